@@ -0,0 +1,223 @@
+package kuniumi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+// Output orders of the batch command.
+const (
+	batchOrderInput      = "input"
+	batchOrderCompletion = "completion"
+)
+
+func (a *App) buildBatchCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "batch [file]",
+		Short: "Call functions for each record of a JSONL file",
+		Long: `Call functions for each record of a JSONL file (or stdin).
+
+Each line is a record {"id": ..., "function": "Add", "args": {"x": 1, "y": 2}},
+where function is a function name or operation ID. One NDJSON line is written
+per record, in input order or in completion order (--order):
+
+  {"id": ..., "result": 3}
+  {"id": ..., "error": "..."}
+
+The command fails if any record fails, after every record has been processed.`,
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			parallel, _ := cmd.Flags().GetInt("parallel")
+			order, _ := cmd.Flags().GetString("order")
+			if parallel < 1 {
+				return fmt.Errorf("--parallel must be at least 1")
+			}
+			if order != batchOrderInput && order != batchOrderCompletion {
+				return fmt.Errorf("invalid order %q: must be input or completion", order)
+			}
+
+			in := cmd.InOrStdin()
+			if len(args) == 1 && args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				in = f
+			}
+
+			total, failed, err := a.runBatch(cmd.Context(), in, cmd.OutOrStdout(), parallel, order)
+			if err != nil {
+				return err
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d records failed", failed, total)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().IntP("parallel", "p", 1, "Number of records processed concurrently")
+	cmd.Flags().String("order", batchOrderInput, "Output order: input or completion")
+	return cmd
+}
+
+// batchRecord is an input record of the batch command.
+type batchRecord struct {
+	ID       json.RawMessage `json:"id"`
+	Function string          `json:"function"`
+	Args     map[string]any  `json:"args"`
+}
+
+// batchJob is a line of the input, numbered from 0.
+type batchJob struct {
+	index int
+	line  []byte
+}
+
+// batchResult is the output of a job.
+type batchResult struct {
+	index  int
+	output []byte
+	failed bool
+}
+
+// runBatch processes the JSONL records read from r with the given parallelism
+// and writes one NDJSON result per record to w. It returns the number of
+// records and of failed records. Blank lines are skipped.
+func (a *App) runBatch(ctx context.Context, r io.Reader, w io.Writer, parallel int, order string) (total, failed int, err error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	jobs := make(chan batchJob)
+	results := make(chan batchResult)
+
+	// Read
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(jobs)
+		in := bufio.NewReader(r)
+		index := 0
+		for {
+			line, err := in.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				select {
+				case jobs <- batchJob{index: index, line: line}:
+					index++
+				case <-ctx.Done():
+					readErr <- ctx.Err()
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr <- err
+				}
+				return
+			}
+		}
+	}()
+
+	// Process
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				output, ok := a.runBatchRecord(ctx, job.line)
+				results <- batchResult{index: job.index, output: output, failed: !ok}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Write
+	out := bufio.NewWriter(w)
+	write := func(res batchResult) {
+		out.Write(res.output)
+		out.WriteByte('\n')
+		// Flush per record so that progress is visible on long runs
+		out.Flush()
+	}
+	pending := map[int]batchResult{}
+	next := 0
+	for res := range results {
+		total++
+		if res.failed {
+			failed++
+		}
+		if order == batchOrderCompletion {
+			write(res)
+			continue
+		}
+		pending[res.index] = res
+		for {
+			res, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			write(res)
+			next++
+		}
+	}
+
+	select {
+	case err = <-readErr:
+	default:
+	}
+	return total, failed, err
+}
+
+// runBatchRecord calls the function of a record and returns its encoded
+// output line and whether the call succeeded.
+func (a *App) runBatchRecord(ctx context.Context, line []byte) (out []byte, ok bool) {
+	var rec batchRecord
+	fail := func(msg string) ([]byte, bool) {
+		out, _ := json.Marshal(map[string]any{"id": rec.ID, "error": msg})
+		return out, false
+	}
+	// A panicking function fails its record, not the whole batch
+	defer func() {
+		if r := recover(); r != nil {
+			out, ok = fail(fmt.Sprintf("Function panicked: %v", r))
+		}
+	}()
+
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return fail(fmt.Sprintf("Invalid record: %v", err))
+	}
+	fn := a.findFunction(rec.Function)
+	if fn == nil {
+		return fail(fmt.Sprintf("Function not found: %s", rec.Function))
+	}
+
+	// Every record gets its own environment, as records may run concurrently
+	results, err := CallFunction(a.ContextWithEnv(ctx), fn.Meta, rec.Args)
+	if err != nil {
+		return fail(fmt.Sprintf("Function error: %v", err))
+	}
+	if results, err = jsonResults(results); err != nil {
+		return fail(err.Error())
+	}
+
+	response := buildSuccessResponse(results)
+	response["id"] = rec.ID
+	out, err = json.Marshal(response)
+	if err != nil {
+		return fail(fmt.Sprintf("Failed to encode result: %v", err))
+	}
+	return out, true
+}
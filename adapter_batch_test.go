@@ -0,0 +1,138 @@
+package kuniumi
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sleepMs(ctx context.Context, ms int) (int, error) {
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	return ms, nil
+}
+
+func newBatchTestApp() *App {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	app.RegisterFunc(addInts, "adds", WithParams(Param("x", "x"), Param("y", "y")))
+	app.RegisterFunc(sleepMs, "sleeps", WithArgs("ms"))
+	return app
+}
+
+func TestRunBatch(t *testing.T) {
+	app := newBatchTestApp()
+	input := strings.Join([]string{
+		`{"id": 1, "function": "addInts", "args": {"x": 1, "y": 2}}`,
+		``,
+		`{"id": "b", "function": "functions.addInts", "args": {"x": "nope"}}`,
+		`{"id": 3, "function": "Missing"}`,
+		`not json`,
+		`{"function": "addInts", "args": {"x": 5}}`,
+	}, "\n")
+
+	var out bytes.Buffer
+	total, failed, err := app.runBatch(context.Background(), strings.NewReader(input), &out, 1, batchOrderInput)
+	require.NoError(t, err)
+	assert.Equal(t, 5, total)
+	assert.Equal(t, 3, failed)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 5)
+	assert.JSONEq(t, `{"id": 1, "result": 3}`, lines[0])
+	assert.Contains(t, lines[1], `"id":"b"`)
+	assert.Contains(t, lines[1], `"error":"Function error: cannot convert string`)
+	assert.JSONEq(t, `{"id": 3, "error": "Function not found: Missing"}`, lines[2])
+	assert.Contains(t, lines[3], `"error":"Invalid record:`)
+	assert.Contains(t, lines[3], `"id":null`)
+	assert.JSONEq(t, `{"id": null, "result": 5}`, lines[4])
+}
+
+func TestRunBatch_Panic(t *testing.T) {
+	app := newBatchTestApp()
+	app.RegisterFunc(func(ctx context.Context) error {
+		panic("unexpected")
+	}, "panics")
+	panics := app.functions[len(app.functions)-1].Name
+
+	input := `{"id": 1, "function": "addInts", "args": {"x": 1, "y": 2}}
+{"id": 2, "function": "` + panics + `"}
+{"id": 3, "function": "addInts", "args": {"x": 3, "y": 4}}
+`
+	for _, parallel := range []int{1, 2} {
+		var out bytes.Buffer
+		total, failed, err := app.runBatch(context.Background(), strings.NewReader(input), &out, parallel, batchOrderInput)
+		require.NoError(t, err)
+		assert.Equal(t, 3, total)
+		assert.Equal(t, 1, failed)
+		assert.Equal(t, `{"id":1,"result":3}
+{"error":"Function panicked: unexpected","id":2}
+{"id":3,"result":7}
+`, out.String())
+	}
+}
+
+func TestRunBatch_Order(t *testing.T) {
+	app := newBatchTestApp()
+	// The first record finishes last
+	input := `{"id": 1, "function": "sleepMs", "args": {"ms": 200}}
+{"id": 2, "function": "sleepMs", "args": {"ms": 1}}
+{"id": 3, "function": "sleepMs", "args": {"ms": 1}}
+`
+
+	var out bytes.Buffer
+	_, _, err := app.runBatch(context.Background(), strings.NewReader(input), &out, 3, batchOrderInput)
+	require.NoError(t, err)
+	assert.Equal(t, `{"id":1,"result":200}
+{"id":2,"result":1}
+{"id":3,"result":1}
+`, out.String())
+
+	out.Reset()
+	_, _, err = app.runBatch(context.Background(), strings.NewReader(input), &out, 3, batchOrderCompletion)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, `{"id":1,"result":200}`, lines[2])
+}
+
+func TestRunBatch_BinaryResult(t *testing.T) {
+	readers := make(chan *closeTrackingReader, 1)
+	app := newReaderApp(readers)
+
+	var out bytes.Buffer
+	input := `{"id": 1, "function": "` + app.functions[0].Name + `"}`
+	_, failed, err := app.runBatch(context.Background(), strings.NewReader(input), &out, 1, batchOrderInput)
+	require.NoError(t, err)
+	assert.Zero(t, failed)
+	assert.JSONEq(t, `{"id": 1, "result": `+readerResultJSON+`}`, out.String())
+	assert.True(t, (<-readers).closed.Load())
+}
+
+func TestBatchCmd(t *testing.T) {
+	app := newBatchTestApp()
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	require.NoError(t, os.WriteFile(path, []byte(`{"id": 1, "function": "addInts", "args": {"x": 1, "y": 1}}
+{"id": 2, "function": "Missing"}
+`), 0644))
+
+	cmd := app.buildBatchCmd()
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetErr(&bytes.Buffer{})
+	cmd.SetArgs([]string{path, "--parallel", "2"})
+	err := cmd.Execute()
+
+	assert.EqualError(t, err, "1 of 2 records failed")
+	assert.Equal(t, `{"id":1,"result":2}
+{"error":"Function not found: Missing","id":2}
+`, out.String())
+
+	cmd.SetArgs([]string{path, "--order", "random"})
+	assert.ErrorContains(t, cmd.Execute(), "invalid order")
+}
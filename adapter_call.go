@@ -0,0 +1,318 @@
+package kuniumi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.yaml.in/yaml/v3"
+)
+
+// Output formats of the call command.
+const (
+	callOutputJSON  = "json"
+	callOutputYAML  = "yaml"
+	callOutputTable = "table"
+)
+
+// callReservedFlags are the flags of every function subcommand, including the
+// global --env and --mount. Arguments with the same name can only be given
+// through --json.
+var callReservedFlags = map[string]bool{"json": true, "output": true, "help": true, "env": true, "mount": true}
+
+func (a *App) buildCallCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "call",
+		Short: "Call a registered function from the command line",
+		Long: `Call a registered function from the command line.
+
+Each function is a subcommand whose flags are the function arguments:
+
+  app call Add --x 1 --y 2
+
+Arguments can also be given as a JSON object with --json, or read from stdin
+with --json -. Flags take precedence over the JSON object.`,
+	}
+	for _, fn := range a.functions {
+		cmd.AddCommand(a.buildCallFuncCmd(fn))
+	}
+	return cmd
+}
+
+// buildCallFuncCmd returns the call subcommand of fn, with one typed flag per argument.
+func (a *App) buildCallFuncCmd(fn *RegisteredFunc) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   fn.Name,
+		Short: fn.Description,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output, _ := cmd.Flags().GetString("output")
+			switch output {
+			case callOutputJSON, callOutputYAML, callOutputTable:
+			default:
+				return fmt.Errorf("invalid output format %q: must be json, yaml or table", output)
+			}
+
+			fnArgs, err := callArgs(cmd, fn)
+			if err != nil {
+				return err
+			}
+
+			ctx := a.ContextWithEnv(cmd.Context())
+			results, err := CallFunction(ctx, fn.Meta, fnArgs)
+			if err != nil {
+				return err
+			}
+
+			if bin, ok := binaryResult(results); ok {
+				defer bin.Close()
+				_, err := io.Copy(cmd.OutOrStdout(), bin.body)
+				return err
+			}
+			return writeCallOutput(cmd.OutOrStdout(), output, buildSuccessResponse(results))
+		},
+	}
+
+	cmd.Flags().String("json", "", `Arguments as a JSON object ("-" reads it from stdin)`)
+	cmd.Flags().StringP("output", "o", callOutputJSON, "Output format: json, yaml or table")
+	for _, arg := range fn.Meta.Args {
+		if callReservedFlags[arg.Name] {
+			continue
+		}
+		addArgFlag(cmd.Flags(), arg)
+	}
+	return cmd
+}
+
+// addArgFlag defines the flag of a function argument, typed after its Go type.
+// Arguments of other types (structs, maps, non-string slices) take a JSON value.
+func addArgFlag(flags *pflag.FlagSet, arg ArgMetadata) {
+	usage := arg.Description
+	switch arg.Type.Kind() {
+	case reflect.String:
+		flags.String(arg.Name, "", usage)
+	case reflect.Bool:
+		flags.Bool(arg.Name, false, usage)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		flags.Int64(arg.Name, 0, usage)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		flags.Uint64(arg.Name, 0, usage)
+	case reflect.Float32, reflect.Float64:
+		flags.Float64(arg.Name, 0, usage)
+	default:
+		if arg.Type.Kind() == reflect.Slice && arg.Type.Elem().Kind() == reflect.String {
+			flags.StringSlice(arg.Name, nil, usage)
+			return
+		}
+		if usage != "" {
+			usage += " "
+		}
+		flags.String(arg.Name, "", usage+"(JSON)")
+	}
+}
+
+// callArgs collects the function arguments from --json and the argument flags.
+// Only flags set on the command line are included, so missing arguments keep
+// their zero value as with the other adapters.
+func callArgs(cmd *cobra.Command, fn *RegisteredFunc) (map[string]any, error) {
+	args := map[string]any{}
+
+	if input, _ := cmd.Flags().GetString("json"); input != "" {
+		data := []byte(input)
+		if input == "-" {
+			var err error
+			if data, err = io.ReadAll(cmd.InOrStdin()); err != nil {
+				return nil, fmt.Errorf("failed to read stdin: %w", err)
+			}
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			if err := json.Unmarshal(data, &args); err != nil {
+				return nil, fmt.Errorf("invalid JSON arguments: %w", err)
+			}
+		}
+	}
+
+	for _, arg := range fn.Meta.Args {
+		flag := cmd.Flags().Lookup(arg.Name)
+		if flag == nil || !flag.Changed || callReservedFlags[arg.Name] {
+			continue
+		}
+		v, err := argFlagValue(cmd.Flags(), arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for --%s: %w", arg.Name, err)
+		}
+		args[arg.Name] = v
+	}
+	return args, nil
+}
+
+// argFlagValue returns the value of the flag defined by addArgFlag for arg.
+func argFlagValue(flags *pflag.FlagSet, arg ArgMetadata) (any, error) {
+	switch arg.Type.Kind() {
+	case reflect.String:
+		return flags.GetString(arg.Name)
+	case reflect.Bool:
+		return flags.GetBool(arg.Name)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return flags.GetInt64(arg.Name)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return flags.GetUint64(arg.Name)
+	case reflect.Float32, reflect.Float64:
+		return flags.GetFloat64(arg.Name)
+	}
+	if arg.Type.Kind() == reflect.Slice && arg.Type.Elem().Kind() == reflect.String {
+		return flags.GetStringSlice(arg.Name)
+	}
+
+	// Decode JSON values into the argument type itself
+	s, err := flags.GetString(arg.Name)
+	if err != nil {
+		return nil, err
+	}
+	ptr := reflect.New(arg.Type)
+	if err := json.Unmarshal([]byte(s), ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+// writeCallOutput renders the response in the given format.
+func writeCallOutput(w io.Writer, format string, response map[string]any) error {
+	// Round-trip through JSON so that YAML and tables follow the json struct tags
+	// and look the same as the responses of the other adapters.
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case callOutputYAML:
+		var v any
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		return enc.Close()
+	case callOutputTable:
+		var v map[string]any
+		if err := unmarshalJSONNumber(data, &v); err != nil {
+			return err
+		}
+		return writeTable(w, v)
+	default:
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, data, "", "  "); err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+		_, err := buf.WriteTo(w)
+		return err
+	}
+}
+
+// unmarshalJSONNumber decodes JSON keeping numbers as json.Number, so that
+// large integers are printed exactly.
+func unmarshalJSONNumber(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// writeTable renders a response as a table:
+//   - a list of objects has one row per object and one column per key,
+//   - an object has one KEY/VALUE row per field,
+//   - any other value is printed as is.
+//
+// A single result is rendered on its own; several results are rendered as an object.
+func writeTable(w io.Writer, response map[string]any) error {
+	var v any = response
+	if result, ok := response["result"]; ok && len(response) == 1 {
+		v = result
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	switch v := v.(type) {
+	case []any:
+		columns, ok := tableColumns(v)
+		if !ok {
+			for _, item := range v {
+				fmt.Fprintln(tw, tableCell(item))
+			}
+			break
+		}
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(columns, "\t")))
+		for _, item := range v {
+			row := item.(map[string]any)
+			cells := make([]string, len(columns))
+			for i, col := range columns {
+				if cell, ok := row[col]; ok {
+					cells[i] = tableCell(cell)
+				}
+			}
+			fmt.Fprintln(tw, strings.Join(cells, "\t"))
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Fprintln(tw, "KEY\tVALUE")
+		for _, k := range keys {
+			fmt.Fprintf(tw, "%s\t%s\n", k, tableCell(v[k]))
+		}
+	default:
+		fmt.Fprintln(tw, tableCell(v))
+	}
+	return tw.Flush()
+}
+
+// tableColumns returns the sorted union of the keys of items, or false if
+// items is empty or not a list of objects.
+func tableColumns(items []any) ([]string, bool) {
+	if len(items) == 0 {
+		return nil, false
+	}
+	seen := map[string]bool{}
+	var columns []string
+	for _, item := range items {
+		row, ok := item.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		for k := range row {
+			if !seen[k] {
+				seen[k] = true
+				columns = append(columns, k)
+			}
+		}
+	}
+	sort.Strings(columns)
+	return columns, true
+}
+
+// tableCell formats a value for a table cell. Nested values are compact JSON.
+func tableCell(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number, bool:
+		return fmt.Sprint(v)
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
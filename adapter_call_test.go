@@ -0,0 +1,144 @@
+package kuniumi
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type callTestUser struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+func listUsers(ctx context.Context, prefix string, limit uint, tags []string, filter map[string]int) ([]callTestUser, error) {
+	users := []callTestUser{{Name: prefix + "alice", Age: 30}, {Name: prefix + "bob", Age: filter["age"]}}
+	return users[:limit], nil
+}
+
+func newCallTestApp() *App {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	app.RegisterFunc(addInts, "Adds two integers", WithParams(Param("x", "First integer"), Param("y", "Second integer")))
+	app.RegisterFunc(listUsers, "Lists users", WithArgs("prefix", "limit", "tags", "filter"))
+	app.RegisterFunc(renderChart, "Renders a chart")
+	return app
+}
+
+func runCall(t *testing.T, app *App, stdin string, args ...string) (string, error) {
+	t.Helper()
+	cmd := app.buildCallCmd()
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetErr(&out)
+	cmd.SetIn(strings.NewReader(stdin))
+	cmd.SetArgs(args)
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+func TestCallCmd(t *testing.T) {
+	app := newCallTestApp()
+
+	t.Run("typed flags", func(t *testing.T) {
+		out, err := runCall(t, app, "", "addInts", "--x", "1", "--y", "2")
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"result": 3}`, out)
+	})
+
+	t.Run("flag descriptions", func(t *testing.T) {
+		cmd := app.buildCallCmd()
+		sub, _, err := cmd.Find([]string{"addInts"})
+		require.NoError(t, err)
+		assert.Equal(t, "Adds two integers", sub.Short)
+		assert.Equal(t, "First integer", sub.Flags().Lookup("x").Usage)
+		assert.Equal(t, "int64", sub.Flags().Lookup("x").Value.Type())
+	})
+
+	t.Run("invalid flag value", func(t *testing.T) {
+		_, err := runCall(t, app, "", "addInts", "--x", "one")
+		assert.Error(t, err)
+	})
+
+	t.Run("json input", func(t *testing.T) {
+		out, err := runCall(t, app, "", "addInts", "--json", `{"x": 10, "y": 20}`)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"result": 30}`, out)
+	})
+
+	t.Run("json from stdin with flag override", func(t *testing.T) {
+		out, err := runCall(t, app, `{"x": 10, "y": 20}`, "addInts", "--json", "-", "--y", "5")
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"result": 15}`, out)
+	})
+
+	t.Run("invalid json", func(t *testing.T) {
+		_, err := runCall(t, app, "", "addInts", "--json", `{"x":`)
+		assert.ErrorContains(t, err, "invalid JSON arguments")
+	})
+
+	t.Run("slice and JSON flags", func(t *testing.T) {
+		out, err := runCall(t, app, "", "listUsers",
+			"--prefix", "u-", "--limit", "2", "--tags", "a,b", "--filter", `{"age": 40}`)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"result": [{"name": "u-alice", "age": 30}, {"name": "u-bob", "age": 40}]}`, out)
+	})
+
+	t.Run("yaml output", func(t *testing.T) {
+		out, err := runCall(t, app, "", "listUsers", "--limit", "1", "-o", "yaml")
+		require.NoError(t, err)
+		assert.Equal(t, "result:\n  - age: 30\n    name: alice\n", out)
+	})
+
+	t.Run("table output", func(t *testing.T) {
+		out, err := runCall(t, app, "", "listUsers", "--limit", "2", "--filter", `{"age": 25}`, "-o", "table")
+		require.NoError(t, err)
+		assert.Equal(t, "AGE  NAME\n30   alice\n25   bob\n", out)
+
+		out, err = runCall(t, app, "", "addInts", "--x", "4", "-o", "table")
+		require.NoError(t, err)
+		assert.Equal(t, "4\n", out)
+	})
+
+	t.Run("invalid output format", func(t *testing.T) {
+		_, err := runCall(t, app, "", "addInts", "-o", "xml")
+		assert.ErrorContains(t, err, "invalid output format")
+	})
+
+	t.Run("binary result", func(t *testing.T) {
+		out, err := runCall(t, app, "", "renderChart")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(out, "\x89PNG"), "raw bytes expected, got %q", out)
+	})
+
+	t.Run("reserved argument names", func(t *testing.T) {
+		app := New(Config{Name: "test", Version: "1.0.0"})
+		app.RegisterFunc(func(ctx context.Context, env string, mount string) (string, error) {
+			return env + " " + mount, nil
+		}, "Echoes its arguments", WithArgs("env", "mount"))
+		app.rootCmd.AddCommand(app.buildCallCmd())
+
+		sub, _, err := app.rootCmd.Find([]string{"call", app.functions[0].Name})
+		require.NoError(t, err)
+		assert.Nil(t, sub.LocalNonPersistentFlags().Lookup("env"), "--env is the global flag")
+		assert.Nil(t, sub.LocalNonPersistentFlags().Lookup("mount"), "--mount is the global flag")
+
+		out, err := runCall(t, app, "", app.functions[0].Name, "--json", `{"env": "prod", "mount": "/data"}`)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"result": "prod /data"}`, out)
+	})
+
+	t.Run("unknown function", func(t *testing.T) {
+		_, err := runCall(t, app, "", "Missing")
+		assert.Error(t, err)
+	})
+}
+
+func TestWriteTable_Object(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeCallOutput(&buf, callOutputTable, map[string]any{"result0": 1, "result1": "two"}))
+	assert.Equal(t, "KEY      VALUE\nresult0  1\nresult1  two\n", buf.String())
+}
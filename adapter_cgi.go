@@ -1,11 +1,16 @@
 package kuniumi
 
 import (
+	"bufio"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	vpath "path"
+	"strconv"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -15,69 +20,262 @@ func (a *App) buildCgiCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "cgi",
 		Short: "Execute a registered function directly (CGI mode)",
+		Long: `Handle a single CGI/1.1 (RFC 3875) request.
+
+The function is selected by PATH_INFO (e.g. /Add or /functions/Add), or by the
+last segment of SCRIPT_NAME when PATH_INFO is empty. Functions accept POST;
+/openapi.json accepts GET and HEAD. The JSON body is read from stdin, bounded
+by CONTENT_LENGTH.
+
+When run by hand (GATEWAY_INTERFACE unset), REQUEST_METHOD defaults to POST
+and the body is read until EOF if CONTENT_LENGTH is not set.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			// 1. Determine which function to call.
-			// PATH_INFO usually contains the path. e.g. /Add
-			pathInfo := os.Getenv("PATH_INFO")
-			pathInfo = strings.TrimPrefix(pathInfo, "/")
-
-			// OpenAPI spec request
-			if pathInfo == "openapi.json" {
-				fmt.Printf("Content-Type: application/json\r\nStatus: 200 OK\r\n\r\n")
-				spec := a.generateOpenAPISpec()
-				json.NewEncoder(os.Stdout).Encode(spec)
-				return nil
-			}
-
-			// Normalize: if pathInfo is "functions/Add", handle it.
-			// Or just "Add".
-			fnName := pathInfo
-			fnName = strings.TrimPrefix(fnName, "functions/")
-
-			var targetFn *RegisteredFunc
-			for _, fn := range a.functions {
-				if fn.Name == fnName {
-					targetFn = fn
-					break
-				}
-			}
-
-		if targetFn == nil {
-			fmt.Printf("Content-Type: application/json\r\nStatus: 404 Not Found\r\n\r\n")
-			json.NewEncoder(os.Stdout).Encode(buildErrorResponse(
-				fmt.Sprintf("Function not found: %s", fnName)))
-			return nil
+			return a.serveCgi(cmd.Context(), cgiEnvMap(os.Environ()), os.Stdin, os.Stdout)
+		},
+	}
+	return cmd
+}
+
+// serveCgi handles a single CGI request described by env, reading the request
+// body from stdin and writing the CGI response to stdout.
+func (a *App) serveCgi(ctx context.Context, env map[string]string, stdin io.Reader, stdout io.Writer) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	w := newCgiResponseWriter(stdout)
+
+	creq, err := parseCgiRequest(env)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return w.finish()
+	}
+	w.discardBody = creq.Method == http.MethodHead
+
+	r := creq.httpRequest(ctx, stdin)
+	a.routeRequest(w, r, creq.route())
+	return w.finish()
+}
+
+// routeRequest dispatches a request to the OpenAPI document or to a function.
+// route is "openapi.json", "functions/{name}" or just "{name}".
+// It is used by the adapters that do not go through the serve mux (cgi, lambda).
+func (a *App) routeRequest(w http.ResponseWriter, r *http.Request, route string) {
+	// OpenAPI spec request
+	if route == "openapi.json" {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeJSONError(w, fmt.Sprintf("Method not allowed: %s", r.Method), http.StatusMethodNotAllowed)
+			return
 		}
+		a.serveOpenAPI(w, r)
+		return
+	}
 
-			// 2. Read Body
-			// If POST, read Stdin.
-			// We expect JSON body.
-			var inputArgs map[string]interface{}
-
-			// Basic check for content length if needed, but JSON decoder is enough
-		if err := json.NewDecoder(os.Stdin).Decode(&inputArgs); err != nil && err != io.EOF {
-			fmt.Printf("Content-Type: application/json\r\nStatus: 400 Bad Request\r\n\r\n")
-			json.NewEncoder(os.Stdout).Encode(buildErrorResponse(
-				fmt.Sprintf("Invalid JSON: %v", err)))
-			return nil
+	// Normalize: if route is "functions/Add", handle it.
+	// Or just "Add".
+	fnName := strings.TrimPrefix(route, "functions/")
+	targetFn := a.findFunction(fnName)
+	if targetFn == nil {
+		writeJSONError(w, fmt.Sprintf("Function not found: %s", fnName), http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, fmt.Sprintf("Method not allowed: %s", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.createHttpHandler(targetFn)(w, r)
+}
+
+// cgiRequest is a CGI/1.1 request built from the RFC 3875 meta-variables.
+type cgiRequest struct {
+	Method      string
+	ScriptName  string
+	PathInfo    string
+	QueryString string
+	// ContentLength is the body length, or -1 if CONTENT_LENGTH is not set.
+	ContentLength int64
+	Header        http.Header
+	Host          string
+	RemoteAddr    string
+	HTTPS         bool
+	// Gateway is true when the request comes from a web server
+	// (GATEWAY_INTERFACE is set), and false when the program is run by hand.
+	Gateway bool
+}
+
+// parseCgiRequest builds a cgiRequest from the CGI meta-variables in env.
+func parseCgiRequest(env map[string]string) (*cgiRequest, error) {
+	creq := &cgiRequest{
+		Method:        strings.ToUpper(env["REQUEST_METHOD"]),
+		ScriptName:    env["SCRIPT_NAME"],
+		PathInfo:      env["PATH_INFO"],
+		QueryString:   env["QUERY_STRING"],
+		ContentLength: -1,
+		Header:        http.Header{},
+		Host:          env["HTTP_HOST"],
+		RemoteAddr:    env["REMOTE_ADDR"],
+		Gateway:       env["GATEWAY_INTERFACE"] != "",
+	}
+
+	if creq.Method == "" {
+		if creq.Gateway {
+			return nil, fmt.Errorf("missing REQUEST_METHOD")
 		}
+		creq.Method = http.MethodPost
+	}
 
-			// 3. Setup Context
-			ctx := a.ContextWithEnv(context.Background())
+	if s := env["CONTENT_LENGTH"]; s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid CONTENT_LENGTH: %q", s)
+		}
+		creq.ContentLength = n
+	}
 
-			// 4. Call Function
-		results, err := CallFunction(ctx, targetFn.Meta, inputArgs)
-		if err != nil {
-			fmt.Printf("Content-Type: application/json\r\nStatus: 500 Internal Server Error\r\n\r\n")
-			json.NewEncoder(os.Stdout).Encode(buildErrorResponse(
-				fmt.Sprintf("Error: %v", err)))
-			return nil
+	if ct := env["CONTENT_TYPE"]; ct != "" {
+		creq.Header.Set("Content-Type", ct)
+	}
+	// Copy "HTTP_FOO_BAR" variables to "Foo-Bar" headers
+	for k, v := range env {
+		if name, ok := strings.CutPrefix(k, "HTTP_"); ok {
+			creq.Header.Add(strings.ReplaceAll(name, "_", "-"), v)
 		}
+	}
 
-		fmt.Printf("Content-Type: application/json\r\nStatus: 200 OK\r\n\r\n")
-		json.NewEncoder(os.Stdout).Encode(buildSuccessResponse(results))
-			return nil
-		},
+	if port := env["REMOTE_PORT"]; port != "" && creq.RemoteAddr != "" {
+		creq.RemoteAddr = net.JoinHostPort(creq.RemoteAddr, port)
 	}
-	return cmd
+	switch env["HTTPS"] {
+	case "on", "ON", "1":
+		creq.HTTPS = true
+	}
+
+	return creq, nil
+}
+
+// route returns the route selected by the request: PATH_INFO, or the last
+// segment of SCRIPT_NAME when PATH_INFO is empty (e.g. /cgi-bin/Add).
+func (c *cgiRequest) route() string {
+	route := strings.Trim(c.PathInfo, "/")
+	if route == "" && c.ScriptName != "" {
+		route = vpath.Base(c.ScriptName)
+	}
+	return route
+}
+
+// body returns the request body read from stdin.
+// Reads are bounded by CONTENT_LENGTH, so a server keeping stdin open does not
+// block the request. Without CONTENT_LENGTH there is no body, except when run
+// by hand, where a POST body is read until EOF.
+func (c *cgiRequest) body(stdin io.Reader) io.Reader {
+	switch {
+	case c.ContentLength >= 0:
+		return io.LimitReader(stdin, c.ContentLength)
+	case !c.Gateway && c.Method != http.MethodGet && c.Method != http.MethodHead:
+		return stdin
+	default:
+		return http.NoBody
+	}
+}
+
+// httpRequest converts the CGI request into an http.Request whose context
+// carries the request metadata.
+func (c *cgiRequest) httpRequest(ctx context.Context, stdin io.Reader) *http.Request {
+	u := &url.URL{
+		Path:     c.ScriptName + c.PathInfo,
+		RawQuery: c.QueryString,
+	}
+	r := &http.Request{
+		Method:        c.Method,
+		URL:           u,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        c.Header,
+		Body:          io.NopCloser(c.body(stdin)),
+		ContentLength: c.ContentLength,
+		Host:          c.Host,
+		RemoteAddr:    c.RemoteAddr,
+		RequestURI:    u.RequestURI(),
+	}
+	if r.ContentLength < 0 {
+		r.ContentLength = 0
+	}
+
+	info := newRequestInfo(r)
+	info.ScriptName = c.ScriptName
+	info.PathInfo = c.PathInfo
+	return r.WithContext(withRequestInfo(ctx, info))
+}
+
+// cgiEnvMap converts "KEY=VALUE" entries into a map.
+func cgiEnvMap(environ []string) map[string]string {
+	env := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+// cgiResponseWriter is an http.ResponseWriter that writes a CGI response:
+// a "Status:" line and the headers, a blank line, then the body.
+type cgiResponseWriter struct {
+	out         *bufio.Writer
+	header      http.Header
+	wroteHeader bool
+	discardBody bool // HEAD requests
+}
+
+func newCgiResponseWriter(out io.Writer) *cgiResponseWriter {
+	return &cgiResponseWriter{
+		out:    bufio.NewWriter(out),
+		header: http.Header{},
+	}
+}
+
+func (w *cgiResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *cgiResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.header.Get("Content-Type") == "" {
+		w.header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	fmt.Fprintf(w.out, "Status: %d %s\r\n", code, http.StatusText(code))
+	w.header.Write(w.out)
+	w.out.WriteString("\r\n")
+}
+
+func (w *cgiResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discardBody {
+		return len(p), nil
+	}
+	return w.out.Write(p)
+}
+
+// Flush implements http.Flusher.
+func (w *cgiResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.out.Flush()
+}
+
+// finish completes the response, writing the headers if nothing was written.
+func (w *cgiResponseWriter) finish() error {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.out.Flush()
 }
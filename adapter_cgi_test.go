@@ -0,0 +1,219 @@
+package kuniumi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingReader never returns, like the stdin of a server that keeps it open.
+type blockingReader struct{}
+
+func (blockingReader) Read(p []byte) (int, error) {
+	select {}
+}
+
+// cgiResponse is a parsed CGI response.
+type cgiResponse struct {
+	status  string
+	headers map[string]string
+	body    string
+}
+
+func parseCgiResponse(t *testing.T, out string) cgiResponse {
+	t.Helper()
+	head, body, ok := strings.Cut(out, "\r\n\r\n")
+	require.True(t, ok, "CGI output should contain header/body separator: %q", out)
+
+	resp := cgiResponse{headers: map[string]string{}, body: body}
+	for _, line := range strings.Split(head, "\r\n") {
+		k, v, ok := strings.Cut(line, ": ")
+		require.True(t, ok, "malformed header line %q", line)
+		if k == "Status" {
+			resp.status = v
+		} else {
+			resp.headers[k] = v
+		}
+	}
+	return resp
+}
+
+func runCgi(t *testing.T, app *App, env map[string]string, stdin io.Reader) cgiResponse {
+	t.Helper()
+	var out bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		done <- app.serveCgi(context.Background(), env, stdin, &out)
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("CGI request did not complete")
+	}
+	return parseCgiResponse(t, out.String())
+}
+
+func newCgiTestApp() *App {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	app.RegisterFunc(addInts, "adds", WithParams(Param("x", "x"), Param("y", "y")))
+	app.RegisterFunc(func(ctx context.Context) (map[string]any, error) {
+		info := GetRequestInfo(ctx)
+		return map[string]any{
+			"method":     info.Method,
+			"path":       info.Path,
+			"query":      info.Query.Get("q"),
+			"agent":      info.Header.Get("User-Agent"),
+			"remote":     info.RemoteAddr,
+			"scriptName": info.ScriptName,
+			"pathInfo":   info.PathInfo,
+		}, nil
+	}, "echoes request metadata")
+	return app
+}
+
+func TestServeCgi(t *testing.T) {
+	app := newCgiTestApp()
+
+	t.Run("body bounded by CONTENT_LENGTH", func(t *testing.T) {
+		body := `{"x": 1, "y": 2}`
+		resp := runCgi(t, app, map[string]string{
+			"GATEWAY_INTERFACE": "CGI/1.1",
+			"REQUEST_METHOD":    "POST",
+			"PATH_INFO":         "/addInts",
+			"CONTENT_TYPE":      "application/json",
+			"CONTENT_LENGTH":    "16",
+		}, io.MultiReader(strings.NewReader(body), blockingReader{}))
+
+		assert.Equal(t, "200 OK", resp.status)
+		assert.Equal(t, "application/json", resp.headers["Content-Type"])
+		assert.JSONEq(t, `{"result":3}`, resp.body)
+	})
+
+	t.Run("no body without CONTENT_LENGTH from a server", func(t *testing.T) {
+		resp := runCgi(t, app, map[string]string{
+			"GATEWAY_INTERFACE": "CGI/1.1",
+			"REQUEST_METHOD":    "POST",
+			"PATH_INFO":         "/functions/addInts",
+		}, blockingReader{})
+
+		assert.Equal(t, "200 OK", resp.status)
+		assert.JSONEq(t, `{"result":0}`, resp.body)
+	})
+
+	t.Run("manual invocation reads until EOF", func(t *testing.T) {
+		resp := runCgi(t, app, map[string]string{
+			"PATH_INFO": "/addInts",
+		}, strings.NewReader(`{"x": 10, "y": 20}`))
+
+		assert.Equal(t, "200 OK", resp.status)
+		assert.JSONEq(t, `{"result":30}`, resp.body)
+	})
+
+	t.Run("route by SCRIPT_NAME", func(t *testing.T) {
+		resp := runCgi(t, app, map[string]string{
+			"GATEWAY_INTERFACE": "CGI/1.1",
+			"REQUEST_METHOD":    "POST",
+			"SCRIPT_NAME":       "/cgi-bin/addInts",
+			"CONTENT_LENGTH":    "8",
+		}, strings.NewReader(`{"x": 5}`))
+
+		assert.Equal(t, "200 OK", resp.status)
+		assert.JSONEq(t, `{"result":5}`, resp.body)
+	})
+
+	t.Run("request metadata", func(t *testing.T) {
+		fnName := app.functions[1].Name
+		resp := runCgi(t, app, map[string]string{
+			"GATEWAY_INTERFACE": "CGI/1.1",
+			"REQUEST_METHOD":    "POST",
+			"SCRIPT_NAME":       "/cgi-bin/app",
+			"PATH_INFO":         "/" + fnName,
+			"QUERY_STRING":      "q=hello",
+			"HTTP_USER_AGENT":   "test-agent",
+			"REMOTE_ADDR":       "192.0.2.1",
+			"REMOTE_PORT":       "4321",
+			"CONTENT_LENGTH":    "0",
+		}, blockingReader{})
+		require.Equal(t, "200 OK", resp.status, resp.body)
+
+		var parsed map[string]map[string]any
+		require.NoError(t, json.Unmarshal([]byte(resp.body), &parsed))
+		assert.Equal(t, map[string]any{
+			"method":     "POST",
+			"path":       "/cgi-bin/app/" + fnName,
+			"query":      "hello",
+			"agent":      "test-agent",
+			"remote":     "192.0.2.1:4321",
+			"scriptName": "/cgi-bin/app",
+			"pathInfo":   "/" + fnName,
+		}, parsed["result"])
+	})
+
+	t.Run("method not allowed", func(t *testing.T) {
+		resp := runCgi(t, app, map[string]string{
+			"GATEWAY_INTERFACE": "CGI/1.1",
+			"REQUEST_METHOD":    "GET",
+			"PATH_INFO":         "/addInts",
+		}, blockingReader{})
+
+		assert.Equal(t, "405 Method Not Allowed", resp.status)
+		assert.Equal(t, "POST", resp.headers["Allow"])
+		assert.Equal(t, "application/json", resp.headers["Content-Type"])
+	})
+
+	t.Run("function not found", func(t *testing.T) {
+		resp := runCgi(t, app, map[string]string{
+			"GATEWAY_INTERFACE": "CGI/1.1",
+			"REQUEST_METHOD":    "POST",
+			"PATH_INFO":         "/Missing",
+			"CONTENT_LENGTH":    "0",
+		}, blockingReader{})
+
+		assert.Equal(t, "404 Not Found", resp.status)
+		assert.Contains(t, resp.body, "Missing")
+	})
+
+	t.Run("openapi", func(t *testing.T) {
+		resp := runCgi(t, app, map[string]string{
+			"GATEWAY_INTERFACE": "CGI/1.1",
+			"REQUEST_METHOD":    "GET",
+			"PATH_INFO":         "/openapi.json",
+		}, blockingReader{})
+		assert.Equal(t, "200 OK", resp.status)
+		assert.Contains(t, resp.body, `"openapi":"3.0.0"`)
+
+		resp = runCgi(t, app, map[string]string{
+			"GATEWAY_INTERFACE": "CGI/1.1",
+			"REQUEST_METHOD":    "HEAD",
+			"PATH_INFO":         "/openapi.json",
+		}, blockingReader{})
+		assert.Equal(t, "200 OK", resp.status)
+		assert.Empty(t, resp.body, "HEAD responses have no body")
+
+		resp = runCgi(t, app, map[string]string{
+			"GATEWAY_INTERFACE": "CGI/1.1",
+			"REQUEST_METHOD":    "POST",
+			"PATH_INFO":         "/openapi.json",
+			"CONTENT_LENGTH":    "0",
+		}, blockingReader{})
+		assert.Equal(t, "405 Method Not Allowed", resp.status)
+	})
+
+	t.Run("invalid CONTENT_LENGTH", func(t *testing.T) {
+		resp := runCgi(t, app, map[string]string{
+			"GATEWAY_INTERFACE": "CGI/1.1",
+			"REQUEST_METHOD":    "POST",
+			"PATH_INFO":         "/addInts",
+			"CONTENT_LENGTH":    "abc",
+		}, blockingReader{})
+		assert.Equal(t, "400 Bad Request", resp.status)
+	})
+}
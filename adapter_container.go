@@ -1,69 +1,110 @@
 package kuniumi
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
+// Entrypoint modes of the container image.
+const (
+	containerModeServe = "serve"
+	containerModeMcp   = "mcp"
+)
+
+// Defaults of the containerize command.
+const (
+	defaultBuilderImage = "golang:1.24-alpine"
+	defaultBaseImage    = "alpine:latest"
+	// defaultContainerUser is the "nonroot" user of distroless images.
+	defaultContainerUser = "65532:65532"
+	defaultContainerPort = 8080
+)
+
 func (a *App) buildContainerizeCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "containerize",
 		Short: "Build a Docker image of this application",
+		Long: `Build a Docker image of this application, or only generate its Dockerfile
+with --output.
+
+The image is built in two stages: the main package (--package) is compiled in
+the builder image, then copied into the base image, which can be scratch or a
+distroless image. The entrypoint runs the app in serve (default) or mcp mode.
+
+The image is built with docker (default), podman or buildah (--builder).
+With several --platform values, the app is cross-compiled in the builder
+stage and a multi-platform image is built (podman and buildah build a
+manifest list; docker builds with buildx and pushes, so it requires --push).
+
+With --builder oci, no container engine is needed: the app is cross-compiled
+with the local Go toolchain for --platform and the image is written to the
+--dest archive, on top of --base-tarball (e.g. the output of docker save or
+skopeo copy) or from scratch. Load it with docker load or podman load, or
+push it with skopeo or crane.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			imageName, _ := cmd.Flags().GetString("image")
 			push, _ := cmd.Flags().GetBool("push")
+			output, _ := cmd.Flags().GetString("output")
 
-			if imageName == "" {
-				return fmt.Errorf("image name is required")
+			opts, err := dockerfileOptionsFromFlags(cmd)
+			if err != nil {
+				return err
 			}
-
-			// Generate Dockerfile
-			dockerfile := `
-FROM golang:1.24-alpine AS builder
-WORKDIR /app
-COPY . .
-RUN go build -o app .
-
-FROM alpine:latest
-WORKDIR /app
-COPY --from=builder /app/app .
-ENTRYPOINT ["./app"]
-`
-			// Create a temporary file for the Dockerfile
-			tmpFile, err := os.CreateTemp("", "dockerfile-kuniumi-*")
+			opts.Labels = a.imageLabels()
+			if opts.Manifest, err = json.Marshal(a.imageManifest()); err != nil {
+				return err
+			}
+			dockerfile, err := renderDockerfile(opts)
 			if err != nil {
-				return fmt.Errorf("failed to create temp file: %w", err)
+				return err
 			}
-			dockerfilename := tmpFile.Name()
-			defer os.Remove(dockerfilename)
 
-			if _, err := tmpFile.Write([]byte(dockerfile)); err != nil {
-				tmpFile.Close()
-				return fmt.Errorf("failed to write dockerfile: %w", err)
-			}
-			if err := tmpFile.Close(); err != nil {
-				return fmt.Errorf("failed to close temp file: %w", err)
+			if output != "" {
+				if output == "-" {
+					_, err := fmt.Fprint(cmd.OutOrStdout(), dockerfile)
+					return err
+				}
+				if err := os.WriteFile(output, []byte(dockerfile), 0644); err != nil {
+					return fmt.Errorf("failed to write dockerfile: %w", err)
+				}
+				fmt.Printf("Wrote %s\n", output)
+				return nil
 			}
 
-			// Build
-			fmt.Printf("Building image %s...\n", imageName)
-			buildCmd := exec.Command("docker", "build", "-f", dockerfilename, "-t", imageName, ".")
-			buildCmd.Stdout = os.Stdout
-			buildCmd.Stderr = os.Stderr
-			if err := buildCmd.Run(); err != nil {
+			builderName, _ := cmd.Flags().GetString("builder")
+			builder, err := a.newImageBuilder(builderName)
+			if err != nil {
+				return err
+			}
+			req := &buildRequest{
+				Image:      imageName,
+				Dockerfile: dockerfile,
+				Context:    ".",
+				Push:       push,
+				Options:    opts,
+			}
+			req.BuildArgs, _ = cmd.Flags().GetStringArray("build-arg")
+			req.Platforms, _ = cmd.Flags().GetStringSlice("platform")
+			req.AuthFile, _ = cmd.Flags().GetString("authfile")
+			if req.OCI, err = ociBuildOptionsFromFlags(cmd); err != nil {
 				return err
 			}
 
-			// Push
+			if err := builder.Build(cmd.Context(), req); err != nil {
+				return err
+			}
 			if push {
-				fmt.Printf("Pushing image %s...\n", imageName)
-				pushCmd := exec.Command("docker", "push", imageName)
-				pushCmd.Stdout = os.Stdout
-				pushCmd.Stderr = os.Stderr
-				if err := pushCmd.Run(); err != nil {
+				if err := builder.Push(cmd.Context(), req); err != nil {
 					return err
 				}
 			}
@@ -72,7 +113,389 @@ ENTRYPOINT ["./app"]
 			return nil
 		},
 	}
-	cmd.Flags().String("image", "", "Docker image name (e.g. my-app:latest)")
+	cmd.Flags().String("image", "", "Image name (e.g. my-app:latest)")
 	cmd.Flags().Bool("push", false, "Push image after build")
+	cmd.Flags().StringP("output", "o", "", `Write the Dockerfile to this path ("-" for stdout) instead of building`)
+	cmd.Flags().String("builder-image", defaultBuilderImage, "Image used to compile the app")
+	cmd.Flags().String("base-image", defaultBaseImage, "Base image of the final stage (e.g. scratch, gcr.io/distroless/static-debian12)")
+	cmd.Flags().String("package", ".", "Path of the main package, relative to the build context")
+	cmd.Flags().StringSlice("tags", nil, "Go build tags")
+	cmd.Flags().String("ldflags", "-s -w", "Go linker flags")
+	cmd.Flags().String("user", defaultContainerUser, `User the app runs as ("" for the image default)`)
+	cmd.Flags().String("mode", containerModeServe, "Default entrypoint mode: serve or mcp")
+	cmd.Flags().Int("port", defaultContainerPort, "Port exposed in serve mode")
+	cmd.Flags().Bool("healthcheck", true, "Add a HEALTHCHECK in serve mode, running the app healthcheck command")
+	cmd.Flags().String("builder", "docker", "Image builder: docker, podman, buildah, or oci to assemble the image without a container engine")
+	cmd.Flags().StringSlice("platform", nil, "Target platforms (os/arch[/variant], e.g. linux/amd64,linux/arm64; default: the native one)")
+	cmd.Flags().StringArray("build-arg", nil, "Build arguments (KEY=VALUE, or KEY to take it from the environment), e.g. GOPROXY")
+	cmd.Flags().String("authfile", "", "Registry auth config (e.g. ~/.docker/config.json)")
+	cmd.Flags().String("base-tarball", "", "Base image of the oci builder: a docker-archive or oci-archive tarball (default: scratch)")
+	cmd.Flags().String("format", imageFormatOCI, "Archive format of the oci builder: oci or docker-archive")
+	cmd.Flags().String("dest", "image.tar", "Archive written by the oci builder")
 	return cmd
 }
+
+// dockerfileOptions configures the generated Dockerfile.
+type dockerfileOptions struct {
+	BuilderImage string
+	BaseImage    string
+	// Package is the path of the main package relative to the build context.
+	Package string
+	Tags    []string
+	LDFlags string
+	// User is the user the app runs as; empty keeps the base image default.
+	User string
+	// Mode is the default entrypoint mode: serve or mcp.
+	Mode string
+	// Port is the port exposed and served in serve mode.
+	Port int
+	// HealthCheck adds a HEALTHCHECK probing /healthz in serve mode.
+	HealthCheck bool
+	// BuildArgs are the names of the build arguments declared in the builder stage.
+	BuildArgs []string
+	// CrossCompile runs the builder stage on the build platform and compiles
+	// for the target platform (TARGETOS/TARGETARCH).
+	CrossCompile bool
+	// Labels are the labels of the image.
+	Labels map[string]string
+	// Manifest is the app manifest written to imageManifestPath, if not empty.
+	Manifest []byte
+}
+
+// dockerfileOptionsFromFlags reads the Dockerfile options of the containerize command.
+func dockerfileOptionsFromFlags(cmd *cobra.Command) (dockerfileOptions, error) {
+	var opts dockerfileOptions
+	opts.BuilderImage, _ = cmd.Flags().GetString("builder-image")
+	opts.BaseImage, _ = cmd.Flags().GetString("base-image")
+	opts.Package, _ = cmd.Flags().GetString("package")
+	opts.Tags, _ = cmd.Flags().GetStringSlice("tags")
+	opts.LDFlags, _ = cmd.Flags().GetString("ldflags")
+	opts.User, _ = cmd.Flags().GetString("user")
+	opts.Mode, _ = cmd.Flags().GetString("mode")
+	opts.Port, _ = cmd.Flags().GetInt("port")
+	opts.HealthCheck, _ = cmd.Flags().GetBool("healthcheck")
+	buildArgs, _ := cmd.Flags().GetStringArray("build-arg")
+	platforms, _ := cmd.Flags().GetStringSlice("platform")
+	for _, arg := range buildArgs {
+		name, _, _ := strings.Cut(arg, "=")
+		if name == "" {
+			return opts, fmt.Errorf("invalid build arg %q", arg)
+		}
+		opts.BuildArgs = append(opts.BuildArgs, name)
+	}
+	opts.CrossCompile = len(platforms) > 0
+
+	if opts.Mode != containerModeServe && opts.Mode != containerModeMcp {
+		return opts, fmt.Errorf("invalid mode %q: must be serve or mcp", opts.Mode)
+	}
+	return opts, nil
+}
+
+var dockerfileTemplate = template.Must(template.New("Dockerfile").Funcs(template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"quote": dockerfileQuote,
+}).Parse(`{{if .Manifest}}# syntax=docker/dockerfile:1
+{{end}}# Generated by kuniumi containerize
+FROM {{if .CrossCompile}}--platform=$BUILDPLATFORM {{end}}{{.BuilderImage}} AS builder
+{{- range .BuildArgs}}
+ARG {{.}}
+{{- end}}
+{{- if .CrossCompile}}
+ARG TARGETOS
+ARG TARGETARCH
+{{- end}}
+WORKDIR /src
+ENV CGO_ENABLED=0
+{{- if .CrossCompile}}
+ENV GOOS=$TARGETOS GOARCH=$TARGETARCH
+{{- end}}
+COPY go.* ./
+RUN go mod download
+COPY . .
+RUN {{json .BuildCommand}}
+
+FROM {{.BaseImage}}
+{{- range .Labels}}
+LABEL {{quote .Key}}={{quote .Value}}
+{{- end}}
+COPY --from=builder /out/app /app/app
+{{- if .Manifest}}
+COPY <<"KUNIUMI_MANIFEST" {{.ManifestPath}}
+{{.Manifest}}
+KUNIUMI_MANIFEST
+{{- end}}
+{{- if .User}}
+USER {{.User}}
+{{- end}}
+{{- if .Serve}}
+EXPOSE {{.Port}}
+{{- if .HealthCheck}}
+HEALTHCHECK --interval=30s --timeout=3s --start-period=5s --retries=3 CMD {{json .HealthCheckCommand}}
+{{- end}}
+{{- end}}
+ENTRYPOINT ["/app/app"]
+CMD {{json .Command}}
+`))
+
+// goBuildCommand returns the command compiling the app to out.
+func goBuildCommand(opts dockerfileOptions, out string) []string {
+	build := []string{"go", "build"}
+	if len(opts.Tags) > 0 {
+		build = append(build, "-tags", strings.Join(opts.Tags, ","))
+	}
+	if opts.LDFlags != "" {
+		build = append(build, "-ldflags", opts.LDFlags)
+	}
+	pkg := opts.Package
+	if pkg == "" {
+		pkg = "."
+	} else if pkg != "." && !strings.HasPrefix(pkg, "./") && !strings.HasPrefix(pkg, "../") {
+		pkg = "./" + pkg
+	}
+	return append(build, "-o", out, pkg)
+}
+
+// containerCommand returns the default command (CMD) of the image.
+func containerCommand(opts dockerfileOptions) []string {
+	if opts.Mode == containerModeServe {
+		return []string{containerModeServe, "--port", fmt.Sprint(opts.Port)}
+	}
+	return []string{containerModeMcp}
+}
+
+// healthCheckCommand returns the command probing /healthz with the
+// healthcheck command of the app. Being in exec form, it needs no shell or
+// HTTP client in the base image.
+func healthCheckCommand(port int) []string {
+	return []string{"/app/app", "healthcheck", "--port", fmt.Sprint(port)}
+}
+
+// dockerfileQuote returns s as a double-quoted Dockerfile string. Unlike
+// JSON, these strings only know the \" \\ and \$ escapes; line breaks,
+// which would end the instruction, are replaced by spaces.
+func dockerfileQuote(s string) string {
+	s = strings.NewReplacer(
+		`\`, `\\`, `"`, `\"`, `$`, `\$`,
+		"\r\n", " ", "\n", " ", "\r", " ",
+	).Replace(s)
+	return `"` + s + `"`
+}
+
+type imageLabel struct{ Key, Value string }
+
+// sortedLabels returns labels sorted by key.
+func sortedLabels(labels map[string]string) []imageLabel {
+	sorted := make([]imageLabel, 0, len(labels))
+	for k, v := range labels {
+		sorted = append(sorted, imageLabel{k, v})
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	return sorted
+}
+
+// renderDockerfile generates the Dockerfile of the app.
+func renderDockerfile(opts dockerfileOptions) (string, error) {
+	build := goBuildCommand(opts, "/out/app")
+	command := containerCommand(opts)
+
+	var sb strings.Builder
+	err := dockerfileTemplate.Execute(&sb, struct {
+		dockerfileOptions
+		BuildCommand       []string
+		Command            []string
+		HealthCheckCommand []string
+		Serve              bool
+		Labels             []imageLabel
+		Manifest           string
+		ManifestPath       string
+	}{
+		dockerfileOptions: dockerfileOptions{
+			BuilderImage: opts.BuilderImage,
+			BaseImage:    opts.BaseImage,
+			BuildArgs:    opts.BuildArgs,
+			CrossCompile: opts.CrossCompile,
+			User:         opts.User,
+			Port:         opts.Port,
+			HealthCheck:  opts.HealthCheck,
+		},
+		BuildCommand:       build,
+		Command:            command,
+		HealthCheckCommand: healthCheckCommand(opts.Port),
+		Serve:              opts.Mode == containerModeServe,
+		Labels:             sortedLabels(opts.Labels),
+		// Written by a heredoc, which has no size limit unlike RUN arguments.
+		// The JSON manifest is a single line, so it cannot end the heredoc.
+		Manifest:     string(opts.Manifest),
+		ManifestPath: imageManifestPath,
+	})
+	return sb.String(), err
+}
+
+// ociBuildOptions configures the oci builder.
+type ociBuildOptions struct {
+	// Platforms are the target platforms; empty means linux on the local
+	// architecture.
+	Platforms []ociPlatform
+	// BaseTarball is the base image archive; empty builds from scratch.
+	BaseTarball string
+	Format      string
+	Dest        string
+	// Image is the reference the image is tagged with.
+	Image string
+}
+
+// ociBuildOptionsFromFlags reads the oci builder options of the containerize command.
+func ociBuildOptionsFromFlags(cmd *cobra.Command) (ociBuildOptions, error) {
+	var o ociBuildOptions
+	o.BaseTarball, _ = cmd.Flags().GetString("base-tarball")
+	o.Format, _ = cmd.Flags().GetString("format")
+	o.Dest, _ = cmd.Flags().GetString("dest")
+
+	if o.Format != imageFormatOCI && o.Format != imageFormatDocker {
+		return o, fmt.Errorf("invalid format %q: must be %s or %s", o.Format, imageFormatOCI, imageFormatDocker)
+	}
+	return o, nil
+}
+
+// buildOCIImage cross-compiles the app and writes its image archive without
+// a container engine. Several platforms make a multi-platform image.
+func (a *App) buildOCIImage(opts dockerfileOptions, o ociBuildOptions) error {
+	platforms := o.Platforms
+	if len(platforms) == 0 {
+		platforms = []ociPlatform{{OS: "linux", Architecture: runtime.GOARCH}}
+	}
+	if len(platforms) > 1 && o.Format == imageFormatDocker {
+		return fmt.Errorf("%s holds a single platform: use --format %s for multi-platform images", imageFormatDocker, imageFormatOCI)
+	}
+
+	now := time.Now().UTC()
+	var images []*ociImage
+	for _, platform := range platforms {
+		img, err := a.buildOCIPlatformImage(opts, o, platform, now)
+		if err != nil {
+			return err
+		}
+		images = append(images, img)
+	}
+
+	ref := o.Image
+	if ref == "" {
+		ref = dnsLabel(a.config.Name) + ":" + a.config.Version
+	}
+	fmt.Printf("Writing %s (%s)...\n", o.Dest, o.Format)
+	f, err := os.Create(o.Dest)
+	if err != nil {
+		return err
+	}
+	if err := writeImageArchive(f, images, o.Format, ref, now); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// buildOCIPlatformImage returns the image of the app for platform.
+func (a *App) buildOCIPlatformImage(opts dockerfileOptions, o ociBuildOptions, platform ociPlatform, now time.Time) (*ociImage, error) {
+	fmt.Printf("Compiling for %s...\n", platform)
+	binary, err := compileApp(opts, platform)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &ociImage{config: map[string]any{}}
+	if o.BaseTarball != "" {
+		if img, err = readImageArchive(o.BaseTarball, platform); err != nil {
+			return nil, err
+		}
+		if p := img.platform(); p.Architecture != "" && !platformMatches(p, platform) {
+			return nil, fmt.Errorf("%s: base image is %s, not %s", o.BaseTarball, p, platform)
+		}
+	}
+
+	files := []layerFile{{name: "app/app", mode: 0755, data: binary}}
+	if len(opts.Manifest) > 0 {
+		files = append(files, layerFile{name: strings.TrimPrefix(imageManifestPath, "/"), mode: 0644, data: opts.Manifest})
+	}
+	layer, err := newFileLayer(files, now)
+	if err != nil {
+		return nil, err
+	}
+	img.addLayer(layer, "kuniumi containerize", now)
+	configureImage(img, opts, platform, now)
+	return img, nil
+}
+
+// compileApp cross-compiles the main package for platform and returns the binary.
+func compileApp(opts dockerfileOptions, platform ociPlatform) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "kuniumi-build-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "app")
+
+	args := goBuildCommand(opts, out)
+	build := exec.Command(args[0], args[1:]...)
+	build.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS="+platform.OS, "GOARCH="+platform.Architecture)
+	if platform.Architecture == "arm" && platform.Variant != "" {
+		build.Env = append(build.Env, "GOARM="+strings.TrimPrefix(platform.Variant, "v"))
+	}
+	build.Stdout = os.Stdout
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		return nil, fmt.Errorf("go build failed: %w", err)
+	}
+	return os.ReadFile(out)
+}
+
+// configureImage sets the platform and execution parameters of img, as the
+// Dockerfile does.
+func configureImage(img *ociImage, opts dockerfileOptions, platform ociPlatform, created time.Time) {
+	img.config["created"] = created.Format(time.RFC3339)
+	img.config["os"] = platform.OS
+	img.config["architecture"] = platform.Architecture
+	if platform.Variant != "" {
+		img.config["variant"] = platform.Variant
+	} else {
+		delete(img.config, "variant")
+	}
+
+	cfg := img.runConfig()
+	if len(opts.Labels) > 0 {
+		// Labels of the base image are kept
+		labels, ok := cfg["Labels"].(map[string]any)
+		if !ok {
+			labels = map[string]any{}
+			cfg["Labels"] = labels
+		}
+		for k, v := range opts.Labels {
+			labels[k] = v
+		}
+	}
+	cfg["Entrypoint"] = []string{"/app/app"}
+	cfg["Cmd"] = containerCommand(opts)
+	if opts.User != "" {
+		cfg["User"] = opts.User
+	}
+	if opts.Mode != containerModeServe {
+		return
+	}
+	ports, ok := cfg["ExposedPorts"].(map[string]any)
+	if !ok {
+		ports = map[string]any{}
+		cfg["ExposedPorts"] = ports
+	}
+	ports[fmt.Sprintf("%d/tcp", opts.Port)] = map[string]any{}
+	if opts.HealthCheck {
+		cfg["Healthcheck"] = map[string]any{
+			"Test":        append([]string{"CMD"}, healthCheckCommand(opts.Port)...),
+			"Interval":    int64(30 * time.Second),
+			"Timeout":     int64(3 * time.Second),
+			"StartPeriod": int64(5 * time.Second),
+			"Retries":     3,
+		}
+	}
+}
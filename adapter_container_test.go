@@ -0,0 +1,174 @@
+package kuniumi
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// defaultDockerfileOptions returns the options of containerize without flags.
+func defaultDockerfileOptions() dockerfileOptions {
+	return dockerfileOptions{
+		BuilderImage: defaultBuilderImage,
+		BaseImage:    defaultBaseImage,
+		Package:      ".",
+		LDFlags:      "-s -w",
+		User:         defaultContainerUser,
+		Mode:         containerModeServe,
+		Port:         defaultContainerPort,
+		HealthCheck:  true,
+	}
+}
+
+func TestRenderDockerfile(t *testing.T) {
+	dockerfile, err := renderDockerfile(defaultDockerfileOptions())
+	require.NoError(t, err)
+
+	assert.Contains(t, dockerfile, "FROM golang:1.24-alpine AS builder\n")
+	assert.Contains(t, dockerfile, "ENV CGO_ENABLED=0\n")
+	assert.Contains(t, dockerfile, "COPY go.* ./\nRUN go mod download\n")
+	assert.Contains(t, dockerfile, `RUN ["go","build","-ldflags","-s -w","-o","/out/app","."]`)
+	assert.Contains(t, dockerfile, "FROM alpine:latest\n")
+	assert.Contains(t, dockerfile, "USER 65532:65532\n")
+	assert.Contains(t, dockerfile, "EXPOSE 8080\n")
+	assert.Contains(t, dockerfile, `CMD ["/app/app","healthcheck","--port","8080"]`)
+	assert.Contains(t, dockerfile, `ENTRYPOINT ["/app/app"]`)
+	assert.Contains(t, dockerfile, `CMD ["serve","--port","8080"]`)
+}
+
+func TestRenderDockerfile_Options(t *testing.T) {
+	t.Run("build flags", func(t *testing.T) {
+		opts := defaultDockerfileOptions()
+		opts.Package = "cmd/server"
+		opts.Tags = []string{"netgo", "osusergo"}
+		opts.LDFlags = ""
+		opts.Port = 9090
+		opts.User = ""
+
+		dockerfile, err := renderDockerfile(opts)
+		require.NoError(t, err)
+		assert.Contains(t, dockerfile, `RUN ["go","build","-tags","netgo,osusergo","-o","/out/app","./cmd/server"]`)
+		assert.Contains(t, dockerfile, "EXPOSE 9090\n")
+		assert.Contains(t, dockerfile, `CMD ["serve","--port","9090"]`)
+		assert.NotContains(t, dockerfile, "USER")
+	})
+
+	for _, base := range []string{"scratch", "gcr.io/distroless/static-debian12"} {
+		t.Run(base, func(t *testing.T) {
+			opts := defaultDockerfileOptions()
+			opts.BaseImage = base
+
+			dockerfile, err := renderDockerfile(opts)
+			require.NoError(t, err)
+			assert.Contains(t, dockerfile, "FROM "+base+"\n")
+			assert.Contains(t, dockerfile, "EXPOSE 8080\n")
+			assert.Contains(t, dockerfile, `CMD ["/app/app","healthcheck","--port","8080"]`, "no shell or wget needed in the base image")
+		})
+	}
+
+	t.Run("mcp", func(t *testing.T) {
+		opts := defaultDockerfileOptions()
+		opts.Mode = containerModeMcp
+
+		dockerfile, err := renderDockerfile(opts)
+		require.NoError(t, err)
+		assert.NotContains(t, dockerfile, "EXPOSE")
+		assert.NotContains(t, dockerfile, "HEALTHCHECK")
+		assert.Contains(t, dockerfile, `CMD ["mcp"]`)
+	})
+}
+
+func TestRenderDockerfile_Labels(t *testing.T) {
+	opts := defaultDockerfileOptions()
+	opts.Labels = map[string]string{
+		"title":   `Tom & "Jerry" <cartoons>`,
+		"version": `1.0 $HOME \n`,
+		"notes":   "two\nlines\r\nend",
+	}
+
+	dockerfile, err := renderDockerfile(opts)
+	require.NoError(t, err)
+	assert.Contains(t, dockerfile, `LABEL "title"="Tom & \"Jerry\" <cartoons>"`+"\n")
+	assert.Contains(t, dockerfile, `LABEL "version"="1.0 \$HOME \\n"`+"\n")
+	assert.Contains(t, dockerfile, `LABEL "notes"="two lines end"`+"\n")
+}
+
+func TestContainerizeCmd_Output(t *testing.T) {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "Dockerfile")
+		cmd := app.buildContainerizeCmd()
+		cmd.SetArgs([]string{"--output", path, "--base-image", "scratch", "--port", "3000"})
+		require.NoError(t, cmd.Execute())
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "FROM scratch\n")
+		assert.Contains(t, string(data), `CMD ["serve","--port","3000"]`)
+	})
+
+	t.Run("stdout", func(t *testing.T) {
+		var out bytes.Buffer
+		cmd := app.buildContainerizeCmd()
+		cmd.SetOut(&out)
+		cmd.SetArgs([]string{"-o", "-", "--mode", "mcp"})
+		require.NoError(t, cmd.Execute())
+		assert.Contains(t, out.String(), `CMD ["mcp"]`)
+	})
+
+	t.Run("invalid mode", func(t *testing.T) {
+		cmd := app.buildContainerizeCmd()
+		cmd.SetOut(&bytes.Buffer{})
+		cmd.SetErr(&bytes.Buffer{})
+		cmd.SetArgs([]string{"-o", "-", "--mode", "cgi"})
+		assert.Error(t, cmd.Execute())
+	})
+}
+
+func TestHealthz(t *testing.T) {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+
+	rec := httptest.NewRecorder()
+	app.newHttpMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"status":"ok"}`, rec.Body.String())
+}
+
+func TestHealthcheckCmd(t *testing.T) {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	srv := httptest.NewServer(app.newHttpMux())
+	defer srv.Close()
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	require.NoError(t, err)
+
+	run := func(port string) error {
+		cmd := app.buildHealthcheckCmd()
+		cmd.SetOut(io.Discard)
+		cmd.SetErr(io.Discard)
+		cmd.SetArgs([]string{"--port", port, "--timeout", "1s"})
+		return cmd.Execute()
+	}
+	assert.NoError(t, run(port))
+
+	srv.Close()
+	assert.Error(t, run(port), "nothing listening")
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	_, port, err = net.SplitHostPort(failing.Listener.Addr().String())
+	require.NoError(t, err)
+	assert.ErrorContains(t, run(port), "503")
+}
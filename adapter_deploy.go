@@ -0,0 +1,588 @@
+package kuniumi
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+)
+
+// Formats of the deploy-manifests command.
+const (
+	deployFormatKubernetes = "kubernetes"
+	deployFormatCompose    = "compose"
+)
+
+func (a *App) buildDeployManifestsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "deploy-manifests",
+		Short: "Generate Kubernetes or docker-compose manifests for this application",
+		Long: `Generate the manifests deploying the container image of this application
+(see containerize) in serve mode.
+
+The kubernetes format emits a Deployment, a Service and, when needed, a
+ConfigMap, a Secret and one PersistentVolumeClaim per mount. The compose
+format emits an equivalent docker-compose file.
+
+--env values become configuration (the ConfigMap), --secret keys become the
+Secret (taking their --env value, if any), and each --mount becomes a volume mounted at its virtual path.
+The host directory of an overlay mount becomes a read-only volume, which
+the overlay uses as its lower layer. Probes point at GET /healthz.
+
+Secrets are passed in the container environment, which the app reads with
+--env KEY, never in its arguments. The compose file references them as
+${KEY}, and the values given are written to a separate env file (--env-file,
+by default .env next to the compose file) readable only by its owner.
+
+  app --env LOG_LEVEL=debug --mount ./data:/data deploy-manifests --image my-app:1.0 --secret API_KEY`,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format, _ := cmd.Flags().GetString("format")
+			output, _ := cmd.Flags().GetString("output")
+
+			spec, err := a.deploySpecFromFlags(cmd)
+			if err != nil {
+				return err
+			}
+
+			var manifest, secrets []byte
+			switch format {
+			case deployFormatKubernetes, "k8s":
+				manifest, err = renderKubernetesManifests(spec)
+			case deployFormatCompose:
+				if manifest, err = renderComposeFile(spec); err == nil {
+					secrets, err = renderComposeEnvFile(spec)
+				}
+			default:
+				return fmt.Errorf("invalid format %q: must be kubernetes or compose", format)
+			}
+			if err != nil {
+				return err
+			}
+
+			if secrets != nil {
+				envFile, _ := cmd.Flags().GetString("env-file")
+				if envFile == "" {
+					envFile = ".env"
+					if output != "" && output != "-" {
+						envFile = filepath.Join(filepath.Dir(output), ".env")
+					}
+				}
+				if err := writeSecretsFile(envFile, secrets); err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.ErrOrStderr(), "Wrote secrets to %s\n", envFile)
+			}
+
+			if output == "" || output == "-" {
+				_, err := cmd.OutOrStdout().Write(manifest)
+				return err
+			}
+			if err := os.WriteFile(output, manifest, 0644); err != nil {
+				return fmt.Errorf("failed to write manifests: %w", err)
+			}
+			fmt.Printf("Wrote %s\n", output)
+			return nil
+		},
+	}
+	cmd.Flags().String("image", "", "Container image (e.g. registry.example.com/my-app:1.0)")
+	cmd.Flags().String("name", "", "Name of the resources and the compose service (defaults to the app name)")
+	cmd.Flags().String("format", deployFormatKubernetes, "Manifest format: kubernetes or compose")
+	cmd.Flags().StringP("output", "o", "-", `Write the manifests to this path ("-" for stdout)`)
+	cmd.Flags().Int("port", defaultContainerPort, "Port served by the container")
+	cmd.Flags().Int("replicas", 1, "Number of replicas (kubernetes)")
+	cmd.Flags().StringSlice("secret", nil, "Secret environment variables (KEY, or KEY=VALUE); values left empty are filled in later")
+	cmd.Flags().String("storage", "1Gi", "Requested size of the volume claims of mounts (kubernetes)")
+	cmd.Flags().String("env-file", "", "File receiving the secret values (compose; defaults to .env next to the output)")
+	return cmd
+}
+
+// deploySpec describes the deployment of the app.
+type deploySpec struct {
+	Name     string
+	Image    string
+	Port     int
+	Replicas int
+	// Config holds the configuration environment variables (--env).
+	Config map[string]string
+	// Secrets holds the secret environment variables; empty values are
+	// placeholders.
+	Secrets map[string]string
+	Mounts  []deployMount
+	Storage string
+}
+
+// deployMount is a mount of the app: a volume mounted at the virtual path,
+// or a filesystem without volume (e.g. mem) passed as is to --mount.
+type deployMount struct {
+	// Volume is the volume name, unique within the deployment; empty for
+	// mounts without volume.
+	Volume  string
+	Host    string
+	Virtual string
+	// Source is the --mount source of mounts without volume (e.g. "mem").
+	Source string
+	// Overlay is set for overlay mounts of a host directory: the volume
+	// holds the lower layer of the overlay.
+	Overlay bool
+	// Options are the --mount options (e.g. "ro,nodelete").
+	Options  string
+	ReadOnly bool
+}
+
+// spec returns the --mount flag of the mount in the container.
+func (m deployMount) spec() string {
+	spec := m.Virtual + ":" + m.Virtual
+	switch {
+	case m.Overlay:
+		spec = "overlay:" + spec
+	case m.Volume == "":
+		spec = m.Source + ":" + m.Virtual
+	}
+	if m.Options != "" {
+		spec += ":" + m.Options
+	}
+	return spec
+}
+
+// volumeReadOnly reports whether the volume of the mount is read-only. The
+// lower layer of an overlay is never written.
+func (m deployMount) volumeReadOnly() bool {
+	return m.ReadOnly || m.Overlay
+}
+
+// deploySpecFromFlags builds the deployment spec from the flags of the
+// deploy-manifests command and the --env and --mount global flags.
+func (a *App) deploySpecFromFlags(cmd *cobra.Command) (*deploySpec, error) {
+	spec := &deploySpec{
+		Config:  map[string]string{},
+		Secrets: map[string]string{},
+	}
+	spec.Image, _ = cmd.Flags().GetString("image")
+	spec.Name, _ = cmd.Flags().GetString("name")
+	spec.Port, _ = cmd.Flags().GetInt("port")
+	spec.Replicas, _ = cmd.Flags().GetInt("replicas")
+	spec.Storage, _ = cmd.Flags().GetString("storage")
+	secrets, _ := cmd.Flags().GetStringSlice("secret")
+
+	if spec.Image == "" {
+		return nil, fmt.Errorf("image name is required")
+	}
+	if spec.Name == "" {
+		spec.Name = a.config.Name
+	}
+	if spec.Name = dnsLabel(spec.Name); spec.Name == "" {
+		return nil, fmt.Errorf("invalid name: use --name")
+	}
+
+	for _, s := range secrets {
+		key, value, _ := strings.Cut(s, "=")
+		if key == "" {
+			return nil, fmt.Errorf("invalid secret %q", s)
+		}
+		spec.Secrets[key] = value
+	}
+
+	if a.env != nil {
+		// --env values of secret keys move to the Secret
+		for k, v := range a.env.ListEnv() {
+			if secret, ok := spec.Secrets[k]; !ok {
+				spec.Config[k] = v
+			} else if secret == "" {
+				spec.Secrets[k] = v
+			}
+		}
+
+		virtuals := make([]string, 0, len(a.env.mounts))
+		for virt := range a.env.mounts {
+			virtuals = append(virtuals, virt)
+		}
+		sort.Strings(virtuals)
+		volumes := map[string]bool{}
+		newVolume := func(virt string) string {
+			volume := dnsLabel("data-" + path.Base(path.Clean("/"+virt)))
+			for i := 2; volumes[volume]; i++ {
+				volume = dnsLabel(fmt.Sprintf("data-%s-%d", path.Base(path.Clean("/"+virt)), i))
+			}
+			volumes[volume] = true
+			return volume
+		}
+		for _, virt := range virtuals {
+			m := a.env.mounts[virt]
+			dm := deployMount{Host: m.host, Virtual: virt, Options: m.options(), ReadOnly: m.readOnly}
+			switch dir, ok := a.overlayHostDir(m); {
+			case m.host != "":
+				dm.Volume = newVolume(virt)
+			case ok:
+				// The host directory does not exist in the container
+				dm.Volume, dm.Host, dm.Overlay = newVolume(virt), dir, true
+			case m.source != "":
+				dm.Source = m.source
+			default:
+				// Filesystems mounted with Mount cannot be reproduced
+				continue
+			}
+			spec.Mounts = append(spec.Mounts, dm)
+		}
+	}
+	return spec, nil
+}
+
+// overlayHostDir returns the host directory of an overlay mount of a host
+// directory, and false for other mounts (including overlays of filesystems
+// registered with WithFS).
+func (a *App) overlayHostDir(m mountPoint) (string, bool) {
+	scheme, name, _ := strings.Cut(m.source, ":")
+	if scheme != "overlay" || !filepath.IsAbs(name) {
+		return "", false
+	}
+	if _, ok := a.filesystems[name]; ok {
+		return "", false
+	}
+	return name, true
+}
+
+// dnsLabel converts s to a DNS-1123 label, as required for Kubernetes
+// resource names.
+func dnsLabel(s string) string {
+	label := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, s)
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	return strings.Trim(label, "-")
+}
+
+// args returns the arguments of the app in the container. The variables
+// for which inline returns no value are read from the container
+// environment (--env KEY).
+func (s *deploySpec) args(inline func(key string) (string, bool)) []string {
+	args := []string{containerModeServe, "--port", fmt.Sprint(s.Port)}
+	for _, key := range s.envKeys() {
+		if value, ok := inline(key); ok {
+			args = append(args, "--env", key+"="+value)
+		} else {
+			args = append(args, "--env", key)
+		}
+	}
+	for _, m := range s.Mounts {
+		args = append(args, "--mount", m.spec())
+	}
+	return args
+}
+
+// envKeys returns the sorted keys of the configuration and secret variables.
+func (s *deploySpec) envKeys() []string {
+	keys := make([]string, 0, len(s.Config)+len(s.Secrets))
+	for k := range s.Config {
+		keys = append(keys, k)
+	}
+	for k := range s.Secrets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Kubernetes objects, limited to the fields used by the generated manifests.
+
+type k8sObject struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   k8sMetadata       `yaml:"metadata"`
+	Type       string            `yaml:"type,omitempty"`
+	Data       map[string]string `yaml:"data,omitempty"`
+	StringData map[string]string `yaml:"stringData,omitempty"`
+	Spec       any               `yaml:"spec,omitempty"`
+}
+
+type k8sMetadata struct {
+	Name   string            `yaml:"name,omitempty"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+type k8sDeploymentSpec struct {
+	Replicas int `yaml:"replicas"`
+	Selector struct {
+		MatchLabels map[string]string `yaml:"matchLabels"`
+	} `yaml:"selector"`
+	Template struct {
+		Metadata k8sMetadata `yaml:"metadata"`
+		Spec     k8sPodSpec  `yaml:"spec"`
+	} `yaml:"template"`
+}
+
+type k8sPodSpec struct {
+	Containers []k8sContainer `yaml:"containers"`
+	Volumes    []k8sVolume    `yaml:"volumes,omitempty"`
+}
+
+type k8sContainer struct {
+	Name           string           `yaml:"name"`
+	Image          string           `yaml:"image"`
+	Args           []string         `yaml:"args"`
+	Ports          []k8sPort        `yaml:"ports"`
+	Env            []k8sEnvVar      `yaml:"env,omitempty"`
+	VolumeMounts   []k8sVolumeMount `yaml:"volumeMounts,omitempty"`
+	LivenessProbe  k8sProbe         `yaml:"livenessProbe"`
+	ReadinessProbe k8sProbe         `yaml:"readinessProbe"`
+}
+
+type k8sPort struct {
+	Name          string `yaml:"name"`
+	ContainerPort int    `yaml:"containerPort,omitempty"`
+	Port          int    `yaml:"port,omitempty"`
+	TargetPort    string `yaml:"targetPort,omitempty"`
+}
+
+type k8sEnvVar struct {
+	Name      string `yaml:"name"`
+	ValueFrom struct {
+		ConfigMapKeyRef *k8sKeyRef `yaml:"configMapKeyRef,omitempty"`
+		SecretKeyRef    *k8sKeyRef `yaml:"secretKeyRef,omitempty"`
+	} `yaml:"valueFrom"`
+}
+
+type k8sKeyRef struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+}
+
+type k8sVolumeMount struct {
+	Name      string `yaml:"name"`
+	MountPath string `yaml:"mountPath"`
+	ReadOnly  bool   `yaml:"readOnly,omitempty"`
+}
+
+type k8sVolume struct {
+	Name                  string `yaml:"name"`
+	PersistentVolumeClaim struct {
+		ClaimName string `yaml:"claimName"`
+	} `yaml:"persistentVolumeClaim"`
+}
+
+type k8sProbe struct {
+	HTTPGet struct {
+		Path string `yaml:"path"`
+		Port string `yaml:"port"`
+	} `yaml:"httpGet"`
+	InitialDelaySeconds int `yaml:"initialDelaySeconds,omitempty"`
+	PeriodSeconds       int `yaml:"periodSeconds"`
+}
+
+type k8sServiceSpec struct {
+	Selector map[string]string `yaml:"selector"`
+	Ports    []k8sPort         `yaml:"ports"`
+}
+
+type k8sClaimSpec struct {
+	AccessModes []string `yaml:"accessModes"`
+	Resources   struct {
+		Requests map[string]string `yaml:"requests"`
+	} `yaml:"resources"`
+}
+
+// renderKubernetesManifests returns the Kubernetes objects of the deployment
+// as a multi-document YAML stream.
+func renderKubernetesManifests(s *deploySpec) ([]byte, error) {
+	labels := map[string]string{"app.kubernetes.io/name": s.Name}
+	meta := func(name string) k8sMetadata {
+		return k8sMetadata{Name: name, Labels: labels}
+	}
+	var objects []k8sObject
+
+	if len(s.Config) > 0 {
+		objects = append(objects, k8sObject{
+			APIVersion: "v1", Kind: "ConfigMap", Metadata: meta(s.Name), Data: s.Config,
+		})
+	}
+	if len(s.Secrets) > 0 {
+		objects = append(objects, k8sObject{
+			APIVersion: "v1", Kind: "Secret", Metadata: meta(s.Name), Type: "Opaque", StringData: s.Secrets,
+		})
+	}
+
+	container := k8sContainer{
+		Name:  s.Name,
+		Image: s.Image,
+		// Values come from the ConfigMap and the Secret through the
+		// container environment, which keeps secrets out of the arguments
+		Args:  s.args(func(string) (string, bool) { return "", false }),
+		Ports: []k8sPort{{Name: "http", ContainerPort: s.Port}},
+	}
+	for _, key := range s.envKeys() {
+		env := k8sEnvVar{Name: key}
+		if _, ok := s.Secrets[key]; ok {
+			env.ValueFrom.SecretKeyRef = &k8sKeyRef{Name: s.Name, Key: key}
+		} else {
+			env.ValueFrom.ConfigMapKeyRef = &k8sKeyRef{Name: s.Name, Key: key}
+		}
+		container.Env = append(container.Env, env)
+	}
+	container.LivenessProbe.HTTPGet.Path = "/healthz"
+	container.LivenessProbe.HTTPGet.Port = "http"
+	container.LivenessProbe.InitialDelaySeconds = 5
+	container.LivenessProbe.PeriodSeconds = 30
+	container.ReadinessProbe.HTTPGet.Path = "/healthz"
+	container.ReadinessProbe.HTTPGet.Port = "http"
+	container.ReadinessProbe.PeriodSeconds = 10
+
+	var pod k8sPodSpec
+	for _, m := range s.Mounts {
+		if m.Volume == "" {
+			continue
+		}
+		claim := s.Name + "-" + m.Volume
+		var spec k8sClaimSpec
+		spec.AccessModes = []string{"ReadWriteOnce"}
+		spec.Resources.Requests = map[string]string{"storage": s.Storage}
+		objects = append(objects, k8sObject{
+			APIVersion: "v1", Kind: "PersistentVolumeClaim", Metadata: meta(claim), Spec: spec,
+		})
+
+		container.VolumeMounts = append(container.VolumeMounts, k8sVolumeMount{Name: m.Volume, MountPath: m.Virtual, ReadOnly: m.volumeReadOnly()})
+		volume := k8sVolume{Name: m.Volume}
+		volume.PersistentVolumeClaim.ClaimName = claim
+		pod.Volumes = append(pod.Volumes, volume)
+	}
+	pod.Containers = []k8sContainer{container}
+
+	var deployment k8sDeploymentSpec
+	deployment.Replicas = s.Replicas
+	deployment.Selector.MatchLabels = labels
+	deployment.Template.Metadata = k8sMetadata{Labels: labels}
+	deployment.Template.Spec = pod
+	objects = append(objects, k8sObject{
+		APIVersion: "apps/v1", Kind: "Deployment", Metadata: meta(s.Name), Spec: deployment,
+	})
+
+	objects = append(objects, k8sObject{
+		APIVersion: "v1", Kind: "Service", Metadata: meta(s.Name), Spec: k8sServiceSpec{
+			Selector: labels,
+			Ports:    []k8sPort{{Name: "http", Port: s.Port, TargetPort: "http"}},
+		},
+	})
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	for _, obj := range objects {
+		if err := enc.Encode(obj); err != nil {
+			return nil, err
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Compose file, limited to the fields used by the generated file.
+
+type composeFile struct {
+	Services map[string]composeService `yaml:"services"`
+}
+
+type composeService struct {
+	Image       string            `yaml:"image"`
+	Command     []string          `yaml:"command"`
+	Environment map[string]string `yaml:"environment,omitempty"`
+	Ports       []string          `yaml:"ports"`
+	Volumes     []string          `yaml:"volumes,omitempty"`
+	Restart     string            `yaml:"restart"`
+}
+
+// renderComposeFile returns the docker-compose file of the deployment.
+// Configuration values are passed inline. Secrets are passed in the
+// container environment, interpolated by Compose from the shell
+// environment or the .env file (see renderComposeEnvFile), so that their
+// values appear neither in the file nor in the arguments of the app.
+func renderComposeFile(s *deploySpec) ([]byte, error) {
+	service := composeService{
+		Image: s.Image,
+		Command: s.args(func(key string) (string, bool) {
+			value, ok := s.Config[key]
+			return strings.ReplaceAll(value, "$", "$$"), ok
+		}),
+		Ports:   []string{fmt.Sprintf("%d:%d", s.Port, s.Port)},
+		Restart: "unless-stopped",
+	}
+	for key := range s.Secrets {
+		if service.Environment == nil {
+			service.Environment = map[string]string{}
+		}
+		service.Environment[key] = "${" + key + "}"
+	}
+	for _, m := range s.Mounts {
+		if m.Volume == "" {
+			continue
+		}
+		volume := m.Host + ":" + m.Virtual
+		if m.volumeReadOnly() {
+			volume += ":ro"
+		}
+		service.Volumes = append(service.Volumes, volume)
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(composeFile{Services: map[string]composeService{s.Name: service}}); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderComposeEnvFile returns the env file holding the values of the
+// secrets interpolated in the compose file, or nil if no value was given.
+// Values are single-quoted, so that Compose reads them literally.
+func renderComposeEnvFile(s *deploySpec) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, key := range s.envKeys() {
+		value := s.Secrets[key]
+		if value == "" {
+			continue
+		}
+		if strings.ContainsAny(value, "'\n") {
+			return nil, fmt.Errorf("secret %s: values with quotes or newlines cannot be written to an env file", key)
+		}
+		fmt.Fprintf(&buf, "%s='%s'\n", key, value)
+	}
+	if buf.Len() == 0 {
+		return nil, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// writeSecretsFile creates the file path, readable only by its owner, with
+// data. It does not replace an existing file, which may hold other values.
+func writeSecretsFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%s already exists: remove it or choose another file with --env-file", path)
+		}
+		return fmt.Errorf("failed to write secrets: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write secrets: %w", err)
+	}
+	return f.Close()
+}
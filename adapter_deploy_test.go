@@ -0,0 +1,246 @@
+package kuniumi
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.yaml.in/yaml/v3"
+)
+
+// newDeployTestApp returns an app configured as if run with
+// --env LOG_LEVEL=debug --env API_KEY=dev --mount ./data:/data.
+func newDeployTestApp() *App {
+	app := New(Config{Name: "My_Service", Version: "1.0.0"})
+	app.env = NewVirtualEnvironment(
+		map[string]string{"LOG_LEVEL": "debug", "API_KEY": "dev"},
+		map[string]string{"./data": "/data"},
+	)
+	return app
+}
+
+// runDeployManifests runs deploy-manifests and decodes the YAML documents.
+func runDeployManifests(t *testing.T, app *App, args ...string) []map[string]any {
+	t.Helper()
+	var out bytes.Buffer
+	cmd := app.buildDeployManifestsCmd()
+	cmd.SetOut(&out)
+	cmd.SetArgs(args)
+	require.NoError(t, cmd.Execute())
+
+	var docs []map[string]any
+	dec := yaml.NewDecoder(&out)
+	for {
+		var doc map[string]any
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// lookup returns the value at the given path of keys and list indexes.
+func lookup(t *testing.T, v any, keys ...any) any {
+	t.Helper()
+	for _, key := range keys {
+		switch k := key.(type) {
+		case string:
+			m, ok := v.(map[string]any)
+			require.True(t, ok, "expected a mapping at %q", k)
+			v = m[k]
+		case int:
+			l, ok := v.([]any)
+			require.True(t, ok, "expected a sequence at %d", k)
+			require.Greater(t, len(l), k)
+			v = l[k]
+		}
+	}
+	return v
+}
+
+func TestDeployManifests_Kubernetes(t *testing.T) {
+	docs := runDeployManifests(t, newDeployTestApp(),
+		"--image", "registry.example.com/svc:1.0", "--secret", "API_KEY", "--port", "9090", "--replicas", "2")
+
+	kinds := map[string]map[string]any{}
+	for _, doc := range docs {
+		kinds[doc["kind"].(string)] = doc
+		assert.Equal(t, "my-service", lookup(t, doc, "metadata", "labels", "app.kubernetes.io/name"))
+	}
+	require.Len(t, kinds, 5)
+
+	assert.Equal(t, map[string]any{"LOG_LEVEL": "debug"}, kinds["ConfigMap"]["data"])
+	assert.Equal(t, map[string]any{"API_KEY": "dev"}, kinds["Secret"]["stringData"], "--secret keys are taken out of the config")
+	assert.Equal(t, "my-service-data-data", lookup(t, kinds["PersistentVolumeClaim"], "metadata", "name"))
+
+	deployment := kinds["Deployment"]
+	assert.Equal(t, "my-service", lookup(t, deployment, "metadata", "name"))
+	assert.Equal(t, 2, lookup(t, deployment, "spec", "replicas"))
+	container := lookup(t, deployment, "spec", "template", "spec", "containers", 0)
+	assert.Equal(t, "registry.example.com/svc:1.0", lookup(t, container, "image"))
+	assert.Equal(t, []any{
+		"serve", "--port", "9090",
+		"--env", "API_KEY",
+		"--env", "LOG_LEVEL",
+		"--mount", "/data:/data",
+	}, lookup(t, container, "args"), "values come from the container environment")
+	assert.Equal(t, 9090, lookup(t, container, "ports", 0, "containerPort"))
+	assert.Equal(t, "API_KEY", lookup(t, container, "env", 0, "valueFrom", "secretKeyRef", "key"))
+	assert.Equal(t, "LOG_LEVEL", lookup(t, container, "env", 1, "valueFrom", "configMapKeyRef", "key"))
+	assert.Equal(t, "/data", lookup(t, container, "volumeMounts", 0, "mountPath"))
+	assert.Equal(t, "/healthz", lookup(t, container, "livenessProbe", "httpGet", "path"))
+	assert.Equal(t, "/healthz", lookup(t, container, "readinessProbe", "httpGet", "path"))
+	assert.Equal(t, "my-service-data-data", lookup(t, deployment, "spec", "template", "spec", "volumes", 0, "persistentVolumeClaim", "claimName"))
+
+	assert.Equal(t, 9090, lookup(t, kinds["Service"], "spec", "ports", 0, "port"))
+	assert.Equal(t, "http", lookup(t, kinds["Service"], "spec", "ports", 0, "targetPort"))
+}
+
+func TestDeployManifests_KubernetesMinimal(t *testing.T) {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	docs := runDeployManifests(t, app, "--image", "test:1", "--name", "calc")
+
+	var kinds []string
+	for _, doc := range docs {
+		kinds = append(kinds, doc["kind"].(string))
+	}
+	assert.Equal(t, []string{"Deployment", "Service"}, kinds)
+	assert.Equal(t, "calc", lookup(t, docs[0], "metadata", "name"))
+}
+
+func TestDeployManifests_Compose(t *testing.T) {
+	app := newDeployTestApp()
+	app.env.envVars["PRICE"] = "$5"
+	envFile := filepath.Join(t.TempDir(), "secrets.env")
+	docs := runDeployManifests(t, app, "--image", "svc:1.0", "--secret", "API_KEY", "--secret", "TOKEN",
+		"--secret", "PASSWORD=p$ss", "--format", "compose", "--env-file", envFile)
+	require.Len(t, docs, 1)
+
+	service := lookup(t, docs[0], "services", "my-service")
+	assert.Equal(t, "svc:1.0", lookup(t, service, "image"))
+	assert.Equal(t, []any{
+		"serve", "--port", "8080",
+		"--env", "API_KEY",
+		"--env", "LOG_LEVEL=debug",
+		"--env", "PASSWORD",
+		"--env", "PRICE=$$5",
+		"--env", "TOKEN",
+		"--mount", "/data:/data",
+	}, lookup(t, service, "command"), "secrets stay out of the arguments")
+	assert.Equal(t, map[string]any{
+		"API_KEY":  "${API_KEY}",
+		"PASSWORD": "${PASSWORD}",
+		"TOKEN":    "${TOKEN}",
+	}, lookup(t, service, "environment"), "secret values stay out of the compose file")
+	assert.Equal(t, []any{"8080:8080"}, lookup(t, service, "ports"))
+	assert.Equal(t, []any{"./data:/data"}, lookup(t, service, "volumes"))
+
+	data, err := os.ReadFile(envFile)
+	require.NoError(t, err)
+	assert.Equal(t, "API_KEY='dev'\nPASSWORD='p$ss'\n", string(data))
+	info, err := os.Stat(envFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestDeployManifests_ComposeEnvFile(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "compose.yaml")
+	run := func(args ...string) error {
+		cmd := newDeployTestApp().buildDeployManifestsCmd()
+		cmd.SetOut(io.Discard)
+		cmd.SetErr(io.Discard)
+		cmd.SetArgs(append([]string{"--image", "svc:1.0", "--format", "compose", "--output", output}, args...))
+		return cmd.Execute()
+	}
+
+	// Without secret values, no env file is written
+	require.NoError(t, run())
+	assert.NoFileExists(t, filepath.Join(dir, ".env"))
+
+	require.NoError(t, run("--secret", "API_KEY"))
+	data, err := os.ReadFile(filepath.Join(dir, ".env"))
+	require.NoError(t, err)
+	assert.Equal(t, "API_KEY='dev'\n", string(data))
+	manifest, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.NotContains(t, string(manifest), "dev")
+
+	assert.ErrorContains(t, run("--secret", "API_KEY"), "already exists", "an existing env file is kept")
+	assert.Error(t, run("--secret", "QUOTED=it's", "--env-file", filepath.Join(dir, "other.env")))
+}
+
+func TestDeployManifests_MountOptions(t *testing.T) {
+	app := newDeployTestApp()
+	app.env.mount("/data", mountPoint{host: "./data", readOnly: true})
+	app.env.mount("/scratch", mountPoint{fs: NewMemFS(), source: "mem", noDelete: true})
+
+	docs := runDeployManifests(t, app, "--image", "svc:1.0", "--format", "compose")
+	require.Len(t, docs, 1)
+	service := lookup(t, docs[0], "services", "my-service")
+	assert.Equal(t, []any{"--mount", "/data:/data:ro", "--mount", "mem:/scratch:nodelete"}, lookup(t, service, "command").([]any)[7:])
+	assert.Equal(t, []any{"./data:/data:ro"}, lookup(t, service, "volumes"), "no volume for mem mounts")
+
+	docs = runDeployManifests(t, app, "--image", "svc:1.0")
+	deployment := docs[len(docs)-2]
+	container := lookup(t, deployment, "spec", "template", "spec", "containers", 0)
+	assert.Equal(t, true, lookup(t, container, "volumeMounts", 0, "readOnly"))
+}
+
+func TestDeployManifests_OverlayMounts(t *testing.T) {
+	dir := t.TempDir()
+	app := New(Config{Name: "svc", Version: "1.0.0"}, WithFS("assets", fstest.MapFS{}))
+	app.env = NewVirtualEnvironment(nil, nil)
+	for _, spec := range []string{"overlay:" + dir + ":/work:nodelete", "overlay:assets:/assets"} {
+		virt, m, err := parseMountSpec(spec, app.filesystems)
+		require.NoError(t, err)
+		app.env.mount(virt, m)
+	}
+
+	// The host directory of the overlay becomes a read-only volume
+	docs := runDeployManifests(t, app, "--image", "svc:1.0", "--format", "compose")
+	service := lookup(t, docs[0], "services", "svc")
+	assert.Equal(t, []any{
+		"serve", "--port", "8080",
+		"--mount", "overlay:assets:/assets",
+		"--mount", "overlay:/work:/work:nodelete",
+	}, lookup(t, service, "command"))
+	assert.Equal(t, []any{dir + ":/work:ro"}, lookup(t, service, "volumes"))
+
+	docs = runDeployManifests(t, app, "--image", "svc:1.0")
+	deployment := docs[len(docs)-2]
+	container := lookup(t, deployment, "spec", "template", "spec", "containers", 0)
+	assert.Equal(t, "/work", lookup(t, container, "volumeMounts", 0, "mountPath"))
+	assert.Equal(t, true, lookup(t, container, "volumeMounts", 0, "readOnly"))
+	assert.Equal(t, "overlay:/work:/work:nodelete", lookup(t, container, "args").([]any)[6])
+}
+
+func TestDeployManifests_Errors(t *testing.T) {
+	for name, args := range map[string][]string{
+		"no image":   {},
+		"bad format": {"--image", "x", "--format", "helm"},
+		"bad name":   {"--image", "x", "--name", "__"},
+		"bad secret": {"--image", "x", "--secret", "=v"},
+	} {
+		cmd := newDeployTestApp().buildDeployManifestsCmd()
+		cmd.SetOut(io.Discard)
+		cmd.SetErr(io.Discard)
+		cmd.SetArgs(args)
+		assert.Error(t, cmd.Execute(), name)
+	}
+}
+
+func TestDnsLabel(t *testing.T) {
+	assert.Equal(t, "my-service", dnsLabel("My_Service"))
+	assert.Equal(t, "a-b", dnsLabel("-a.b-"))
+	assert.Len(t, dnsLabel(string(bytes.Repeat([]byte("x"), 100))), 63)
+}
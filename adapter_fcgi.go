@@ -0,0 +1,93 @@
+package kuniumi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func (a *App) buildFcgiCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "fcgi",
+		Short: "Serve the registered functions over FastCGI",
+		Long: `Serve the registered functions over FastCGI, on a TCP port or a Unix socket.
+
+The routes are the same as in serve mode: POST /functions/{name} and
+GET /openapi.json. So are the flags: the server listens on --port, or on
+--listen (e.g. unix:/run/app.sock), or on the sockets passed by systemd, and
+on SIGINT or SIGTERM, in-flight requests are given --shutdown-timeout to
+complete.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			listeners, shutdownTimeout, err := a.setupServer(cmd)
+			if err != nil {
+				return err
+			}
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return a.serveFcgi(ctx, listeners, shutdownTimeout)
+		},
+	}
+	addServerFlags(cmd, 9000)
+	return cmd
+}
+
+// serveFcgi serves the functions over FastCGI on the listeners until ctx is
+// done, then shuts down gracefully.
+func (a *App) serveFcgi(ctx context.Context, listeners []net.Listener, shutdownTimeout time.Duration) error {
+	for _, l := range listeners {
+		fmt.Fprintf(os.Stderr, "Serving FastCGI on %s\n", l.Addr())
+	}
+	srv := &fcgiServer{handler: a.newHttpMux(), listeners: listeners}
+	return serveListeners(ctx, srv, listeners, shutdownTimeout)
+}
+
+// fcgiServer adds graceful shutdown to fcgi.Serve: Shutdown closes the
+// listeners and waits for the requests in flight.
+type fcgiServer struct {
+	handler   http.Handler
+	listeners []net.Listener
+	inflight  atomic.Int64
+}
+
+// Serve serves l, one of the listeners of s.
+func (s *fcgiServer) Serve(l net.Listener) error {
+	return fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.inflight.Add(1)
+		defer s.inflight.Add(-1)
+		s.handler.ServeHTTP(w, r)
+	}))
+}
+
+// Shutdown closes the listeners and waits until no request is in flight,
+// polling like http.Server.Shutdown, or until ctx is done.
+func (s *fcgiServer) Shutdown(ctx context.Context) error {
+	s.Close()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for s.inflight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Close closes the listeners. Requests in flight are abandoned when the
+// process exits.
+func (s *fcgiServer) Close() error {
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package kuniumi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// FastCGI record types used by the test client.
+const (
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+)
+
+func writeFcgiRecord(t *testing.T, w io.Writer, recType uint8, content []byte) {
+	t.Helper()
+	header := []byte{1, recType, 0, 1, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+	_, err := w.Write(append(header, content...))
+	require.NoError(t, err)
+}
+
+func encodeFcgiParams(params map[string]string) []byte {
+	var buf bytes.Buffer
+	writeLen := func(n int) {
+		if n < 128 {
+			buf.WriteByte(byte(n))
+			return
+		}
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(n)|1<<31)
+		buf.Write(b[:])
+	}
+	for k, v := range params {
+		writeLen(len(k))
+		writeLen(len(v))
+		buf.WriteString(k)
+		buf.WriteString(v)
+	}
+	return buf.Bytes()
+}
+
+// fcgiRequest performs a FastCGI responder request and returns the raw
+// CGI-style response written by the application.
+func fcgiRequest(t *testing.T, conn net.Conn, params map[string]string, body string) string {
+	t.Helper()
+	writeFcgiRecord(t, conn, fcgiBeginRequest, []byte{0, 1, 0, 0, 0, 0, 0, 0})
+	writeFcgiRecord(t, conn, fcgiParams, encodeFcgiParams(params))
+	writeFcgiRecord(t, conn, fcgiParams, nil)
+	if body != "" {
+		writeFcgiRecord(t, conn, fcgiStdin, []byte(body))
+	}
+	writeFcgiRecord(t, conn, fcgiStdin, nil)
+
+	var stdout bytes.Buffer
+	for {
+		header := make([]byte, 8)
+		_, err := io.ReadFull(conn, header)
+		require.NoError(t, err)
+		contentLen := binary.BigEndian.Uint16(header[4:])
+		content := make([]byte, int(contentLen)+int(header[6]))
+		_, err = io.ReadFull(conn, content)
+		require.NoError(t, err)
+
+		switch header[1] {
+		case fcgiStdout:
+			stdout.Write(content[:contentLen])
+		case fcgiEndRequest:
+			return stdout.String()
+		}
+	}
+}
+
+func TestFcgi(t *testing.T) {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	app.RegisterFunc(addInts, "adds", WithParams(Param("x", "x"), Param("y", "y")))
+
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	// A stale socket file from a previous run must not prevent startup
+	stale, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listen("unix:" + socket)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.serveFcgi(ctx, []net.Listener{l}, time.Second)
+
+	send := func(params map[string]string, body string) *http.Response {
+		conn, err := net.Dial("unix", socket)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		raw := fcgiRequest(t, conn, params, body)
+		// The response is CGI-style: turn the Status header into a status line
+		status, rest, _ := strings.Cut(raw, "\r\n")
+		require.True(t, strings.HasPrefix(status, "Status: "), raw)
+		resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(
+			"HTTP/1.1 "+strings.TrimPrefix(status, "Status: ")+"\r\n"+rest)), nil)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("function call", func(t *testing.T) {
+		body := `{"x": 2, "y": 3}`
+		resp := send(map[string]string{
+			"REQUEST_METHOD":  "POST",
+			"SCRIPT_NAME":     "/functions/addInts",
+			"CONTENT_TYPE":    "application/json",
+			"CONTENT_LENGTH":  "16",
+			"SERVER_PROTOCOL": "HTTP/1.1",
+		}, body)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		data, _ := io.ReadAll(resp.Body)
+		assert.JSONEq(t, `{"result":5}`, string(data))
+	})
+
+	t.Run("server flags", func(t *testing.T) {
+		// fcgi takes the listener, shutdown and session flags of serve
+		cmd := app.buildFcgiCmd()
+		for _, flag := range []string{"port", "listen", "shutdown-timeout", "env-scope", "session-ttl", "max-sessions", "session-header"} {
+			assert.NotNil(t, cmd.Flags().Lookup(flag), flag)
+		}
+	})
+
+	t.Run("openapi", func(t *testing.T) {
+		resp := send(map[string]string{
+			"REQUEST_METHOD":  "GET",
+			"SCRIPT_NAME":     "/openapi.json",
+			"SERVER_PROTOCOL": "HTTP/1.1",
+		}, "")
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	})
+}
+
+func TestFcgi_Shutdown(t *testing.T) {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	started := make(chan struct{})
+	release := make(chan struct{})
+	app.RegisterFunc(func(ctx context.Context) (string, error) {
+		close(started)
+		<-release
+		return "done", nil
+	}, "slow")
+
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	l, err := listen("unix:" + socket)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- app.serveFcgi(ctx, []net.Listener{l}, 5*time.Second)
+	}()
+
+	conn, err := net.Dial("unix", socket)
+	require.NoError(t, err)
+	defer conn.Close()
+	response := make(chan string, 1)
+	go func() {
+		response <- fcgiRequest(t, conn, map[string]string{
+			"REQUEST_METHOD":  "POST",
+			"SCRIPT_NAME":     "/functions/" + app.functions[0].Name,
+			"SERVER_PROTOCOL": "HTTP/1.1",
+		}, "")
+	}()
+	<-started
+
+	// The request in flight completes, but no new connection is accepted
+	cancel()
+	assert.Eventually(t, func() bool {
+		c, err := net.Dial("unix", socket)
+		if err == nil {
+			c.Close()
+		}
+		return err != nil
+	}, 2*time.Second, 10*time.Millisecond)
+	select {
+	case err := <-served:
+		t.Fatalf("returned with a request in flight: %v", err)
+	default:
+	}
+	close(release)
+	assert.Contains(t, <-response, `{"result":"done"}`)
+	assert.NoError(t, <-served)
+}
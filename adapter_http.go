@@ -1,9 +1,16 @@
 package kuniumi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -12,36 +19,170 @@ func (a *App) buildServeCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "serve",
 		Short: "Start the Web API server",
+		Long: `Start the Web API server.
+
+The server listens on --port, or on --listen (e.g. unix:/run/app.sock or
+127.0.0.1:8080). Under systemd socket activation (LISTEN_FDS), it serves the
+sockets passed by systemd instead, notifies readiness (READY=1) and pings the
+watchdog when WatchdogSec is set. On SIGINT or SIGTERM, in-flight requests are
+given --shutdown-timeout to complete.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			port, _ := cmd.Flags().GetInt("port")
+			listeners, shutdownTimeout, err := a.setupServer(cmd)
+			if err != nil {
+				return err
+			}
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return a.serveHttp(ctx, listeners, shutdownTimeout)
+		},
+	}
+	addServerFlags(cmd, 8080)
+	return cmd
+}
+
+// addServerFlags adds the flags read by setupServer to cmd, which serves
+// the routes of newHttpMux on a listener.
+func addServerFlags(cmd *cobra.Command, defaultPort int) {
+	addListenFlags(cmd, defaultPort)
+	addEnvScopeFlags(cmd)
+	cmd.Flags().String("session-header", defaultSessionHeader, "With --env-scope session, the header carrying the ID of the session (returned by POST /session)")
+}
 
-			mux := http.NewServeMux()
+// setupServer applies the flags added by addServerFlags and returns the
+// listeners to serve on and the shutdown timeout (see openListeners).
+func (a *App) setupServer(cmd *cobra.Command) ([]net.Listener, time.Duration, error) {
+	if err := a.setupEnvScope(cmd); err != nil {
+		return nil, 0, err
+	}
+	a.sessionHeader, _ = cmd.Flags().GetString("session-header")
+	return openListeners(cmd)
+}
 
-			// Register Functions
-			for _, fn := range a.functions {
-				path := fmt.Sprintf("/functions/%s", fn.Name)
-				mux.HandleFunc("POST "+path, a.createHttpHandler(fn))
-				// Also create GET for metadata?
-			}
+// addListenFlags adds the flags read by openListeners to cmd.
+func addListenFlags(cmd *cobra.Command, defaultPort int) {
+	cmd.Flags().Int("port", defaultPort, "Port to listen on")
+	cmd.Flags().String("listen", "", "Address to listen on, e.g. unix:/run/app.sock or 127.0.0.1:8080 (overrides --port)")
+	cmd.Flags().Duration("shutdown-timeout", 30*time.Second, "Time allowed for in-flight requests on shutdown")
+}
 
-			// Open API Endpoint
-			mux.HandleFunc("GET /openapi.json", a.serveOpenAPI)
+// openListeners returns the listeners of cmd (the sockets passed by
+// systemd, or else --listen or --port) and its shutdown timeout.
+func openListeners(cmd *cobra.Command) ([]net.Listener, time.Duration, error) {
+	port, _ := cmd.Flags().GetInt("port")
+	listenSpec, _ := cmd.Flags().GetString("listen")
+	shutdownTimeout, _ := cmd.Flags().GetDuration("shutdown-timeout")
 
-			addr := fmt.Sprintf(":%d", port)
-			fmt.Printf("Serving on %s\n", addr)
-			return http.ListenAndServe(addr, mux)
-		},
+	listeners, err := systemdListeners()
+	if err != nil {
+		return nil, 0, err
 	}
-	cmd.Flags().Int("port", 8080, "Port to listen on")
-	return cmd
+	if len(listeners) == 0 {
+		if listenSpec == "" {
+			listenSpec = fmt.Sprintf(":%d", port)
+		}
+		l, err := listen(listenSpec)
+		if err != nil {
+			return nil, 0, err
+		}
+		listeners = []net.Listener{l}
+	}
+	return listeners, shutdownTimeout, nil
+}
+
+// server is a server of listeners that can be shut down gracefully, like
+// http.Server.
+type server interface {
+	Serve(l net.Listener) error
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// serveHttp serves the functions on the listeners until ctx is done, then
+// shuts down gracefully.
+func (a *App) serveHttp(ctx context.Context, listeners []net.Listener, shutdownTimeout time.Duration) error {
+	for _, l := range listeners {
+		fmt.Printf("Serving on %s\n", l.Addr())
+	}
+	return serveListeners(ctx, &http.Server{Handler: a.newHttpMux()}, listeners, shutdownTimeout)
+}
+
+// serveListeners serves srv on the listeners until ctx is done, then shuts
+// it down, giving in-flight requests shutdownTimeout to complete. Readiness
+// and watchdog pings are sent to systemd when it supervises the process.
+func serveListeners(ctx context.Context, srv server, listeners []net.Listener, shutdownTimeout time.Duration) error {
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			errc <- srv.Serve(l)
+		}()
+	}
+
+	sdNotify("READY=1")
+	watchdogCtx, stopWatchdog := context.WithCancel(ctx)
+	defer stopWatchdog()
+	go sdWatchdog(watchdogCtx)
+
+	select {
+	case err := <-errc:
+		srv.Close()
+		return err
+	case <-ctx.Done():
+	}
+
+	sdNotify("STOPPING=1")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
 }
 
+// newHttpMux returns the handler serving every registered function at
+// POST /functions/{name}, the OpenAPI document at GET /openapi.json and a
+// liveness probe at GET /healthz. It is shared by the serve and fcgi adapters.
+func (a *App) newHttpMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Register Functions
+	for _, fn := range a.functions {
+		path := fmt.Sprintf("/functions/%s", fn.Name)
+		mux.HandleFunc("POST "+path, a.createHttpHandler(fn))
+		// Also create GET for metadata?
+	}
+
+	// Open API Endpoint
+	mux.HandleFunc("GET /openapi.json", a.serveOpenAPI)
+
+	// Health Check (container HEALTHCHECK, Kubernetes probes)
+	mux.HandleFunc("GET /healthz", serveHealthz)
+
+	// Sessions (--env-scope session)
+	if a.sessions != nil {
+		mux.HandleFunc("POST /session", a.startHttpSession)
+		mux.HandleFunc("DELETE /session", a.endHttpSession)
+	}
+
+	return mux
+}
+
+// createHttpHandler returns the handler that invokes fn with the JSON object
+// in the request body as arguments. An empty body calls fn without arguments.
+// The request metadata is available to fn via GetRequestInfo.
 func (a *App) createHttpHandler(fn *RegisteredFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := a.ContextWithEnv(r.Context())
+		ctx := r.Context()
+		if a.env != nil {
+			env, err := a.callEnv(a.env, a.httpSession(r))
+			if err != nil {
+				writeJSONError(w, "Session not found: start one with POST /session", http.StatusNotFound)
+				return
+			}
+			ctx = WithVirtualEnv(ctx, env)
+		}
+		if GetRequestInfo(ctx) == nil {
+			ctx = withRequestInfo(ctx, newRequestInfo(r))
+		}
 
 		var args map[string]any
-		if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		if err := json.NewDecoder(r.Body).Decode(&args); err != nil && err != io.EOF {
 			writeJSONError(w, "Invalid JSON body", http.StatusBadRequest)
 			return
 		}
@@ -57,6 +198,11 @@ func (a *App) createHttpHandler(fn *RegisteredFunc) http.HandlerFunc {
 			return
 		}
 
+		if bin, ok := binaryResult(results); ok {
+			writeBinaryResponse(w, bin)
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(buildSuccessResponse(results))
 	}
@@ -67,3 +213,47 @@ func (a *App) serveOpenAPI(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(spec)
 }
+
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// buildHealthcheckCmd returns the command probing GET /healthz of a local
+// serve process. It is the HEALTHCHECK of the images built by containerize,
+// which need no shell or HTTP client in the base image this way.
+func (a *App) buildHealthcheckCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "healthcheck",
+		Short:        "Check the health of a local serve process",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			port, _ := cmd.Flags().GetInt("port")
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			return checkHealth(cmd.Context(), fmt.Sprintf("http://127.0.0.1:%d/healthz", port), timeout)
+		},
+	}
+	cmd.Flags().Int("port", 8080, "Port of the serve process")
+	cmd.Flags().Duration("timeout", 3*time.Second, "Time allowed for the probe")
+	return cmd
+}
+
+// checkHealth returns an error unless url answers 200 OK within timeout.
+func checkHealth(ctx context.Context, url string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("health check failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check failed: %s", resp.Status)
+	}
+	return nil
+}
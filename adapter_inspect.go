@@ -0,0 +1,194 @@
+package kuniumi
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// imageManifestPath is the path of the app manifest in container images.
+const imageManifestPath = "/app/kuniumi.json"
+
+// Labels of container images. The OCI annotation keys are used where they exist.
+const (
+	labelTitle     = "org.opencontainers.image.title"
+	labelVersion   = "org.opencontainers.image.version"
+	labelFramework = "io.kuniumi.framework"
+	// labelFunctions holds the JSON array of the operation IDs of the functions.
+	labelFunctions = "io.kuniumi.functions"
+	// labelManifest holds the path of the app manifest in the image.
+	labelManifest = "io.kuniumi.manifest"
+)
+
+// imageManifest describes the app packaged in a container image, so that
+// registries can list its functions without running it.
+type imageManifest struct {
+	Name      string                  `json:"name"`
+	Version   string                  `json:"version"`
+	Framework string                  `json:"framework"`
+	Functions []imageManifestFunction `json:"functions"`
+	OpenAPI   map[string]any          `json:"openapi"`
+}
+
+type imageManifestFunction struct {
+	Name        string `json:"name"`
+	OperationID string `json:"operationId"`
+	Description string `json:"description,omitempty"`
+}
+
+// imageManifest returns the manifest of the app.
+func (a *App) imageManifest() *imageManifest {
+	m := &imageManifest{
+		Name:      a.config.Name,
+		Version:   a.config.Version,
+		Framework: frameworkVersionString(),
+		Functions: []imageManifestFunction{},
+		OpenAPI:   a.generateOpenAPISpec(),
+	}
+	for _, fn := range a.functions {
+		m.Functions = append(m.Functions, imageManifestFunction{
+			Name:        fn.Name,
+			OperationID: fn.OperationID(),
+			Description: fn.Description,
+		})
+	}
+	return m
+}
+
+// imageLabels returns the labels of the container images of the app.
+func (a *App) imageLabels() map[string]string {
+	ids := []string{}
+	for _, fn := range a.functions {
+		ids = append(ids, fn.OperationID())
+	}
+	functions, _ := json.Marshal(ids)
+	return map[string]string{
+		labelTitle:     a.config.Name,
+		labelVersion:   a.config.Version,
+		labelFramework: frameworkVersionString(),
+		labelFunctions: string(functions),
+		labelManifest:  imageManifestPath,
+	}
+}
+
+func (a *App) buildInspectImageCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "inspect-image [tarball]",
+		Short: "Show the functions packaged in a container image",
+		Long: `Print the app manifest (name, version, functions and OpenAPI document)
+embedded by containerize in a docker-archive or oci-archive tarball
+(e.g. the output of docker save, or of containerize --builder oci).
+
+Without a tarball, print the manifest of this application.`,
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			labelsOnly, _ := cmd.Flags().GetBool("labels")
+			platformFlag, _ := cmd.Flags().GetString("platform")
+
+			var v any
+			switch {
+			case len(args) == 0 && labelsOnly:
+				v = a.imageLabels()
+			case len(args) == 0:
+				v = a.imageManifest()
+			default:
+				var platform ociPlatform
+				if platformFlag != "" {
+					var err error
+					if platform, err = parsePlatform(platformFlag); err != nil {
+						return err
+					}
+				}
+				img, err := readImageArchive(args[0], platform)
+				if err != nil {
+					return err
+				}
+				if labelsOnly {
+					v = img.runConfig()["Labels"]
+					if v == nil {
+						v = map[string]any{}
+					}
+					break
+				}
+				data, err := readImageManifest(img)
+				if err != nil {
+					return fmt.Errorf("%s: %w", args[0], err)
+				}
+				v = json.RawMessage(data)
+			}
+
+			data, err := json.MarshalIndent(v, "", "  ")
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(cmd.OutOrStdout(), string(data))
+			return err
+		},
+	}
+	cmd.Flags().Bool("labels", false, "Print the image labels instead of the manifest")
+	cmd.Flags().String("platform", "", "Platform of multi-platform images (default: the first one)")
+	return cmd
+}
+
+// readImageManifest returns the content of the app manifest of img, looking
+// for it from the top layer down.
+func readImageManifest(img *ociImage) ([]byte, error) {
+	name := strings.TrimPrefix(imageManifestPath, "/")
+	labels, _ := img.runConfig()["Labels"].(map[string]any)
+	if p, ok := labels[labelManifest].(string); ok && p != "" {
+		name = strings.TrimPrefix(path.Clean(p), "/")
+	}
+	for i := len(img.layers) - 1; i >= 0; i-- {
+		data, found, err := readLayerFile(img.layers[i], name)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("no kuniumi manifest in image (not built by containerize?)")
+}
+
+// readLayerFile returns the content of the named file of a layer.
+func readLayerFile(layer imageLayer, name string) ([]byte, bool, error) {
+	r, err := layer.open()
+	if err != nil {
+		return nil, false, err
+	}
+	defer r.Close()
+
+	br := bufio.NewReader(r)
+	var lr io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, false, err
+		}
+		defer zr.Close()
+		lr = zr
+	}
+
+	tr := tar.NewReader(lr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if hdr.Typeflag == tar.TypeReg && path.Clean(strings.TrimPrefix(hdr.Name, "./")) == name {
+			data, err := io.ReadAll(tr)
+			return data, err == nil, err
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package kuniumi
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageManifest(t *testing.T) {
+	app := newCgiTestApp()
+
+	m := app.imageManifest()
+	assert.Equal(t, "test", m.Name)
+	assert.Equal(t, "1.0.0", m.Version)
+	assert.Equal(t, frameworkVersionString(), m.Framework)
+	require.Len(t, m.Functions, 2)
+	assert.Equal(t, "addInts", m.Functions[0].Name)
+	assert.Equal(t, "functions.addInts", m.Functions[0].OperationID)
+	assert.Contains(t, m.OpenAPI["paths"], "/functions/addInts")
+
+	labels := app.imageLabels()
+	assert.Equal(t, "test", labels[labelTitle])
+	assert.Equal(t, "1.0.0", labels[labelVersion])
+	assert.Equal(t, imageManifestPath, labels[labelManifest])
+	var ids []string
+	require.NoError(t, json.Unmarshal([]byte(labels[labelFunctions]), &ids))
+	assert.Equal(t, []string{"functions.addInts", "functions." + app.functions[1].Name}, ids)
+}
+
+func TestRenderDockerfile_Manifest(t *testing.T) {
+	app := newCgiTestApp()
+	opts := defaultDockerfileOptions()
+	opts.Labels = app.imageLabels()
+	var err error
+	opts.Manifest, err = json.Marshal(app.imageManifest())
+	require.NoError(t, err)
+
+	dockerfile, err := renderDockerfile(opts)
+	require.NoError(t, err)
+	assert.Contains(t, dockerfile, `LABEL "org.opencontainers.image.title"="test"`)
+	assert.Contains(t, dockerfile, `LABEL "io.kuniumi.functions"="[\"functions.addInts\",`)
+	assert.True(t, strings.HasPrefix(dockerfile, "# syntax=docker/dockerfile:1\n"), "heredocs need Dockerfile syntax 1.4 or later")
+	assert.Contains(t, dockerfile, "COPY <<\"KUNIUMI_MANIFEST\" /app/kuniumi.json\n"+string(opts.Manifest)+"\nKUNIUMI_MANIFEST\n")
+
+	// Large manifests are not passed as a command argument
+	opts.Manifest, err = json.Marshal(map[string]string{"openapi": strings.Repeat("x", 256<<10)})
+	require.NoError(t, err)
+	dockerfile, err = renderDockerfile(opts)
+	require.NoError(t, err)
+	for _, line := range strings.Split(dockerfile, "\n") {
+		if strings.HasPrefix(line, "RUN ") {
+			assert.Less(t, len(line), 1024)
+		}
+	}
+}
+
+// newTestAppImage returns an archive of the app image built by the oci
+// builder, with a fake binary.
+func newTestAppImage(t *testing.T, app *App, format string) string {
+	t.Helper()
+	manifest, err := json.Marshal(app.imageManifest())
+	require.NoError(t, err)
+	opts := defaultDockerfileOptions()
+	opts.Labels = app.imageLabels()
+
+	layer, err := newFileLayer([]layerFile{
+		{name: "app/app", mode: 0755, data: []byte("binary")},
+		{name: "app/kuniumi.json", mode: 0644, data: manifest},
+	}, ociTestTime)
+	require.NoError(t, err)
+	img := &ociImage{config: map[string]any{
+		"config": map[string]any{"Labels": map[string]any{"maintainer": "base"}},
+	}}
+	img.addLayer(layer, "kuniumi containerize", ociTestTime)
+	configureImage(img, opts, ociPlatform{OS: "linux", Architecture: "amd64"}, ociTestTime)
+	return writeTestArchive(t, img, format)
+}
+
+func TestInspectImageCmd(t *testing.T) {
+	app := newCgiTestApp()
+
+	for _, format := range []string{imageFormatOCI, imageFormatDocker} {
+		t.Run(format, func(t *testing.T) {
+			tarball := newTestAppImage(t, app, format)
+
+			var out bytes.Buffer
+			cmd := app.buildInspectImageCmd()
+			cmd.SetOut(&out)
+			cmd.SetArgs([]string{tarball})
+			require.NoError(t, cmd.Execute())
+
+			var m imageManifest
+			require.NoError(t, json.Unmarshal(out.Bytes(), &m))
+			assert.Equal(t, "test", m.Name)
+			require.Len(t, m.Functions, 2)
+			assert.Equal(t, "functions.addInts", m.Functions[0].OperationID)
+			assert.Equal(t, "3.0.0", m.OpenAPI["openapi"])
+
+			out.Reset()
+			cmd = app.buildInspectImageCmd()
+			cmd.SetOut(&out)
+			cmd.SetArgs([]string{"--labels", tarball})
+			require.NoError(t, cmd.Execute())
+			var labels map[string]string
+			require.NoError(t, json.Unmarshal(out.Bytes(), &labels))
+			assert.Equal(t, "test", labels[labelTitle])
+			assert.Equal(t, "base", labels["maintainer"], "labels of the base image are kept")
+		})
+	}
+}
+
+func TestInspectImageCmd_Self(t *testing.T) {
+	app := newCgiTestApp()
+	var out bytes.Buffer
+	cmd := app.buildInspectImageCmd()
+	cmd.SetOut(&out)
+	cmd.SetArgs(nil)
+	require.NoError(t, cmd.Execute())
+
+	var m imageManifest
+	require.NoError(t, json.Unmarshal(out.Bytes(), &m))
+	assert.Equal(t, "test", m.Name)
+	assert.Len(t, m.Functions, 2)
+}
+
+func TestInspectImageCmd_NoManifest(t *testing.T) {
+	tarball := writeTestArchive(t, newTestImage(t, nil), imageFormatOCI)
+
+	cmd := newCgiTestApp().buildInspectImageCmd()
+	cmd.SetOut(&bytes.Buffer{})
+	cmd.SetErr(&bytes.Buffer{})
+	cmd.SetArgs([]string{tarball})
+	assert.ErrorContains(t, cmd.Execute(), "no kuniumi manifest")
+}
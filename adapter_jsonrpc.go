@@ -0,0 +1,392 @@
+package kuniumi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// JSON-RPC 2.0 error codes.
+const (
+	jsonrpcParseError     = -32700
+	jsonrpcInvalidRequest = -32600
+	jsonrpcMethodNotFound = -32601
+	jsonrpcInvalidParams  = -32602
+	jsonrpcInternalError  = -32603
+	// jsonrpcServerError is reported for errors returned by functions.
+	jsonrpcServerError = -32000
+)
+
+// CodedError is an error with an error code. Under the jsonrpc adapter, a
+// function returning a CodedError (possibly wrapped) reports Code, Message and
+// Data as the JSON-RPC error instead of the generic server error (-32000).
+type CodedError struct {
+	Code    int
+	Message string
+	Data    any
+}
+
+func (e *CodedError) Error() string {
+	return e.Message
+}
+
+// ErrorCode returns the error code.
+func (e *CodedError) ErrorCode() int {
+	return e.Code
+}
+
+// ErrorData returns the additional error data, if any.
+func (e *CodedError) ErrorData() any {
+	return e.Data
+}
+
+func (a *App) buildJsonrpcCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "jsonrpc",
+		Short: "Run as a JSON-RPC 2.0 server (stdio or HTTP)",
+		Long: `Run as a JSON-RPC 2.0 server.
+
+Each registered function is a method, called by operation ID (functions.Add)
+or by name (Add). Params are an object of named arguments or an array of
+positional arguments. Batch requests and notifications are supported.
+
+Over stdio (the default), each line of stdin is a request or a batch, and each
+response is written as a line to stdout. With --http, requests are POSTed to /;
+the server listens like serve does (--port, --listen or systemd sockets) and
+on SIGINT or SIGTERM, in-flight requests are given --shutdown-timeout to
+complete. At most --parallel messages are handled at a time.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			useHttp, _ := cmd.Flags().GetBool("http")
+			parallel, _ := cmd.Flags().GetInt("parallel")
+			if parallel < 1 {
+				return fmt.Errorf("--parallel must be at least 1")
+			}
+			if !useHttp {
+				return a.serveJsonrpcStream(cmd.Context(), os.Stdin, os.Stdout, parallel)
+			}
+
+			listeners, shutdownTimeout, err := openListeners(cmd)
+			if err != nil {
+				return err
+			}
+			for _, l := range listeners {
+				fmt.Fprintf(os.Stderr, "Serving JSON-RPC on %s\n", l.Addr())
+			}
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			srv := &http.Server{Handler: a.newJsonrpcHandler(parallel)}
+			return serveListeners(ctx, srv, listeners, shutdownTimeout)
+		},
+	}
+	cmd.Flags().Bool("http", false, "Serve over HTTP instead of stdio")
+	cmd.Flags().IntP("parallel", "p", defaultJsonrpcParallel, "Number of messages handled concurrently")
+	addListenFlags(cmd, 8080)
+	return cmd
+}
+
+// defaultJsonrpcParallel is the default number of messages handled
+// concurrently by the jsonrpc adapter.
+const defaultJsonrpcParallel = 16
+
+// jsonrpcRequest is a JSON-RPC request or notification (without ID).
+type jsonrpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// jsonrpcResponse is a JSON-RPC response. Exactly one of Result and Error is set.
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+// jsonrpcNullID is the ID of responses to requests whose ID cannot be determined.
+var jsonrpcNullID = json.RawMessage("null")
+
+// serveJsonrpcStream serves newline-delimited JSON-RPC messages from r until
+// EOF, writing one response line per request or batch. Up to parallel
+// messages are handled concurrently, so responses may be written out of
+// order; further lines are read when one of them is done.
+func (a *App) serveJsonrpcStream(ctx context.Context, r io.Reader, w io.Writer, parallel int) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		out = bufio.NewWriter(w)
+		sem = make(chan struct{}, parallel)
+	)
+	defer wg.Wait()
+
+	in := bufio.NewReader(r)
+	for {
+		line, err := in.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				resp := a.handleJsonrpc(ctx, line)
+				if resp == nil {
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				out.Write(resp)
+				out.WriteByte('\n')
+				out.Flush()
+			}()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// newJsonrpcHandler returns the HTTP handler of the jsonrpc adapter, which
+// handles up to parallel requests at a time. Requests made only of
+// notifications get 204 No Content.
+func (a *App) newJsonrpcHandler(parallel int) http.Handler {
+	sem := make(chan struct{}, parallel)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /{$}", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+		case <-r.Context().Done():
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeJSONError(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		ctx := withRequestInfo(r.Context(), newRequestInfo(r))
+		resp := a.handleJsonrpc(ctx, body)
+		if resp == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resp)
+	})
+	return mux
+}
+
+// handleJsonrpc handles a single message (a request, a notification or a
+// batch) and returns the encoded response, or nil if there is none.
+func (a *App) handleJsonrpc(ctx context.Context, data []byte) []byte {
+	data = bytes.TrimSpace(data)
+	if !json.Valid(data) {
+		return jsonrpcEncode(jsonrpcErrorResponse(jsonrpcNullID, jsonrpcParseError, "Parse error"))
+	}
+
+	// Batch
+	if data[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(data, &batch); err != nil || len(batch) == 0 {
+			return jsonrpcEncode(jsonrpcErrorResponse(jsonrpcNullID, jsonrpcInvalidRequest, "Invalid Request"))
+		}
+
+		responses := make([]*jsonrpcResponse, len(batch))
+		var wg sync.WaitGroup
+		for i, msg := range batch {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				responses[i] = a.handleJsonrpcRequest(ctx, msg)
+			}()
+		}
+		wg.Wait()
+
+		var out []*jsonrpcResponse
+		for _, resp := range responses {
+			if resp != nil {
+				out = append(out, resp)
+			}
+		}
+		if len(out) == 0 {
+			return nil
+		}
+		return jsonrpcEncode(out)
+	}
+
+	if resp := a.handleJsonrpcRequest(ctx, data); resp != nil {
+		return jsonrpcEncode(resp)
+	}
+	return nil
+}
+
+// handleJsonrpcRequest calls the method of a single request. It returns nil
+// for notifications, whose result (or error) is discarded.
+func (a *App) handleJsonrpcRequest(ctx context.Context, data json.RawMessage) (resp *jsonrpcResponse) {
+	var req jsonrpcRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return jsonrpcErrorResponse(jsonrpcNullID, jsonrpcInvalidRequest, "Invalid Request")
+	}
+	id := req.ID
+	if id == nil {
+		id = jsonrpcNullID
+	} else if !jsonrpcValidID(id) {
+		return jsonrpcErrorResponse(jsonrpcNullID, jsonrpcInvalidRequest, "Invalid Request: id must be a string, a number or null")
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return jsonrpcErrorResponse(id, jsonrpcInvalidRequest, "Invalid Request")
+	}
+	if req.ID == nil {
+		// Notification: the result or error is not reported
+		defer func() { resp = nil }()
+	}
+
+	fn := a.findFunction(req.Method)
+	if fn == nil {
+		return jsonrpcErrorResponse(id, jsonrpcMethodNotFound, fmt.Sprintf("Method not found: %s", req.Method))
+	}
+
+	args, err := jsonrpcArgs(fn, req.Params)
+	if err != nil {
+		return jsonrpcErrorResponse(id, jsonrpcInvalidParams, fmt.Sprintf("Invalid params: %v", err))
+	}
+
+	// A panicking function must not take the whole stdio server down
+	defer func() {
+		if r := recover(); r != nil {
+			resp = jsonrpcErrorResponse(id, jsonrpcInternalError, fmt.Sprintf("Internal error: %v", r))
+		}
+	}()
+
+	results, err := CallFunction(a.ContextWithEnv(ctx), fn.Meta, args)
+	if err != nil {
+		return &jsonrpcResponse{JSONRPC: "2.0", Error: jsonrpcErrorFrom(err), ID: id}
+	}
+	if results, err = jsonResults(results); err != nil {
+		return jsonrpcErrorResponse(id, jsonrpcInternalError, fmt.Sprintf("Internal error: %v", err))
+	}
+
+	result, err := json.Marshal(jsonrpcResult(results))
+	if err != nil {
+		return jsonrpcErrorResponse(id, jsonrpcInternalError, fmt.Sprintf("Internal error: %v", err))
+	}
+	return &jsonrpcResponse{JSONRPC: "2.0", Result: result, ID: id}
+}
+
+// jsonrpcArgs converts the params of a request into function arguments.
+// Params are either an object of named arguments or an array of positional ones.
+func jsonrpcArgs(fn *RegisteredFunc, params json.RawMessage) (map[string]any, error) {
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 || bytes.Equal(params, []byte("null")) {
+		return nil, nil
+	}
+
+	switch params[0] {
+	case '{':
+		var args map[string]any
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		return args, nil
+	case '[':
+		var values []any
+		if err := json.Unmarshal(params, &values); err != nil {
+			return nil, err
+		}
+		if len(values) > len(fn.Meta.Args) {
+			return nil, fmt.Errorf("%s takes %d arguments, got %d", fn.Name, len(fn.Meta.Args), len(values))
+		}
+		args := make(map[string]any, len(values))
+		for i, v := range values {
+			args[fn.Meta.Args[i].Name] = v
+		}
+		return args, nil
+	default:
+		return nil, fmt.Errorf("params must be an object or an array")
+	}
+}
+
+// jsonrpcResult returns the result of a call: the value itself for functions
+// with a single return value, null for functions returning only an error, and
+// the standard {"result0": ..., "result1": ...} object otherwise.
+func jsonrpcResult(results []any) any {
+	switch len(results) {
+	case 0:
+		return nil
+	case 1:
+		return results[0]
+	default:
+		return buildSuccessResponse(results)
+	}
+}
+
+// jsonrpcErrorFrom maps an error returned by CallFunction to a JSON-RPC error.
+func jsonrpcErrorFrom(err error) *jsonrpcError {
+	var coded interface{ ErrorCode() int }
+	if errors.As(err, &coded) {
+		rpcErr := &jsonrpcError{Code: coded.ErrorCode(), Message: err.Error()}
+		if d, ok := coded.(interface{ ErrorData() any }); ok {
+			rpcErr.Data = d.ErrorData()
+		}
+		return rpcErr
+	}
+	if isArgError(err) {
+		return &jsonrpcError{Code: jsonrpcInvalidParams, Message: fmt.Sprintf("Invalid params: %v", err)}
+	}
+	return &jsonrpcError{Code: jsonrpcServerError, Message: err.Error()}
+}
+
+func jsonrpcErrorResponse(id json.RawMessage, code int, msg string) *jsonrpcResponse {
+	return &jsonrpcResponse{
+		JSONRPC: "2.0",
+		Error:   &jsonrpcError{Code: code, Message: msg},
+		ID:      id,
+	}
+}
+
+// jsonrpcValidID reports whether id is a string, a number or null.
+func jsonrpcValidID(id json.RawMessage) bool {
+	var v any
+	if err := json.Unmarshal(id, &v); err != nil {
+		return false
+	}
+	switch v.(type) {
+	case string, float64, nil:
+		return true
+	}
+	return false
+}
+
+func jsonrpcEncode(v any) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		// Only reachable with unencodable error data
+		data, _ = json.Marshal(jsonrpcErrorResponse(jsonrpcNullID, jsonrpcInternalError, "Internal error"))
+	}
+	return data
+}
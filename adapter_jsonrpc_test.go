@@ -0,0 +1,247 @@
+package kuniumi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newJsonrpcTestApp() *App {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	app.RegisterFunc(addInts, "adds", WithParams(Param("x", "x"), Param("y", "y")))
+	app.RegisterFunc(func(ctx context.Context, id string) (string, error) {
+		return "", fmt.Errorf("lookup failed: %w", &CodedError{Code: 404, Message: "user not found", Data: map[string]string{"id": id}})
+	}, "returns a coded error", WithArgs("id"))
+	app.RegisterFunc(func(ctx context.Context) error {
+		return errors.New("boom")
+	}, "fails")
+	app.RegisterFunc(func(ctx context.Context) error {
+		panic("unexpected")
+	}, "panics")
+	return app
+}
+
+func TestHandleJsonrpc(t *testing.T) {
+	app := newJsonrpcTestApp()
+	coded := app.functions[1].Name
+	fails := app.functions[2].Name
+	panics := app.functions[3].Name
+
+	tests := []struct {
+		name string
+		req  string
+		want string // empty for no response
+	}{
+		{
+			name: "by operation ID",
+			req:  `{"jsonrpc": "2.0", "method": "functions.addInts", "params": {"x": 1, "y": 2}, "id": 1}`,
+			want: `{"jsonrpc": "2.0", "result": 3, "id": 1}`,
+		},
+		{
+			name: "by name with positional params",
+			req:  `{"jsonrpc": "2.0", "method": "addInts", "params": [4, 5], "id": "a"}`,
+			want: `{"jsonrpc": "2.0", "result": 9, "id": "a"}`,
+		},
+		{
+			name: "null id is a request",
+			req:  `{"jsonrpc": "2.0", "method": "addInts", "id": null}`,
+			want: `{"jsonrpc": "2.0", "result": 0, "id": null}`,
+		},
+		{
+			name: "notification",
+			req:  `{"jsonrpc": "2.0", "method": "addInts", "params": [1, 2]}`,
+		},
+		{
+			name: "failing notification",
+			req:  `{"jsonrpc": "2.0", "method": "` + fails + `"}`,
+		},
+		{
+			name: "parse error",
+			req:  `{"jsonrpc": "2.0", "method"`,
+			want: `{"jsonrpc": "2.0", "error": {"code": -32700, "message": "Parse error"}, "id": null}`,
+		},
+		{
+			name: "invalid request",
+			req:  `{"jsonrpc": "1.0", "method": "addInts", "id": 2}`,
+			want: `{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": 2}`,
+		},
+		{
+			name: "invalid request without id",
+			req:  `{"foo": "bar"}`,
+			want: `{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}`,
+		},
+		{
+			name: "empty batch",
+			req:  `[]`,
+			want: `{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}`,
+		},
+		{
+			name: "method not found",
+			req:  `{"jsonrpc": "2.0", "method": "Missing", "id": 3}`,
+			want: `{"jsonrpc": "2.0", "error": {"code": -32601, "message": "Method not found: Missing"}, "id": 3}`,
+		},
+		{
+			name: "too many positional params",
+			req:  `{"jsonrpc": "2.0", "method": "addInts", "params": [1, 2, 3], "id": 4}`,
+			want: `{"jsonrpc": "2.0", "error": {"code": -32602, "message": "Invalid params: addInts takes 2 arguments, got 3"}, "id": 4}`,
+		},
+		{
+			name: "argument type mismatch",
+			req:  `{"jsonrpc": "2.0", "method": "addInts", "params": {"x": true}, "id": 5}`,
+			want: `{"jsonrpc": "2.0", "error": {"code": -32602, "message": "Invalid params: cannot convert bool to int"}, "id": 5}`,
+		},
+		{
+			name: "function error",
+			req:  `{"jsonrpc": "2.0", "method": "` + fails + `", "id": 6}`,
+			want: `{"jsonrpc": "2.0", "error": {"code": -32000, "message": "boom"}, "id": 6}`,
+		},
+		{
+			name: "coded error",
+			req:  `{"jsonrpc": "2.0", "method": "` + coded + `", "params": ["u1"], "id": 7}`,
+			want: `{"jsonrpc": "2.0", "error": {"code": 404, "message": "lookup failed: user not found", "data": {"id": "u1"}}, "id": 7}`,
+		},
+		{
+			name: "panic",
+			req:  `{"jsonrpc": "2.0", "method": "` + panics + `", "id": 8}`,
+			want: `{"jsonrpc": "2.0", "error": {"code": -32603, "message": "Internal error: unexpected"}, "id": 8}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := app.handleJsonrpc(context.Background(), []byte(tt.req))
+			if tt.want == "" {
+				assert.Nil(t, resp, string(resp))
+				return
+			}
+			assert.JSONEq(t, tt.want, string(resp))
+		})
+	}
+}
+
+func TestHandleJsonrpc_Batch(t *testing.T) {
+	app := newJsonrpcTestApp()
+
+	resp := app.handleJsonrpc(context.Background(), []byte(`[
+		{"jsonrpc": "2.0", "method": "addInts", "params": [1, 1], "id": 1},
+		{"jsonrpc": "2.0", "method": "addInts", "params": [2, 2]},
+		1,
+		{"jsonrpc": "2.0", "method": "Missing", "id": 2}
+	]`))
+	assert.JSONEq(t, `[
+		{"jsonrpc": "2.0", "result": 2, "id": 1},
+		{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null},
+		{"jsonrpc": "2.0", "error": {"code": -32601, "message": "Method not found: Missing"}, "id": 2}
+	]`, string(resp))
+
+	// A batch of notifications has no response
+	resp = app.handleJsonrpc(context.Background(), []byte(`[{"jsonrpc": "2.0", "method": "addInts"}]`))
+	assert.Nil(t, resp)
+}
+
+func TestHandleJsonrpc_BinaryResult(t *testing.T) {
+	readers := make(chan *closeTrackingReader, 1)
+	app := newReaderApp(readers)
+
+	resp := app.handleJsonrpc(context.Background(), []byte(`{"jsonrpc": "2.0", "method": "`+app.functions[0].Name+`", "id": 1}`))
+	assert.JSONEq(t, `{"jsonrpc": "2.0", "result": `+readerResultJSON+`, "id": 1}`, string(resp))
+	assert.True(t, (<-readers).closed.Load())
+}
+
+func TestServeJsonrpcStream(t *testing.T) {
+	app := newJsonrpcTestApp()
+
+	in := strings.Join([]string{
+		`{"jsonrpc": "2.0", "method": "addInts", "params": [1, 2], "id": 1}`,
+		``,
+		`{"jsonrpc": "2.0", "method": "addInts", "params": [3, 4]}`,
+		`{"jsonrpc": "2.0", "method": "addInts", "params": [5, 6], "id": 2}`,
+	}, "\n")
+	var out strings.Builder
+	require.NoError(t, app.serveJsonrpcStream(context.Background(), strings.NewReader(in), &out, defaultJsonrpcParallel))
+
+	// Requests are handled concurrently, so responses may come in any order
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.ElementsMatch(t, []string{
+		`{"jsonrpc":"2.0","result":3,"id":1}`,
+		`{"jsonrpc":"2.0","result":11,"id":2}`,
+	}, lines)
+}
+
+func TestServeJsonrpcStream_Parallel(t *testing.T) {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	var running, peak atomic.Int64
+	app.RegisterFunc(func(ctx context.Context) (int, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		return 1, nil
+	}, "sleeps")
+	method := app.functions[0].Name
+
+	var lines []string
+	for i := range 6 {
+		lines = append(lines, fmt.Sprintf(`{"jsonrpc": "2.0", "method": %q, "id": %d}`, method, i))
+	}
+	var out strings.Builder
+	require.NoError(t, app.serveJsonrpcStream(context.Background(), strings.NewReader(strings.Join(lines, "\n")), &out, 2))
+
+	assert.Len(t, strings.Split(strings.TrimSpace(out.String()), "\n"), 6)
+	assert.Equal(t, int64(2), peak.Load())
+}
+
+func TestJsonrpcCmd_Flags(t *testing.T) {
+	app := newJsonrpcTestApp()
+
+	t.Run("server flags", func(t *testing.T) {
+		// --http takes the listener and shutdown flags of serve
+		cmd := app.buildJsonrpcCmd()
+		for _, flag := range []string{"http", "parallel", "port", "listen", "shutdown-timeout"} {
+			assert.NotNil(t, cmd.Flags().Lookup(flag), flag)
+		}
+	})
+
+	t.Run("invalid parallel", func(t *testing.T) {
+		cmd := app.buildJsonrpcCmd()
+		cmd.SetArgs([]string{"--parallel", "0"})
+		cmd.SilenceUsage = true
+		cmd.SilenceErrors = true
+		assert.EqualError(t, cmd.Execute(), "--parallel must be at least 1")
+	})
+}
+
+func TestJsonrpcHttp(t *testing.T) {
+	srv := httptest.NewServer(newJsonrpcTestApp().newJsonrpcHandler(defaultJsonrpcParallel))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/", "application/json",
+		strings.NewReader(`{"jsonrpc": "2.0", "method": "functions.addInts", "params": {"x": 2, "y": 3}, "id": 1}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	body, _ := io.ReadAll(resp.Body)
+	assert.JSONEq(t, `{"jsonrpc": "2.0", "result": 5, "id": 1}`, string(body))
+
+	resp, err = http.Post(srv.URL+"/", "application/json",
+		strings.NewReader(`{"jsonrpc": "2.0", "method": "addInts"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
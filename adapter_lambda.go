@@ -0,0 +1,424 @@
+package kuniumi
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// lambdaAPIVersion is the path prefix of the Lambda Runtime API.
+const lambdaAPIVersion = "2018-06-01"
+
+func (a *App) buildLambdaCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "lambda",
+		Short: "Run as an AWS Lambda custom runtime",
+		Long: `Run as an AWS Lambda custom runtime (e.g. the bootstrap of provided.al2023).
+
+Invocations are read from the Lambda Runtime API (AWS_LAMBDA_RUNTIME_API).
+API Gateway (REST and HTTP API) and Function URL events are routed by path like
+in serve mode: POST /functions/{name} and GET /openapi.json. Any other event is
+passed as the arguments of the function given by --function, which defaults to
+the handler setting (_HANDLER) or to the only registered function.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			api, _ := cmd.Flags().GetString("runtime-api")
+			function, _ := cmd.Flags().GetString("function")
+			if api == "" {
+				return fmt.Errorf("the Lambda Runtime API address is not set (AWS_LAMBDA_RUNTIME_API)")
+			}
+			return a.runLambda(cmd.Context(), newLambdaRuntime(api), function)
+		},
+	}
+	cmd.Flags().String("runtime-api", os.Getenv("AWS_LAMBDA_RUNTIME_API"), "Lambda Runtime API address (host:port)")
+	cmd.Flags().String("function", os.Getenv("_HANDLER"), "Function invoked by non-HTTP events")
+	return cmd
+}
+
+// lambdaRuntime is a client of the Lambda Runtime API.
+type lambdaRuntime struct {
+	baseURL string
+	client  *http.Client
+}
+
+func newLambdaRuntime(api string) *lambdaRuntime {
+	return &lambdaRuntime{
+		baseURL: fmt.Sprintf("http://%s/%s/runtime", api, lambdaAPIVersion),
+		// No timeout: /invocation/next blocks until the next event arrives
+		client: &http.Client{},
+	}
+}
+
+// lambdaInvocation is an event received from /runtime/invocation/next.
+type lambdaInvocation struct {
+	requestID string
+	deadline  time.Time
+	traceID   string
+	payload   []byte
+}
+
+// lambdaError is the error document posted to the Runtime API.
+type lambdaError struct {
+	ErrorMessage string `json:"errorMessage"`
+	ErrorType    string `json:"errorType"`
+}
+
+// next blocks until the next invocation is available.
+func (rt *lambdaRuntime) next(ctx context.Context) (*lambdaInvocation, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rt.baseURL+"/invocation/next", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("runtime API /invocation/next: %s: %s", resp.Status, payload)
+	}
+
+	inv := &lambdaInvocation{
+		requestID: resp.Header.Get("Lambda-Runtime-Aws-Request-Id"),
+		traceID:   resp.Header.Get("Lambda-Runtime-Trace-Id"),
+		payload:   payload,
+	}
+	if inv.requestID == "" {
+		return nil, fmt.Errorf("runtime API /invocation/next: missing Lambda-Runtime-Aws-Request-Id")
+	}
+	if ms, err := strconv.ParseInt(resp.Header.Get("Lambda-Runtime-Deadline-Ms"), 10, 64); err == nil {
+		inv.deadline = time.UnixMilli(ms)
+	}
+	return inv, nil
+}
+
+// respond posts the result of an invocation.
+func (rt *lambdaRuntime) respond(ctx context.Context, requestID string, body []byte) error {
+	return rt.post(ctx, "/invocation/"+requestID+"/response", body, "")
+}
+
+// fail posts the error of an invocation.
+func (rt *lambdaRuntime) fail(ctx context.Context, requestID string, lerr lambdaError) error {
+	body, _ := json.Marshal(lerr)
+	return rt.post(ctx, "/invocation/"+requestID+"/error", body, lerr.ErrorType)
+}
+
+// initError reports an error that prevents the runtime from processing events.
+func (rt *lambdaRuntime) initError(ctx context.Context, lerr lambdaError) error {
+	body, _ := json.Marshal(lerr)
+	return rt.post(ctx, "/init/error", body, lerr.ErrorType)
+}
+
+func (rt *lambdaRuntime) post(ctx context.Context, path string, body []byte, errorType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rt.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if errorType != "" {
+		req.Header.Set("Lambda-Runtime-Function-Error-Type", errorType)
+	}
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("runtime API %s: %s", path, resp.Status)
+	}
+	return nil
+}
+
+// runLambda processes invocations until ctx is cancelled.
+// function selects the function invoked by non-HTTP events; it may be empty
+// when the app registers a single function or only serves HTTP events.
+func (a *App) runLambda(ctx context.Context, rt *lambdaRuntime, function string) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var defaultFn *RegisteredFunc
+	switch {
+	case function != "":
+		if defaultFn = a.findFunction(function); defaultFn == nil {
+			err := fmt.Errorf("function not found: %s", function)
+			rt.initError(ctx, lambdaError{ErrorMessage: err.Error(), ErrorType: "Runtime.InvalidHandler"})
+			return err
+		}
+	case len(a.functions) == 1:
+		defaultFn = a.functions[0]
+	}
+
+	for {
+		inv, err := rt.next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		body, lerr := a.handleLambdaInvocation(ctx, inv, defaultFn)
+		if lerr != nil {
+			err = rt.fail(ctx, inv.requestID, *lerr)
+		} else {
+			err = rt.respond(ctx, inv.requestID, body)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// handleLambdaInvocation runs a single invocation and returns the response
+// payload, or the error to report.
+func (a *App) handleLambdaInvocation(ctx context.Context, inv *lambdaInvocation, defaultFn *RegisteredFunc) (resp []byte, lerr *lambdaError) {
+	// A panicking function fails its invocation, not the runtime
+	defer func() {
+		if r := recover(); r != nil {
+			resp, lerr = nil, &lambdaError{ErrorMessage: fmt.Sprintf("panic: %v", r), ErrorType: "Runtime.Panic"}
+		}
+	}()
+
+	if !inv.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, inv.deadline)
+		defer cancel()
+	}
+	// The X-Ray SDK reads the trace ID from the environment
+	if inv.traceID != "" {
+		os.Setenv("_X_AMZN_TRACE_ID", inv.traceID)
+	}
+
+	var event lambdaHttpEvent
+	if err := json.Unmarshal(inv.payload, &event); err == nil && event.method() != "" {
+		resp, err := json.Marshal(a.serveLambdaHttp(ctx, &event))
+		if err != nil {
+			return nil, &lambdaError{ErrorMessage: err.Error(), ErrorType: "Runtime.MarshalError"}
+		}
+		return resp, nil
+	}
+
+	if defaultFn == nil {
+		return nil, &lambdaError{
+			ErrorMessage: "no function selected for this event: set --function or _HANDLER",
+			ErrorType:    "Runtime.InvalidHandler",
+		}
+	}
+
+	var args map[string]any
+	if len(bytes.TrimSpace(inv.payload)) > 0 {
+		if err := json.Unmarshal(inv.payload, &args); err != nil {
+			return nil, &lambdaError{ErrorMessage: "event is not a JSON object: " + err.Error(), ErrorType: "Runtime.UnmarshalError"}
+		}
+	}
+
+	results, err := CallFunction(a.ContextWithEnv(ctx), defaultFn.Meta, args)
+	if err != nil {
+		return nil, &lambdaError{ErrorMessage: err.Error(), ErrorType: "Function.Error"}
+	}
+	if results, err = jsonResults(results); err != nil {
+		return nil, &lambdaError{ErrorMessage: err.Error(), ErrorType: "Runtime.MarshalError"}
+	}
+	resp, err = json.Marshal(buildSuccessResponse(results))
+	if err != nil {
+		return nil, &lambdaError{ErrorMessage: err.Error(), ErrorType: "Runtime.MarshalError"}
+	}
+	return resp, nil
+}
+
+// lambdaHttpEvent holds the fields used from API Gateway REST API (payload 1.0),
+// HTTP API (payload 2.0) and Function URL events.
+type lambdaHttpEvent struct {
+	// Payload 1.0
+	HTTPMethod                      string              `json:"httpMethod"`
+	Path                            string              `json:"path"`
+	MultiValueQueryStringParameters map[string][]string `json:"multiValueQueryStringParameters"`
+	QueryStringParameters           map[string]string   `json:"queryStringParameters"`
+	MultiValueHeaders               map[string][]string `json:"multiValueHeaders"`
+
+	// Payload 2.0 and Function URLs
+	RawPath        string   `json:"rawPath"`
+	RawQueryString string   `json:"rawQueryString"`
+	Cookies        []string `json:"cookies"`
+
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+	RequestContext  struct {
+		HTTP struct {
+			Method   string `json:"method"`
+			SourceIP string `json:"sourceIp"`
+		} `json:"http"`
+		Identity struct {
+			SourceIP string `json:"sourceIp"`
+		} `json:"identity"`
+	} `json:"requestContext"`
+}
+
+// lambdaHttpResponse is the response format of API Gateway and Function URLs.
+type lambdaHttpResponse struct {
+	StatusCode        int                 `json:"statusCode"`
+	Headers           map[string]string   `json:"headers,omitempty"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// method returns the HTTP method of the event, or "" if it is not an HTTP event.
+func (e *lambdaHttpEvent) method() string {
+	if e.RequestContext.HTTP.Method != "" {
+		return strings.ToUpper(e.RequestContext.HTTP.Method)
+	}
+	return strings.ToUpper(e.HTTPMethod)
+}
+
+// httpRequest converts the event into an http.Request.
+func (e *lambdaHttpEvent) httpRequest(ctx context.Context) (*http.Request, error) {
+	u := &url.URL{Path: e.RawPath, RawQuery: e.RawQueryString}
+	if e.RawPath == "" {
+		u.Path = e.Path
+		query := url.Values{}
+		for k, vs := range e.MultiValueQueryStringParameters {
+			query[k] = vs
+		}
+		for k, v := range e.QueryStringParameters {
+			if _, ok := query[k]; !ok {
+				query.Set(k, v)
+			}
+		}
+		u.RawQuery = query.Encode()
+	}
+
+	body := []byte(e.Body)
+	if e.IsBase64Encoded {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(e.Body); err != nil {
+			return nil, fmt.Errorf("invalid base64 body: %w", err)
+		}
+	}
+
+	r, err := http.NewRequestWithContext(ctx, e.method(), u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range e.MultiValueHeaders {
+		for _, v := range vs {
+			r.Header.Add(k, v)
+		}
+	}
+	for k, v := range e.Headers {
+		if r.Header.Get(k) == "" {
+			r.Header.Set(k, v)
+		}
+	}
+	for _, c := range e.Cookies {
+		r.Header.Add("Cookie", c)
+	}
+	r.Host = r.Header.Get("Host")
+	r.RemoteAddr = e.RequestContext.HTTP.SourceIP
+	if r.RemoteAddr == "" {
+		r.RemoteAddr = e.RequestContext.Identity.SourceIP
+	}
+	r.RequestURI = u.RequestURI()
+	return r, nil
+}
+
+// serveLambdaHttp handles an API Gateway or Function URL event.
+func (a *App) serveLambdaHttp(ctx context.Context, event *lambdaHttpEvent) *lambdaHttpResponse {
+	w := &lambdaResponseWriter{header: http.Header{}}
+
+	r, err := event.httpRequest(ctx)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return w.response()
+	}
+	r = r.WithContext(withRequestInfo(r.Context(), newRequestInfo(r)))
+	a.routeRequest(w, r, strings.Trim(r.URL.Path, "/"))
+	return w.response()
+}
+
+// lambdaResponseWriter is an http.ResponseWriter that buffers the response
+// so it can be returned as an API Gateway response document.
+type lambdaResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *lambdaResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *lambdaResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *lambdaResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+// response builds the response document. Bodies that are not text are base64-encoded.
+func (w *lambdaResponseWriter) response() *lambdaHttpResponse {
+	resp := &lambdaHttpResponse{
+		StatusCode: w.status,
+		Headers:    map[string]string{},
+	}
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+	for k, vs := range w.header {
+		if len(vs) == 1 {
+			resp.Headers[k] = vs[0]
+			continue
+		}
+		if resp.MultiValueHeaders == nil {
+			resp.MultiValueHeaders = map[string][]string{}
+		}
+		resp.MultiValueHeaders[k] = vs
+	}
+
+	if isTextMediaType(w.header.Get("Content-Type")) {
+		resp.Body = w.body.String()
+	} else {
+		resp.Body = base64.StdEncoding.EncodeToString(w.body.Bytes())
+		resp.IsBase64Encoded = true
+	}
+	return resp
+}
+
+// isTextMediaType reports whether a Content-Type can be sent as a plain string.
+func isTextMediaType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mt, "text/") || mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
@@ -0,0 +1,259 @@
+package kuniumi
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLambdaRuntime is a local stand-in for the Lambda Runtime API. It hands
+// out the queued events, records what the runtime posts back, and cancels
+// the runtime once every event has been answered.
+type fakeLambdaRuntime struct {
+	t      *testing.T
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	events    []string
+	pending   int
+	responses map[string]string
+	errors    map[string]lambdaError
+	errTypes  map[string]string
+	initErr   *lambdaError
+}
+
+func newFakeLambdaRuntime(t *testing.T, cancel context.CancelFunc, events ...string) (*fakeLambdaRuntime, *httptest.Server) {
+	f := &fakeLambdaRuntime{
+		t:         t,
+		cancel:    cancel,
+		events:    events,
+		pending:   len(events),
+		responses: map[string]string{},
+		errors:    map[string]lambdaError{},
+		errTypes:  map[string]string{},
+	}
+	mux := http.NewServeMux()
+	prefix := "/" + lambdaAPIVersion + "/runtime"
+	mux.HandleFunc("GET "+prefix+"/invocation/next", f.next)
+	mux.HandleFunc("POST "+prefix+"/invocation/{id}/response", f.response)
+	mux.HandleFunc("POST "+prefix+"/invocation/{id}/error", f.error)
+	mux.HandleFunc("POST "+prefix+"/init/error", f.initError)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeLambdaRuntime) next(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	if len(f.events) == 0 {
+		f.mu.Unlock()
+		// Like the real API, block until an event arrives (or the runtime stops)
+		<-r.Context().Done()
+		return
+	}
+	event := f.events[0]
+	id := strconv.Itoa(len(f.events))
+	f.events = f.events[1:]
+	f.mu.Unlock()
+
+	w.Header().Set("Lambda-Runtime-Aws-Request-Id", "req-"+id)
+	w.Header().Set("Lambda-Runtime-Deadline-Ms", strconv.FormatInt(time.Now().Add(time.Minute).UnixMilli(), 10))
+	w.Header().Set("Lambda-Runtime-Trace-Id", "Root=1-abc")
+	io.WriteString(w, event)
+}
+
+func (f *fakeLambdaRuntime) answered() {
+	f.pending--
+	if f.pending == 0 {
+		f.cancel()
+	}
+}
+
+func (f *fakeLambdaRuntime) response(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses[r.PathValue("id")] = string(body)
+	f.answered()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (f *fakeLambdaRuntime) error(w http.ResponseWriter, r *http.Request) {
+	var lerr lambdaError
+	require.NoError(f.t, json.NewDecoder(r.Body).Decode(&lerr))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors[r.PathValue("id")] = lerr
+	f.errTypes[r.PathValue("id")] = r.Header.Get("Lambda-Runtime-Function-Error-Type")
+	f.answered()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (f *fakeLambdaRuntime) initError(w http.ResponseWriter, r *http.Request) {
+	var lerr lambdaError
+	require.NoError(f.t, json.NewDecoder(r.Body).Decode(&lerr))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.initErr = &lerr
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func runFakeLambda(t *testing.T, app *App, function string, events ...string) *fakeLambdaRuntime {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	f, srv := newFakeLambdaRuntime(t, cancel, events...)
+	rt := newLambdaRuntime(strings.TrimPrefix(srv.URL, "http://"))
+	require.NoError(t, app.runLambda(ctx, rt, function))
+	require.NotEqual(t, context.DeadlineExceeded, ctx.Err(), "runtime did not answer every event")
+	return f
+}
+
+func TestLambda_DirectInvocation(t *testing.T) {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	app.RegisterFunc(addInts, "adds", WithParams(Param("x", "x"), Param("y", "y")))
+
+	// A single registered function is invoked without --function
+	f := runFakeLambda(t, app, "", `{"x": 1, "y": 2}`, `[1, 2]`)
+
+	// Events are numbered from the end of the queue
+	assert.JSONEq(t, `{"result": 3}`, f.responses["req-2"])
+	assert.Equal(t, "Runtime.UnmarshalError", f.errors["req-1"].ErrorType)
+	assert.Equal(t, "Runtime.UnmarshalError", f.errTypes["req-1"])
+}
+
+func TestLambda_FunctionSelection(t *testing.T) {
+	app := newCgiTestApp()
+
+	f := runFakeLambda(t, app, "functions.addInts", `{"x": 4, "y": 5}`)
+	assert.JSONEq(t, `{"result": 9}`, f.responses["req-1"])
+
+	// With several functions, non-HTTP events need --function
+	f = runFakeLambda(t, app, "", `{"x": 4, "y": 5}`)
+	assert.Equal(t, "Runtime.InvalidHandler", f.errors["req-1"].ErrorType)
+}
+
+func TestLambda_UnknownFunction(t *testing.T) {
+	app := newCgiTestApp()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f, srv := newFakeLambdaRuntime(t, cancel)
+	err := app.runLambda(ctx, newLambdaRuntime(strings.TrimPrefix(srv.URL, "http://")), "Missing")
+	assert.Error(t, err)
+	require.NotNil(t, f.initErr)
+	assert.Equal(t, "Runtime.InvalidHandler", f.initErr.ErrorType)
+}
+
+func TestLambda_FunctionError(t *testing.T) {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	app.RegisterFunc(func(ctx context.Context) (string, error) {
+		return "", assert.AnError
+	}, "fails")
+
+	f := runFakeLambda(t, app, "", `{}`)
+	assert.Equal(t, lambdaError{ErrorMessage: assert.AnError.Error(), ErrorType: "Function.Error"}, f.errors["req-1"])
+}
+
+func TestLambda_Panic(t *testing.T) {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	app.RegisterFunc(func(ctx context.Context, fail bool) (string, error) {
+		if fail {
+			panic("unexpected")
+		}
+		return "ok", nil
+	}, "panics on demand", WithArgs("fail"))
+
+	// The runtime reports the panic and goes on with the next invocation
+	f := runFakeLambda(t, app, "", `{"fail": true}`, `{"fail": false}`)
+	assert.Equal(t, lambdaError{ErrorMessage: "panic: unexpected", ErrorType: "Runtime.Panic"}, f.errors["req-2"])
+	assert.Equal(t, "Runtime.Panic", f.errTypes["req-2"])
+	assert.JSONEq(t, `{"result": "ok"}`, f.responses["req-1"])
+}
+
+func TestLambda_BinaryResult(t *testing.T) {
+	readers := make(chan *closeTrackingReader, 1)
+	app := newReaderApp(readers)
+
+	f := runFakeLambda(t, app, "", `{}`)
+	assert.JSONEq(t, `{"result": `+readerResultJSON+`}`, f.responses["req-1"])
+	assert.True(t, (<-readers).closed.Load())
+}
+
+func TestLambda_HttpEvents(t *testing.T) {
+	app := newCgiTestApp()
+	app.RegisterFunc(renderChart, "renders a chart")
+	echoName := app.functions[1].Name
+
+	functionURL := `{
+		"version": "2.0",
+		"rawPath": "/functions/addInts",
+		"rawQueryString": "",
+		"headers": {"content-type": "application/json"},
+		"requestContext": {"http": {"method": "POST", "sourceIp": "192.0.2.1"}},
+		"body": "{\"x\": 2, \"y\": 3}",
+		"isBase64Encoded": false
+	}`
+	restAPI := `{
+		"httpMethod": "POST",
+		"path": "/` + echoName + `",
+		"queryStringParameters": {"q": "hello"},
+		"headers": {"User-Agent": "test-agent"},
+		"requestContext": {"identity": {"sourceIp": "192.0.2.2"}},
+		"body": "` + base64.StdEncoding.EncodeToString([]byte("{}")) + `",
+		"isBase64Encoded": true
+	}`
+	openapi := `{"version": "2.0", "rawPath": "/openapi.json", "requestContext": {"http": {"method": "GET"}}}`
+	notFound := `{"version": "2.0", "rawPath": "/functions/Missing", "requestContext": {"http": {"method": "POST"}}}`
+	binary := `{"version": "2.0", "rawPath": "/renderChart", "requestContext": {"http": {"method": "POST"}}}`
+
+	f := runFakeLambda(t, app, "", functionURL, restAPI, openapi, notFound, binary)
+
+	decode := func(id string) lambdaHttpResponse {
+		var resp lambdaHttpResponse
+		require.NoError(t, json.Unmarshal([]byte(f.responses[id]), &resp), f.responses[id])
+		return resp
+	}
+
+	resp := decode("req-5")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Headers["Content-Type"])
+	assert.JSONEq(t, `{"result": 5}`, resp.Body)
+
+	resp = decode("req-4")
+	require.Equal(t, http.StatusOK, resp.StatusCode, resp.Body)
+	var echoed map[string]map[string]any
+	require.NoError(t, json.Unmarshal([]byte(resp.Body), &echoed))
+	assert.Equal(t, "POST", echoed["result"]["method"])
+	assert.Equal(t, "/"+echoName, echoed["result"]["path"])
+	assert.Equal(t, "hello", echoed["result"]["query"])
+	assert.Equal(t, "test-agent", echoed["result"]["agent"])
+	assert.Equal(t, "192.0.2.2", echoed["result"]["remote"])
+
+	resp = decode("req-3")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Body, `"openapi":"3.0.0"`)
+
+	resp = decode("req-2")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = decode("req-1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Headers["Content-Type"])
+	assert.True(t, resp.IsBase64Encoded)
+	data, err := base64.StdEncoding.DecodeString(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x89, 'P', 'N', 'G'}, data)
+}
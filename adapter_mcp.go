@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"strings"
 
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 	"github.com/spf13/cobra"
@@ -14,80 +16,226 @@ func (a *App) buildMcpCmd() *cobra.Command {
 		Use:   "mcp",
 		Short: "Run as a Model Context Protocol (MCP) server",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			// Create MCP Server
-			s := mcp.NewServer(&mcp.Implementation{
-				Name:    a.config.Name,
-				Version: a.config.Version,
-			}, nil)
-
-			// Register Tools
-			for _, fn := range a.functions {
-				tool := mcp.Tool{
-					Name:        fn.OperationID(),
-					Description: fn.Description,
-					InputSchema: GenerateJSONSchema(fn.Meta),
-				}
-
-				// Capture closure variables
-				targetFn := fn
-
-				s.AddTool(&tool, func(ctx context.Context, req *mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-					// req.Params.Arguments is json.RawMessage
-					params := req.Params
-					var toolArgs map[string]any
-
-					// Handle nil or empty arguments
-					if len(params.Arguments) > 0 {
-				if err := json.Unmarshal(params.Arguments, &toolArgs); err != nil {
-						errJSON, _ := json.Marshal(buildErrorResponse(fmt.Sprintf("Invalid arguments format: %v", err)))
-						return &mcp.CallToolResult{
-							IsError: true,
-							Content: []mcp.Content{
-								&mcp.TextContent{Text: string(errJSON)},
-							},
-						}, nil
-					}
-					} else {
-						toolArgs = make(map[string]interface{})
-					}
-
-					// Create context with env
-					appCtx := a.ContextWithEnv(ctx)
-
-				results, err := CallFunction(appCtx, targetFn.Meta, toolArgs)
-				if err != nil {
-					errJSON, _ := json.Marshal(buildErrorResponse(err.Error()))
-					return &mcp.CallToolResult{
-						IsError: true,
-						Content: []mcp.Content{
-							&mcp.TextContent{Text: string(errJSON)},
-						},
-					}, nil
-				}
+			rootsFlag, _ := cmd.Flags().GetString("roots")
+			policy, err := parseRootsPolicy(rootsFlag)
+			if err != nil {
+				return err
+			}
 
-				response := buildSuccessResponse(results)
-				jsonBytes, marshalErr := json.Marshal(response)
-				if marshalErr != nil {
-					return &mcp.CallToolResult{
-						IsError: true,
-						Content: []mcp.Content{
-							&mcp.TextContent{Text: `{"error":"failed to marshal response"}`},
-						},
-					}, nil
-				}
-				return &mcp.CallToolResult{
-					Content: []mcp.Content{
-						&mcp.TextContent{Text: string(jsonBytes)},
-					},
-				}, nil
-				})
+			if err := a.setupEnvScope(cmd); err != nil {
+				return err
 			}
 
+			s := a.newMcpServer(policy)
+
 			// Serve StdIO
 			// Using StdioTransport
 			transport := &mcp.StdioTransport{}
 			return s.Run(cmd.Context(), transport)
 		},
 	}
+	cmd.Flags().String("roots", string(rootsReadOnly),
+		"Mount MCP client roots at "+rootsMountDir+"/<name>: rw (read-write), ro (read-only) or ignore")
+	addEnvScopeFlags(cmd)
+	cmd.AddCommand(a.buildMcpInstallCmd())
 	return cmd
 }
+
+// newMcpServer creates an MCP server exposing every registered function as a tool.
+// Unless policy is rootsIgnore, the roots advertised by each client are mounted
+// into the VirtualEnvironment of that client's session.
+func (a *App) newMcpServer(policy rootsPolicy) *mcp.Server {
+	var roots *mcpRoots
+	opts := &mcp.ServerOptions{}
+	if policy != rootsIgnore {
+		roots = newMcpRoots(policy)
+		opts.InitializedHandler = func(ctx context.Context, req *mcp.InitializedRequest) {
+			roots.invalidate(req.Session)
+		}
+		opts.RootsListChangedHandler = func(ctx context.Context, req *mcp.RootsListChangedRequest) {
+			roots.invalidate(req.Session)
+		}
+	}
+	if sessions := a.sessions; sessions != nil {
+		// Forget the environment of a session when it is closed
+		initialized := opts.InitializedHandler
+		opts.InitializedHandler = func(ctx context.Context, req *mcp.InitializedRequest) {
+			if initialized != nil {
+				initialized(ctx, req)
+			}
+			go func() {
+				req.Session.Wait()
+				sessions.end(req.Session)
+			}()
+		}
+	}
+
+	s := mcp.NewServer(&mcp.Implementation{
+		Name:    a.config.Name,
+		Version: a.config.Version,
+	}, opts)
+	if roots != nil {
+		roots.server = s
+	}
+
+	// Register Tools
+	for _, fn := range a.functions {
+		tool := mcp.Tool{
+			Name:        fn.OperationID(),
+			Description: fn.Description,
+			InputSchema: GenerateJSONSchema(fn.Meta),
+		}
+		s.AddTool(&tool, a.mcpToolHandler(fn, roots))
+	}
+
+	return s
+}
+
+// mcpToolHandler returns the MCP tool handler that invokes fn.
+// The request context is passed through to the function, so a
+// notifications/cancelled message from the client cancels the context
+// observed by the function. If roots is non-nil, the function sees the
+// session's VirtualEnvironment with the client roots mounted.
+func (a *App) mcpToolHandler(fn *RegisteredFunc, roots *mcpRoots) mcp.ToolHandler {
+	return func(ctx context.Context, req *mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		// req.Params.Arguments is json.RawMessage
+		params := req.Params
+		var toolArgs map[string]any
+
+		// Handle nil or empty arguments
+		if len(params.Arguments) > 0 {
+			if err := json.Unmarshal(params.Arguments, &toolArgs); err != nil {
+				return mcpErrorResult(fmt.Sprintf("Invalid arguments format: %v", err)), nil
+			}
+		} else {
+			toolArgs = make(map[string]interface{})
+		}
+
+		// Create context with env and the MCP call state. The environment
+		// is kept across the calls of the session with --env-scope session.
+		appCtx := ctx
+		base := a.env
+		if roots != nil {
+			if base == nil {
+				base = NewVirtualEnvironment(nil, nil)
+			}
+			base = roots.sessionEnv(ctx, req.Session, base)
+		}
+		if base != nil {
+			var key any
+			if req.Session != nil {
+				key = req.Session
+				if a.sessions != nil {
+					if err := a.sessions.start(key, base); err != nil {
+						return mcpErrorResult(err.Error()), nil
+					}
+				}
+			}
+			env, err := a.callEnv(base, key)
+			if err != nil {
+				return mcpErrorResult(err.Error()), nil
+			}
+			appCtx = WithVirtualEnv(ctx, env)
+		}
+		appCtx = withMcpCall(appCtx, &mcpCall{
+			session:       req.Session,
+			toolName:      params.Name,
+			progressToken: params.GetProgressToken(),
+		})
+
+		results, err := CallFunction(appCtx, fn.Meta, toolArgs)
+		if err != nil {
+			return mcpErrorResult(err.Error()), nil
+		}
+
+		if bin, ok := binaryResult(results); ok {
+			content, err := mcpBinaryContent(fn, bin)
+			if err != nil {
+				return mcpErrorResult(err.Error()), nil
+			}
+			return &mcp.CallToolResult{Content: []mcp.Content{content}}, nil
+		}
+
+		response := buildSuccessResponse(results)
+		jsonBytes, marshalErr := json.Marshal(response)
+		if marshalErr != nil {
+			return &mcp.CallToolResult{
+				IsError: true,
+				Content: []mcp.Content{
+					&mcp.TextContent{Text: `{"error":"failed to marshal response"}`},
+				},
+			}, nil
+		}
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{
+				&mcp.TextContent{Text: string(jsonBytes)},
+			},
+		}, nil
+	}
+}
+
+// mcpBinaryContent converts a binary function result into MCP content:
+// image and audio content for Image and Audio results, and an embedded
+// resource for Blob and io.Reader results.
+func mcpBinaryContent(fn *RegisteredFunc, bin *binaryValue) (mcp.Content, error) {
+	defer bin.Close()
+	data, err := io.ReadAll(bin.body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read result: %w", err)
+	}
+
+	switch bin.kind {
+	case binaryImage:
+		return &mcp.ImageContent{MIMEType: bin.mime, Data: data}, nil
+	case binaryAudio:
+		return &mcp.AudioContent{MIMEType: bin.mime, Data: data}, nil
+	}
+
+	resource := &mcp.ResourceContents{
+		URI:      "kuniumi://functions/" + fn.Name + "/result",
+		MIMEType: bin.mime,
+	}
+	if strings.HasPrefix(bin.mime, "text/") {
+		resource.Text = string(data)
+	} else {
+		resource.Blob = data
+	}
+	return &mcp.EmbeddedResource{Resource: resource}, nil
+}
+
+// mcpErrorResult builds a tool result carrying the standard JSON error response.
+func mcpErrorResult(msg string) *mcp.CallToolResult {
+	errJSON, _ := json.Marshal(buildErrorResponse(msg))
+	return &mcp.CallToolResult{
+		IsError: true,
+		Content: []mcp.Content{
+			&mcp.TextContent{Text: string(errJSON)},
+		},
+	}
+}
+
+// mcpCall carries the MCP session state of a single tool invocation.
+// It is attached to the function context by the mcp adapter and is absent
+// under every other adapter.
+type mcpCall struct {
+	session       *mcp.ServerSession
+	toolName      string
+	progressToken any
+}
+
+// mcpCallKey is the context key for mcpCall.
+type mcpCallKey struct{}
+
+// withMcpCall adds the MCP call state to the context.
+func withMcpCall(ctx context.Context, call *mcpCall) context.Context {
+	return context.WithValue(ctx, mcpCallKey{}, call)
+}
+
+// getMcpCall retrieves the MCP call state from the context.
+// It returns nil if the function is not running under the mcp adapter.
+func getMcpCall(ctx context.Context) *mcpCall {
+	if c, ok := ctx.Value(mcpCallKey{}).(*mcpCall); ok && c.session != nil {
+		return c
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package kuniumi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// mcpClient describes where and how an MCP client configures stdio servers.
+type mcpClient struct {
+	// configPath returns the path of the user-level config file.
+	configPath func() (string, error)
+	// serversKey is the key of the server entries in the config file.
+	serversKey string
+	// stdioType is the "type" of the entries, if the client expects one.
+	stdioType string
+}
+
+// mcpClients are the clients supported by mcp install.
+var mcpClients = map[string]mcpClient{
+	"claude-desktop": {
+		configPath: userConfigPath("Claude", "claude_desktop_config.json"),
+		serversKey: "mcpServers",
+	},
+	"claude-code": {
+		configPath: homePath(".claude.json"),
+		serversKey: "mcpServers",
+		stdioType:  "stdio",
+	},
+	"cursor": {
+		configPath: homePath(".cursor", "mcp.json"),
+		serversKey: "mcpServers",
+	},
+	"vscode": {
+		configPath: userConfigPath("Code", "User", "mcp.json"),
+		serversKey: "servers",
+		stdioType:  "stdio",
+	},
+	"windsurf": {
+		configPath: homePath(".codeium", "windsurf", "mcp_config.json"),
+		serversKey: "mcpServers",
+	},
+}
+
+// userConfigPath returns a path under the user config directory
+// (~/.config, ~/Library/Application Support or %AppData%).
+func userConfigPath(elem ...string) func() (string, error) {
+	return func() (string, error) {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(append([]string{dir}, elem...)...), nil
+	}
+}
+
+// homePath returns a path under the home directory.
+func homePath(elem ...string) func() (string, error) {
+	return func() (string, error) {
+		dir, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(append([]string{dir}, elem...)...), nil
+	}
+}
+
+func mcpClientNames() string {
+	names := make([]string, 0, len(mcpClients))
+	for name := range mcpClients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func (a *App) buildMcpInstallCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "install",
+		Short: "Register this application as an MCP server in an MCP client",
+		Long: `Add (or update) the entry of this application in the config file of an MCP
+client: ` + mcpClientNames() + `.
+
+The entry runs the absolute path of this binary in mcp mode, with the
+--env and --mount flags given to this command (host paths are made
+absolute). Other entries and settings of the config file are kept.
+
+  app --env API_KEY=xxx --mount ./data:/data mcp install --client claude-desktop`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			clientName, _ := cmd.Flags().GetString("client")
+			name, _ := cmd.Flags().GetString("name")
+			configPath, _ := cmd.Flags().GetString("config")
+			command, _ := cmd.Flags().GetString("command")
+			print, _ := cmd.Flags().GetBool("print")
+			envFlags, _ := cmd.Flags().GetStringSlice("env")
+			mountFlags, _ := cmd.Flags().GetStringArray("mount")
+
+			client, ok := mcpClients[clientName]
+			if !ok {
+				return fmt.Errorf("invalid client %q: must be one of %s", clientName, mcpClientNames())
+			}
+			if name == "" {
+				name = strings.ToLower(a.config.Name)
+			}
+			if command == "" {
+				var err error
+				if command, err = executablePath(); err != nil {
+					return err
+				}
+			}
+			serverArgs, err := mcpServerArgs(envFlags, mountFlags, a.filesystems)
+			if err != nil {
+				return err
+			}
+
+			entry := map[string]any{"command": command, "args": serverArgs}
+			if client.stdioType != "" {
+				entry["type"] = client.stdioType
+			}
+
+			if print {
+				data, err := marshalJSON(map[string]any{
+					client.serversKey: map[string]any{name: entry},
+				}, "")
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Fprintln(cmd.OutOrStdout(), string(data))
+				return err
+			}
+
+			if configPath == "" {
+				if configPath, err = client.configPath(); err != nil {
+					return err
+				}
+			}
+			updated, err := installMcpServer(configPath, client.serversKey, name, entry)
+			if err != nil {
+				return err
+			}
+			action := "Added"
+			if updated {
+				action = "Updated"
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s MCP server %q in %s\nRestart %s to load it.\n", action, name, configPath, clientName)
+			return nil
+		},
+	}
+	cmd.Flags().String("client", "", "MCP client: "+mcpClientNames())
+	cmd.Flags().String("name", "", "Server name in the client (defaults to the app name)")
+	cmd.Flags().String("config", "", "Config file to update (defaults to the user config file of the client)")
+	cmd.Flags().String("command", "", "Command the client runs (defaults to the absolute path of this binary)")
+	cmd.Flags().Bool("print", false, "Print the JSON entry instead of updating the config file")
+	cmd.MarkFlagRequired("client")
+	return cmd
+}
+
+// executablePath returns the absolute path of the running binary.
+func executablePath() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("cannot determine the binary path (use --command): %w", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+	return exe, nil
+}
+
+// mcpServerArgs returns the arguments running the app as an MCP server
+// with the given --env and --mount flags. Host paths of mounts are made
+// absolute, since clients start servers in an unspecified directory.
+// filesystems are the filesystems registered with WithFS.
+func mcpServerArgs(envFlags, mountFlags []string, filesystems map[string]fs.FS) ([]string, error) {
+	args := []string{"mcp"}
+	for _, e := range envFlags {
+		if key, _, _ := strings.Cut(e, "="); key == "" {
+			return nil, fmt.Errorf("invalid --env %q: expected KEY=VALUE or KEY", e)
+		}
+		args = append(args, "--env", e)
+	}
+	for _, m := range mountFlags {
+		virt, mount, err := parseMountSpec(m, filesystems)
+		if err != nil {
+			return nil, err
+		}
+		if mount.host == "" {
+			args = append(args, "--mount", mountSpec(mount.source, virt, mount))
+			continue
+		}
+		host, err := filepath.Abs(mount.host)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--mount", mountSpec(host, virt, mount))
+	}
+	return args, nil
+}
+
+// installMcpServer sets the server entry in the config file at path,
+// creating it if needed, and reports whether an entry was replaced. The
+// rest of the file is kept as is: other keys stay in place and their
+// values are copied byte for byte.
+func installMcpServer(path, serversKey, name string, entry map[string]any) (bool, error) {
+	var config jsonObject
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if len(strings.TrimSpace(string(data))) > 0 {
+			if config, err = decodeJSONObject(data); err != nil {
+				return false, fmt.Errorf("%s is not valid JSON (use --print and edit it by hand): %w", path, err)
+			}
+		}
+	case !os.IsNotExist(err):
+		return false, err
+	}
+
+	var servers jsonObject
+	if raw, ok := config.get(serversKey); ok && string(raw) != "null" {
+		if servers, err = decodeJSONObject(raw); err != nil {
+			return false, fmt.Errorf("%s: %q is not an object", path, serversKey)
+		}
+	}
+	value, err := marshalJSON(entry, "    ")
+	if err != nil {
+		return false, err
+	}
+	updated := servers.set(name, value)
+	config.set(serversKey, servers.indent("  "))
+	out := config.indent("")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	// Replace the file atomically, so that a failure does not corrupt it
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(out, '\n')); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if info, err := os.Stat(path); err == nil {
+		os.Chmod(tmp.Name(), info.Mode().Perm())
+	}
+	return updated, os.Rename(tmp.Name(), path)
+}
+
+// jsonObject is a JSON object whose members keep their order and the bytes
+// of their values, so that a config file can be edited without rewriting
+// the parts that do not change.
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	key   string
+	value json.RawMessage
+}
+
+// decodeJSONObject decodes data, which must hold a single JSON object.
+func decodeJSONObject(data []byte) (jsonObject, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('{') {
+		return nil, errors.New("not a JSON object")
+	}
+	var o jsonObject
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		o = append(o, jsonMember{key: tok.(string), value: value})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the JSON object")
+	}
+	return o, nil
+}
+
+// get returns the value of key.
+func (o jsonObject) get(key string) (json.RawMessage, bool) {
+	for _, m := range o {
+		if m.key == key {
+			return m.value, true
+		}
+	}
+	return nil, false
+}
+
+// set replaces the value of key, or adds key at the end, and reports
+// whether key was replaced.
+func (o *jsonObject) set(key string, value json.RawMessage) bool {
+	for i, m := range *o {
+		if m.key == key {
+			(*o)[i].value = value
+			return true
+		}
+	}
+	*o = append(*o, jsonMember{key: key, value: value})
+	return false
+}
+
+// indent encodes o with one member per line, indented by two spaces more
+// than prefix. Values are written as they are.
+func (o jsonObject) indent(prefix string) []byte {
+	if len(o) == 0 {
+		return []byte("{}")
+	}
+	var buf bytes.Buffer
+	buf.WriteString("{\n")
+	for i, m := range o {
+		key, _ := marshalJSON(m.key, "")
+		fmt.Fprintf(&buf, "%s  %s: %s", prefix, key, m.value)
+		if i < len(o)-1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('\n')
+	}
+	buf.WriteString(prefix + "}")
+	return buf.Bytes()
+}
+
+// marshalJSON encodes v indented by two spaces, with prefix before every
+// line but the first. Unlike json.MarshalIndent, it keeps <, > and & as
+// they are.
+func marshalJSON(v any, prefix string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent(prefix, "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
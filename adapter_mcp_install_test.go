@@ -0,0 +1,133 @@
+package kuniumi
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runMcpInstall runs "mcp install" with the given arguments, including the
+// global --env and --mount flags.
+func runMcpInstall(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	app := newCgiTestApp()
+	app.rootCmd.AddCommand(app.buildMcpCmd())
+	var out bytes.Buffer
+	app.rootCmd.SetOut(&out)
+	app.rootCmd.SetErr(&out)
+	app.rootCmd.SetArgs(args)
+	err := app.rootCmd.Execute()
+	return out.String(), err
+}
+
+func TestMcpInstallCmd_Print(t *testing.T) {
+	out, err := runMcpInstall(t,
+		"--env", "API_KEY=xxx", "--mount", "data:/data:ro,nodelete", "--mount", "mem:/scratch",
+		"mcp", "install", "--client", "vscode", "--print", "--command", "/usr/local/bin/app",
+	)
+	require.NoError(t, err)
+
+	abs, err := filepath.Abs("data")
+	require.NoError(t, err)
+	var snippet map[string]map[string]map[string]any
+	require.NoError(t, json.Unmarshal([]byte(out), &snippet))
+	assert.Equal(t, map[string]any{
+		"type":    "stdio",
+		"command": "/usr/local/bin/app",
+		"args":    []any{"mcp", "--env", "API_KEY=xxx", "--mount", abs + ":/data:ro,nodelete", "--mount", "mem:/scratch"},
+	}, snippet["servers"]["test"])
+}
+
+func TestMcpInstallCmd_Merge(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "Claude", "claude_desktop_config.json")
+
+	out, err := runMcpInstall(t, "mcp", "install", "--client", "claude-desktop", "--config", config, "--command", "/bin/app")
+	require.NoError(t, err)
+	assert.Contains(t, out, `Added MCP server "test"`)
+
+	// Other servers and settings are kept, the entry is replaced
+	require.NoError(t, os.WriteFile(config, []byte(`{
+  "globalShortcut": "Ctrl+Space",
+  "mcpServers": {
+    "other": {"command": "other"},
+    "test": {"command": "/old/app"}
+  }
+}`), 0600))
+	out, err = runMcpInstall(t, "mcp", "install", "--client", "claude-desktop", "--config", config, "--command", "/bin/app")
+	require.NoError(t, err)
+	assert.Contains(t, out, `Updated MCP server "test"`)
+
+	data, err := os.ReadFile(config)
+	require.NoError(t, err)
+	var got map[string]any
+	require.NoError(t, json.Unmarshal(data, &got))
+	assert.Equal(t, map[string]any{
+		"globalShortcut": "Ctrl+Space",
+		"mcpServers": map[string]any{
+			"other": map[string]any{"command": "other"},
+			"test":  map[string]any{"command": "/bin/app", "args": []any{"mcp"}},
+		},
+	}, got)
+	info, err := os.Stat(config)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "permissions are kept")
+}
+
+func TestMcpInstallCmd_KeepsOtherKeys(t *testing.T) {
+	config := filepath.Join(t.TempDir(), ".claude.json")
+	before := `{
+  "zeta": {"id": 12345678901234567890123, "ratio": 1.50, "at": 1e3},
+  "html": "<b>Tom & Jerry</b>",
+  "escaped": "caf\u00e9 \u003c",
+  "mcpServers": {
+    "other": {
+      "command": "other",
+      "args": ["a&b"]
+    }
+  },
+  "alpha": [1, 2.0, -0]
+}`
+	require.NoError(t, os.WriteFile(config, []byte(before), 0600))
+	_, err := runMcpInstall(t, "mcp", "install", "--client", "claude-code", "--config", config, "--command", "/bin/a&b")
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(config)
+	require.NoError(t, err)
+	assert.Equal(t, `{
+  "zeta": {"id": 12345678901234567890123, "ratio": 1.50, "at": 1e3},
+  "html": "<b>Tom & Jerry</b>",
+  "escaped": "caf\u00e9 \u003c",
+  "mcpServers": {
+    "other": {
+      "command": "other",
+      "args": ["a&b"]
+    },
+    "test": {
+      "args": [
+        "mcp"
+      ],
+      "command": "/bin/a&b",
+      "type": "stdio"
+    }
+  },
+  "alpha": [1, 2.0, -0]
+}
+`, string(data))
+}
+
+func TestMcpInstallCmd_Errors(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "mcp.json")
+	require.NoError(t, os.WriteFile(config, []byte("// comment\n{}"), 0644))
+
+	_, err := runMcpInstall(t, "mcp", "install", "--client", "zed", "--print")
+	assert.ErrorContains(t, err, "must be one of claude-code, claude-desktop, cursor, vscode, windsurf")
+	_, err = runMcpInstall(t, "--mount", "/data", "mcp", "install", "--client", "cursor", "--print")
+	assert.ErrorContains(t, err, "expected SOURCE:/VIRTUAL")
+	_, err = runMcpInstall(t, "mcp", "install", "--client", "cursor", "--config", config)
+	assert.ErrorContains(t, err, "not valid JSON")
+}
@@ -0,0 +1,134 @@
+package kuniumi
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectMcp starts the app's MCP server over an in-memory transport and
+// returns a connected client session.
+func connectMcp(t *testing.T, app *App, opts *mcp.ClientOptions) *mcp.ClientSession {
+	t.Helper()
+	return connectMcpWithRoots(t, app, rootsIgnore, opts)
+}
+
+// connectMcpWithRoots is like connectMcp, but mounts client roots using policy.
+func connectMcpWithRoots(t *testing.T, app *App, policy rootsPolicy, opts *mcp.ClientOptions) *mcp.ClientSession {
+	t.Helper()
+	ctx := context.Background()
+
+	serverTransport, clientTransport := mcp.NewInMemoryTransports()
+	serverSession, err := app.newMcpServer(policy).Connect(ctx, serverTransport, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { serverSession.Close() })
+
+	client := mcp.NewClient(&mcp.Implementation{Name: "test-client", Version: "1.0.0"}, opts)
+	session, err := client.Connect(ctx, clientTransport, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { session.Close() })
+	return session
+}
+
+func TestMcpProgress(t *testing.T) {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	app.RegisterFunc(func(ctx context.Context, n int) (int, error) {
+		for i := 1; i <= n; i++ {
+			if err := ReportProgress(ctx, float64(i), float64(n), "step"); err != nil {
+				return 0, err
+			}
+		}
+		return n, nil
+	}, "counts", WithParams(Param("n", "steps")))
+
+	var mu sync.Mutex
+	var progress []float64
+	session := connectMcp(t, app, &mcp.ClientOptions{
+		ProgressNotificationHandler: func(ctx context.Context, req *mcp.ProgressNotificationClientRequest) {
+			mu.Lock()
+			defer mu.Unlock()
+			progress = append(progress, req.Params.Progress)
+		},
+	})
+
+	fnName := app.functions[0].OperationID()
+
+	t.Run("with progress token", func(t *testing.T) {
+		params := &mcp.CallToolParams{
+			Meta:      mcp.Meta{"progressToken": "tok"},
+			Name:      fnName,
+			Arguments: map[string]any{"n": 3},
+		}
+		result, err := session.CallTool(context.Background(), params)
+		require.NoError(t, err)
+		require.False(t, result.IsError)
+
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(progress) == 3
+		}, time.Second, 10*time.Millisecond)
+		mu.Lock()
+		assert.Equal(t, []float64{1, 2, 3}, progress)
+		progress = nil
+		mu.Unlock()
+	})
+
+	t.Run("without progress token", func(t *testing.T) {
+		result, err := session.CallTool(context.Background(), &mcp.CallToolParams{
+			Name:      fnName,
+			Arguments: map[string]any{"n": 3},
+		})
+		require.NoError(t, err)
+		require.False(t, result.IsError)
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Empty(t, progress)
+	})
+}
+
+func TestMcpCancellation(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	app.RegisterFunc(func(ctx context.Context) (string, error) {
+		close(started)
+		select {
+		case <-ctx.Done():
+			cancelled <- ctx.Err()
+			return "", ctx.Err()
+		case <-time.After(5 * time.Second):
+			cancelled <- nil
+			return "finished", nil
+		}
+	}, "blocks until cancelled")
+
+	session := connectMcp(t, app, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err := session.CallTool(ctx, &mcp.CallToolParams{Name: app.functions[0].OperationID()})
+	require.Error(t, err)
+
+	select {
+	case err := <-cancelled:
+		assert.ErrorIs(t, err, context.Canceled, "function context should be cancelled")
+	case <-time.After(3 * time.Second):
+		t.Fatal("cancellation did not reach the function")
+	}
+}
+
+func TestReportProgress_NoMcp(t *testing.T) {
+	// Outside the mcp adapter ReportProgress is a no-op.
+	assert.NoError(t, ReportProgress(context.Background(), 1, 2, "ignored"))
+}
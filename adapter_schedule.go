@@ -0,0 +1,360 @@
+package kuniumi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+)
+
+// Overlap policies of scheduled jobs, applied when a run is due while the
+// previous run of the same job is still in progress.
+const (
+	overlapSkip  = "skip"  // drop the new run
+	overlapQueue = "queue" // start the new run when the previous one finishes
+	overlapAllow = "allow" // start the new run immediately
+)
+
+func (a *App) buildScheduleCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "schedule",
+		Short: "Call functions on cron schedules",
+		Long: `Call functions on cron schedules defined in a YAML file:
+
+  timezone: Asia/Tokyo     # optional, defaults to the local time zone
+  jobs:
+    - name: nightly-report
+      cron: "0 3 * * *"    # minute hour day-of-month month day-of-week, or @daily etc.
+      function: Report     # function name or operation ID
+      args: {format: pdf}
+      overlap: skip        # skip (default), queue or allow
+      jitter: 30s          # random delay added to each run
+
+Functions run in the VirtualEnvironment built from --env and --mount. With
+--history, one JSON record per run is written to that virtual directory
+(e.g. a mounted directory).`,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			file, _ := cmd.Flags().GetString("file")
+			history, _ := cmd.Flags().GetString("history")
+
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			jobs, err := a.parseScheduleFile(data)
+			if err != nil {
+				return fmt.Errorf("%s: %w", file, err)
+			}
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			s := &scheduler{
+				app:        a,
+				jobs:       jobs,
+				historyDir: history,
+				clock:      realClock{},
+			}
+			return s.run(ctx)
+		},
+	}
+	cmd.Flags().StringP("file", "f", "schedule.yaml", "Schedule file")
+	cmd.Flags().String("history", "", "Virtual directory receiving one JSON record per run (e.g. a mounted directory)")
+	return cmd
+}
+
+// scheduleFile is the format of the schedule file.
+type scheduleFile struct {
+	Timezone string            `yaml:"timezone"`
+	Jobs     []scheduleJobSpec `yaml:"jobs"`
+}
+
+type scheduleJobSpec struct {
+	Name     string         `yaml:"name"`
+	Cron     string         `yaml:"cron"`
+	Function string         `yaml:"function"`
+	Args     map[string]any `yaml:"args"`
+	Overlap  string         `yaml:"overlap"`
+	Jitter   string         `yaml:"jitter"`
+}
+
+// scheduledJob is a validated job of the schedule file.
+type scheduledJob struct {
+	name     string
+	schedule *cronSchedule
+	fn       *RegisteredFunc
+	args     map[string]any
+	overlap  string
+	jitter   time.Duration
+
+	// running holds a token while a run is in progress (skip and queue policies).
+	running chan struct{}
+}
+
+// parseScheduleFile parses and validates a schedule file.
+func (a *App) parseScheduleFile(data []byte) ([]*scheduledJob, error) {
+	var file scheduleFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	loc := time.Local
+	if file.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(file.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid timezone: %w", err)
+		}
+	}
+
+	if len(file.Jobs) == 0 {
+		return nil, fmt.Errorf("no jobs defined")
+	}
+	names := map[string]bool{}
+	var jobs []*scheduledJob
+	for i, spec := range file.Jobs {
+		if spec.Name == "" {
+			spec.Name = fmt.Sprintf("job%d", i+1)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("duplicate job name %q", spec.Name)
+		}
+		names[spec.Name] = true
+
+		job := &scheduledJob{
+			name:    spec.Name,
+			args:    spec.Args,
+			overlap: spec.Overlap,
+			running: make(chan struct{}, 1),
+		}
+		var err error
+		if job.schedule, err = parseCron(spec.Cron, loc); err != nil {
+			return nil, fmt.Errorf("job %q: %w", spec.Name, err)
+		}
+		if job.fn = a.findFunction(spec.Function); job.fn == nil {
+			return nil, fmt.Errorf("job %q: function not found: %s", spec.Name, spec.Function)
+		}
+		switch job.overlap {
+		case "":
+			job.overlap = overlapSkip
+		case overlapSkip, overlapQueue, overlapAllow:
+		default:
+			return nil, fmt.Errorf("job %q: invalid overlap policy %q: must be skip, queue or allow", spec.Name, spec.Overlap)
+		}
+		if spec.Jitter != "" {
+			if job.jitter, err = time.ParseDuration(spec.Jitter); err != nil || job.jitter < 0 {
+				return nil, fmt.Errorf("job %q: invalid jitter %q", spec.Name, spec.Jitter)
+			}
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// clock abstracts time for the scheduler.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// scheduler runs scheduled jobs until its context is done.
+type scheduler struct {
+	app        *App
+	jobs       []*scheduledJob
+	historyDir string
+	clock      clock
+	// ran is called after each run, for tests.
+	ran func(scheduleRun)
+
+	wg sync.WaitGroup
+}
+
+// scheduleRun is the history record of a run.
+type scheduleRun struct {
+	Job       string         `json:"job"`
+	Function  string         `json:"function"`
+	Args      map[string]any `json:"args,omitempty"`
+	Scheduled time.Time      `json:"scheduled"`
+	Started   time.Time      `json:"started"`
+	Finished  time.Time      `json:"finished"`
+	// Status is "ok", "error" or "skipped".
+	Status string         `json:"status"`
+	Result map[string]any `json:"result,omitempty"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// run starts the jobs and blocks until ctx is done and the runs in progress
+// have finished.
+func (s *scheduler) run(ctx context.Context) error {
+	logger := Logger(ctx)
+	for _, job := range s.jobs {
+		logger.Info("Scheduled job", "job", job.name, "function", job.fn.Name,
+			"overlap", job.overlap, "next", job.schedule.Next(s.clock.Now()))
+	}
+
+	var loops sync.WaitGroup
+	for _, job := range s.jobs {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			s.loop(ctx, job)
+		}()
+	}
+	loops.Wait()
+	s.wg.Wait()
+	return nil
+}
+
+// loop waits for each activation of job and dispatches it. Activations
+// follow the previous one rather than the clock, so that a clock read
+// before the activation (or set back) does not dispatch it again, and a
+// jitter longer than the interval does not drop activations. Activations
+// missed by more than the jitter (e.g. while the machine was suspended)
+// are skipped.
+func (s *scheduler) loop(ctx context.Context, job *scheduledJob) {
+	logger := Logger(ctx).With("job", job.name)
+	prev := s.clock.Now()
+	for {
+		next := job.schedule.Next(prev)
+		now := s.clock.Now()
+		if !next.IsZero() && next.Add(job.jitter).Before(now) {
+			missed := next
+			next = job.schedule.Next(now.Add(-job.jitter))
+			logger.Warn("Skipped missed activations", "from", missed, "next", next)
+		}
+		if next.IsZero() {
+			logger.Warn("Job will never run again")
+			return
+		}
+		delay := next.Sub(now)
+		if job.jitter > 0 {
+			delay += rand.N(job.jitter)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.clock.After(max(delay, 0)):
+		}
+		s.dispatch(ctx, job, next)
+		prev = next
+	}
+}
+
+// dispatch starts a run of job according to its overlap policy.
+func (s *scheduler) dispatch(ctx context.Context, job *scheduledJob, scheduled time.Time) {
+	switch job.overlap {
+	case overlapAllow:
+		s.start(func() { s.execute(ctx, job, scheduled) })
+	case overlapQueue:
+		s.start(func() {
+			select {
+			case job.running <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-job.running }()
+			s.execute(ctx, job, scheduled)
+		})
+	default:
+		select {
+		case job.running <- struct{}{}:
+			s.start(func() {
+				defer func() { <-job.running }()
+				s.execute(ctx, job, scheduled)
+			})
+		default:
+			now := s.clock.Now()
+			Logger(ctx).Warn("Skipped job: previous run still in progress", "job", job.name, "scheduled", scheduled)
+			s.record(ctx, scheduleRun{
+				Job: job.name, Function: job.fn.Name, Args: job.args,
+				Scheduled: scheduled, Started: now, Finished: now, Status: "skipped",
+			})
+		}
+	}
+}
+
+func (s *scheduler) start(f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+// execute calls the function of job and records the run.
+// Runs in progress are not cancelled on shutdown; the scheduler waits for them.
+func (s *scheduler) execute(ctx context.Context, job *scheduledJob, scheduled time.Time) {
+	runCtx := s.app.ContextWithEnv(context.WithoutCancel(ctx))
+	logger := Logger(runCtx).With("job", job.name, "function", job.fn.Name)
+
+	run := scheduleRun{
+		Job: job.name, Function: job.fn.Name, Args: job.args,
+		Scheduled: scheduled, Started: s.clock.Now(),
+	}
+	logger.Info("Job started", "scheduled", scheduled)
+	results, err := CallFunction(runCtx, job.fn.Meta, job.args)
+	if err == nil {
+		results, err = jsonResults(results)
+	}
+	run.Finished = s.clock.Now()
+
+	if err != nil {
+		run.Status = "error"
+		run.Error = err.Error()
+		logger.Error("Job failed", "error", err, "duration", run.Finished.Sub(run.Started))
+	} else {
+		run.Status = "ok"
+		run.Result = buildSuccessResponse(results)
+		logger.Info("Job finished", "duration", run.Finished.Sub(run.Started))
+	}
+	s.record(runCtx, run)
+}
+
+// record writes the history record of a run to the history directory.
+func (s *scheduler) record(ctx context.Context, run scheduleRun) {
+	if s.ran != nil {
+		defer s.ran(run)
+	}
+	if s.historyDir == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err == nil {
+		env := s.app.env
+		if env == nil {
+			env = NewVirtualEnvironment(nil, nil)
+		}
+		name := fmt.Sprintf("%s-%s.json", run.Started.UTC().Format("20060102T150405.000000000Z"), sanitizeJobName(run.Job))
+		err = env.WriteFile(path.Join(s.historyDir, name), data)
+	}
+	if err != nil {
+		Logger(ctx).Error("Failed to write run history", "job", run.Job, "error", err)
+	}
+}
+
+// sanitizeJobName makes a job name safe for use in a file name.
+func sanitizeJobName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,309 @@
+package kuniumi
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock whose timers advance the time (by drift more than
+// they wait for) and fire as soon as a token is available on gate.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	drift time.Duration
+	gate  chan struct{}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d + c.drift)
+	ch := make(chan time.Time, 1)
+	go func(now time.Time) {
+		<-c.gate
+		ch <- now
+	}(c.now)
+	return ch
+}
+
+func TestParseScheduleFile(t *testing.T) {
+	app := newBatchTestApp()
+
+	jobs, err := app.parseScheduleFile([]byte(`
+timezone: UTC
+jobs:
+  - name: add
+    cron: "*/5 * * * *"
+    function: functions.addInts
+    args: {x: 1, y: 2}
+    overlap: queue
+    jitter: 10s
+  - cron: "@daily"
+    function: sleepMs
+`))
+	require.NoError(t, err)
+	require.Len(t, jobs, 2)
+	assert.Equal(t, "add", jobs[0].name)
+	assert.Equal(t, "addInts", jobs[0].fn.Name)
+	assert.Equal(t, map[string]any{"x": 1, "y": 2}, jobs[0].args)
+	assert.Equal(t, overlapQueue, jobs[0].overlap)
+	assert.Equal(t, 10*time.Second, jobs[0].jitter)
+	assert.Equal(t, "job2", jobs[1].name)
+	assert.Equal(t, overlapSkip, jobs[1].overlap, "skip is the default policy")
+
+	for name, file := range map[string]string{
+		"no jobs":          `jobs: []`,
+		"bad cron":         `jobs: [{cron: "* *", function: addInts}]`,
+		"unknown function": `jobs: [{cron: "* * * * *", function: Missing}]`,
+		"bad overlap":      `jobs: [{cron: "* * * * *", function: addInts, overlap: sometimes}]`,
+		"bad jitter":       `jobs: [{cron: "* * * * *", function: addInts, jitter: soon}]`,
+		"duplicate names":  `jobs: [{name: a, cron: "* * * * *", function: addInts}, {name: a, cron: "* * * * *", function: addInts}]`,
+		"bad timezone":     "timezone: Nowhere/Nothing\njobs: [{cron: \"* * * * *\", function: addInts}]",
+	} {
+		_, err := app.parseScheduleFile([]byte(file))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestScheduler_RunsAndHistory(t *testing.T) {
+	app := newBatchTestApp()
+	historyDir := t.TempDir()
+	app.env = NewVirtualEnvironment(nil, map[string]string{historyDir: "/history"})
+
+	jobs, err := app.parseScheduleFile([]byte(`
+jobs:
+  - name: every minute
+    cron: "* * * * *"
+    function: addInts
+    args: {x: 2, y: 3}
+`))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Fire the next timer only once the previous run is recorded
+	gate := make(chan struct{}, 1)
+	gate <- struct{}{}
+	var mu sync.Mutex
+	var runs []scheduleRun
+	s := &scheduler{
+		app:        app,
+		jobs:       jobs,
+		historyDir: "/history",
+		clock:      &fakeClock{now: time.Date(2026, 1, 15, 10, 30, 15, 0, time.UTC), gate: gate},
+		ran: func(run scheduleRun) {
+			mu.Lock()
+			defer mu.Unlock()
+			if runs = append(runs, run); len(runs) == 3 {
+				cancel()
+				return
+			}
+			gate <- struct{}{}
+		},
+	}
+	require.NoError(t, s.run(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, runs, 3)
+	assert.Equal(t, time.Date(2026, 1, 15, 10, 31, 0, 0, time.UTC), runs[0].Scheduled.UTC())
+	assert.Equal(t, time.Date(2026, 1, 15, 10, 32, 0, 0, time.UTC), runs[1].Scheduled.UTC())
+	assert.Equal(t, "ok", runs[0].Status)
+	assert.Equal(t, map[string]any{"result": 5}, runs[0].Result)
+
+	entries, err := os.ReadDir(historyDir)
+	require.NoError(t, err)
+	require.Len(t, entries, len(runs))
+	assert.Contains(t, entries[0].Name(), "every_minute")
+
+	data, err := os.ReadFile(filepath.Join(historyDir, entries[0].Name()))
+	require.NoError(t, err)
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(data, &record))
+	assert.Equal(t, "every minute", record["job"])
+	assert.Equal(t, "addInts", record["function"])
+	assert.Equal(t, "ok", record["status"])
+	assert.Equal(t, map[string]any{"result": float64(5)}, record["result"])
+}
+
+func TestScheduler_BinaryResult(t *testing.T) {
+	readers := make(chan *closeTrackingReader, 1)
+	app := newReaderApp(readers)
+	jobs, err := app.parseScheduleFile([]byte(`jobs: [{name: export, cron: "* * * * *", function: ` + app.functions[0].Name + `}]`))
+	require.NoError(t, err)
+
+	var run scheduleRun
+	s := &scheduler{app: app, jobs: jobs, clock: realClock{}, ran: func(r scheduleRun) { run = r }}
+	s.dispatch(context.Background(), jobs[0], time.Now())
+	s.wg.Wait()
+
+	assert.Equal(t, "ok", run.Status)
+	data, err := json.Marshal(run.Result)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"result": `+readerResultJSON+`}`, string(data))
+	assert.True(t, (<-readers).closed.Load())
+}
+
+// runScheduledJob runs the job of the schedule file with clock until it has
+// run n times, and returns the runs.
+func runScheduledJob(t *testing.T, file string, clock *fakeClock, n int) []scheduleRun {
+	t.Helper()
+	app := newBatchTestApp()
+	jobs, err := app.parseScheduleFile([]byte(file))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clock.gate = make(chan struct{}, 1)
+	clock.gate <- struct{}{}
+	var mu sync.Mutex
+	var runs []scheduleRun
+	s := &scheduler{
+		app:   app,
+		jobs:  jobs,
+		clock: clock,
+		ran: func(run scheduleRun) {
+			mu.Lock()
+			defer mu.Unlock()
+			if runs = append(runs, run); len(runs) == n {
+				cancel()
+				return
+			}
+			clock.gate <- struct{}{}
+		},
+	}
+	require.NoError(t, s.run(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, runs, n)
+	return runs
+}
+
+func TestScheduler_Activations(t *testing.T) {
+	start := time.Date(2026, 1, 15, 10, 30, 15, 0, time.UTC)
+	minute := func(m int) time.Time { return time.Date(2026, 1, 15, 10, m, 0, 0, time.UTC) }
+	scheduled := func(runs []scheduleRun) []time.Time {
+		var times []time.Time
+		for _, run := range runs {
+			times = append(times, run.Scheduled.UTC())
+		}
+		return times
+	}
+	const everyMinute = `jobs: [{name: add, cron: "* * * * *", function: addInts}]`
+
+	t.Run("clock behind the timer", func(t *testing.T) {
+		// The clock reads one second before the activation when the timer fires
+		runs := runScheduledJob(t, everyMinute, &fakeClock{now: start, drift: -time.Second}, 3)
+		assert.Equal(t, []time.Time{minute(31), minute(32), minute(33)}, scheduled(runs))
+	})
+
+	t.Run("jitter longer than the interval", func(t *testing.T) {
+		file := `jobs: [{name: add, cron: "* * * * *", function: addInts, jitter: 3m}]`
+		runs := runScheduledJob(t, file, &fakeClock{now: start}, 4)
+		assert.Equal(t, []time.Time{minute(31), minute(32), minute(33), minute(34)}, scheduled(runs))
+	})
+
+	t.Run("missed activations", func(t *testing.T) {
+		// Each timer fires ten minutes late, as after a suspend
+		runs := runScheduledJob(t, everyMinute, &fakeClock{now: start, drift: 10 * time.Minute}, 3)
+		assert.Equal(t, []time.Time{minute(31), minute(42), minute(53)}, scheduled(runs))
+	})
+}
+
+// newBlockingScheduleJob returns a job whose runs block until release is closed.
+func newBlockingScheduleJob(t *testing.T, overlap string) (*scheduler, *scheduledJob, chan struct{}, chan struct{}) {
+	t.Helper()
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	app.RegisterFunc(func(ctx context.Context) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}, "blocks")
+
+	jobs, err := app.parseScheduleFile([]byte(`jobs: [{name: block, cron: "* * * * *", function: ` +
+		app.functions[0].Name + `, overlap: ` + overlap + `}]`))
+	require.NoError(t, err)
+	s := &scheduler{app: app, jobs: jobs, clock: realClock{}}
+	return s, jobs[0], started, release
+}
+
+func waitStarted(t *testing.T, started chan struct{}) {
+	t.Helper()
+	select {
+	case <-started:
+	case <-time.After(3 * time.Second):
+		t.Fatal("run did not start")
+	}
+}
+
+func assertNotStarted(t *testing.T, started chan struct{}) {
+	t.Helper()
+	select {
+	case <-started:
+		t.Fatal("run started while the previous run was in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestScheduler_Overlap(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("skip", func(t *testing.T) {
+		s, job, started, release := newBlockingScheduleJob(t, overlapSkip)
+		var skipped []scheduleRun
+		s.ran = func(run scheduleRun) {
+			if run.Status == "skipped" {
+				skipped = append(skipped, run)
+			}
+		}
+
+		s.dispatch(ctx, job, time.Now())
+		waitStarted(t, started)
+		s.dispatch(ctx, job, time.Now())
+		assertNotStarted(t, started)
+		close(release)
+		s.wg.Wait()
+
+		assert.Len(t, skipped, 1)
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		s, job, started, release := newBlockingScheduleJob(t, overlapQueue)
+
+		s.dispatch(ctx, job, time.Now())
+		waitStarted(t, started)
+		s.dispatch(ctx, job, time.Now())
+		assertNotStarted(t, started)
+		close(release)
+		waitStarted(t, started)
+		s.wg.Wait()
+	})
+
+	t.Run("allow", func(t *testing.T) {
+		s, job, started, release := newBlockingScheduleJob(t, overlapAllow)
+
+		s.dispatch(ctx, job, time.Now())
+		s.dispatch(ctx, job, time.Now())
+		waitStarted(t, started)
+		waitStarted(t, started)
+		close(release)
+		s.wg.Wait()
+	})
+}
@@ -3,6 +3,8 @@ package kuniumi
 import (
 	"context"
 	"fmt"
+	"io/fs"
+	"os"
 	"reflect"
 	"runtime"
 	"strings"
@@ -22,6 +24,15 @@ type App struct {
 	functions []*RegisteredFunc
 	rootCmd   *cobra.Command
 	env       *VirtualEnvironment
+
+	// filesystems are the filesystems registered with WithFS, mountable
+	// with --mount embed:NAME:/virt or overlay:NAME:/virt.
+	filesystems map[string]fs.FS
+
+	// sessions keeps the environments of sessions with --env-scope session,
+	// identified by sessionHeader in HTTP requests. It is nil otherwise.
+	sessions      *envSessions
+	sessionHeader string
 }
 
 // RegisteredFunc holds metadata about a registered function.
@@ -101,8 +112,8 @@ func New(cfg Config, opts ...Option) *App {
 	}
 
 	// Setup Global Flags
-	app.rootCmd.PersistentFlags().StringSlice("env", []string{}, "Environment variables (KEY=VALUE)")
-	app.rootCmd.PersistentFlags().StringSlice("mount", []string{}, "Mount directories (HOST:VIRTUAL)")
+	app.rootCmd.PersistentFlags().StringSlice("env", []string{}, "Environment variables (KEY=VALUE, or KEY to take the value of the process environment)")
+	app.rootCmd.PersistentFlags().StringArray("mount", []string{}, "Mount a filesystem (SOURCE:/VIRTUAL[:ro,noexec,nodelete]); repeat for several")
 
 	viper.BindPFlag("env", app.rootCmd.PersistentFlags().Lookup("env"))
 	viper.BindPFlag("mount", app.rootCmd.PersistentFlags().Lookup("mount"))
@@ -183,62 +194,101 @@ func (a *App) RegisterFunc(fn interface{}, desc string, opts ...FuncOption) {
 //
 // Capabilities:
 //   - **serve**: Starts a clear Web API server.
-//   - **mcp**: Runs as a Model Context Protocol server (stdio).
+//   - **healthcheck**: Probes a local serve process (the HEALTHCHECK of containerized images).
+//   - **mcp**: Runs as a Model Context Protocol server (stdio); `mcp install` registers it in MCP clients.
 //   - **cgi**: Executes a single function in CGI mode (useful for serverless/hooks).
+//   - **fcgi**: Serves the functions over FastCGI (TCP port or Unix socket).
+//   - **jsonrpc**: Runs as a JSON-RPC 2.0 server (stdio or HTTP).
+//   - **lambda**: Runs as an AWS Lambda custom runtime (Runtime API loop).
+//   - **batch**: Calls functions for each record of a JSONL file.
+//   - **schedule**: Calls functions on cron schedules.
+//   - **call**: Calls a function from the command line (`app call Add --x 1 --y 2`).
 //   - **containerize**: (Experimental) Helps package the app.
+//   - **deploy-manifests**: Generates Kubernetes or docker-compose manifests.
+//   - **inspect-image**: Shows the functions packaged in a container image tarball.
 //
 // It also parses global flags like `--env` and `--mount` to initialize the Virtual Environment.
+// `--mount` accepts host directories (`HOST:/virt`) as well as in-memory (`mem:/virt`),
+// embedded (`embed:/virt`, see WithFS) and copy-on-write (`overlay:/virt`) filesystems.
 func (a *App) Run() error {
 	// Initialize Virtual Environment from flags
-	a.rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
-		envKV := make(map[string]string)
-		mounts := make(map[string]string)
-
-		// Parse --env
+	a.rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
 		envFlags, _ := cmd.Flags().GetStringSlice("env")
-		for _, e := range envFlags {
-			parts := strings.SplitN(e, "=", 2)
-			if len(parts) == 2 {
-				envKV[parts[0]] = parts[1]
-			}
-		}
+		env := NewVirtualEnvironment(parseEnvFlags(envFlags), nil)
 
-		// Parse --mount
-		mountFlags, _ := cmd.Flags().GetStringSlice("mount")
+		// Parse --mount (HOST:/virt, mem:/virt, embed:/virt, ...)
+		mountFlags, _ := cmd.Flags().GetStringArray("mount")
 		for _, m := range mountFlags {
-			// Handle Windows paths (C:\foo:/bar)
-			// Split by LAST colon to separate Host and Virtual path,
-			// usually Virtual path starts with / and is on the right.
-			lastColon := strings.LastIndex(m, ":")
-			if lastColon > 0 {
-				hostPath := m[:lastColon]
-				virtualPath := m[lastColon+1:]
-				mounts[hostPath] = virtualPath
-			} else {
-				// Fallback or error? For now fallback to simple split if only one colon found by LastIndex
-				// If LastIndex == -1, no colon.
+			virtualPath, mount, err := parseMountSpec(m, a.filesystems)
+			if err != nil {
+				return err
 			}
+			env.mount(virtualPath, mount)
 		}
 
-		a.env = NewVirtualEnvironment(envKV, mounts)
+		a.env = env
+		return nil
+	}
+	a.rootCmd.PersistentPostRunE = func(cmd *cobra.Command, args []string) error {
+		return a.env.Close()
 	}
 
 	// Add subcommands
 	a.rootCmd.AddCommand(a.buildServeCmd())
+	a.rootCmd.AddCommand(a.buildHealthcheckCmd())
 	a.rootCmd.AddCommand(a.buildCgiCmd())
+	a.rootCmd.AddCommand(a.buildFcgiCmd())
+	a.rootCmd.AddCommand(a.buildJsonrpcCmd())
+	a.rootCmd.AddCommand(a.buildLambdaCmd())
+	a.rootCmd.AddCommand(a.buildCallCmd())
+	a.rootCmd.AddCommand(a.buildBatchCmd())
+	a.rootCmd.AddCommand(a.buildScheduleCmd())
 	a.rootCmd.AddCommand(a.buildMcpCmd())
 	a.rootCmd.AddCommand(a.buildContainerizeCmd())
+	a.rootCmd.AddCommand(a.buildDeployManifestsCmd())
+	a.rootCmd.AddCommand(a.buildInspectImageCmd())
 
 	return a.rootCmd.Execute()
 }
 
+// parseEnvFlags returns the variables of the --env flags. KEY=VALUE sets
+// VALUE; KEY alone takes the value of KEY in the process environment, if
+// set, so that secrets need not appear in the command line.
+func parseEnvFlags(envFlags []string) map[string]string {
+	envKV := make(map[string]string)
+	for _, e := range envFlags {
+		key, value, ok := strings.Cut(e, "=")
+		if !ok {
+			if value, ok = os.LookupEnv(key); !ok {
+				continue
+			}
+		}
+		envKV[key] = value
+	}
+	return envKV
+}
+
+// findFunction returns the registered function with the given name or
+// operation ID (e.g. "Add" or "functions.Add"), or nil if there is none.
+func (a *App) findFunction(name string) *RegisteredFunc {
+	for _, fn := range a.functions {
+		if fn.Name == name || fn.OperationID() == name {
+			return fn
+		}
+	}
+	return nil
+}
+
 // ContextWithEnv returns a new context with the application's VirtualEnvironment attached.
 // This context should be passed to handler functions so they can access the environment
 // via `kuniumi.GetVirtualEnv(ctx)`.
+//
+// Every context gets its own clone of the environment (see VirtualEnvironment.Clone),
+// so that ChangeCurrentDirectory in one call does not affect concurrent calls.
 func (a *App) ContextWithEnv(ctx context.Context) context.Context {
 	if a.env == nil {
 		// Should not happen if PreRun executed, but for safety
 		return ctx
 	}
-	return WithVirtualEnv(ctx, a.env)
+	return WithVirtualEnv(ctx, a.env.Clone())
 }
@@ -0,0 +1,17 @@
+package kuniumi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEnvFlags(t *testing.T) {
+	t.Setenv("KUNIUMI_TEST_SECRET", "s3cret")
+	assert.Equal(t, map[string]string{
+		"LOG_LEVEL":           "debug",
+		"EMPTY":               "",
+		"URL":                 "a=b",
+		"KUNIUMI_TEST_SECRET": "s3cret",
+	}, parseEnvFlags([]string{"LOG_LEVEL=debug", "EMPTY=", "URL=a=b", "KUNIUMI_TEST_SECRET", "KUNIUMI_TEST_UNSET"}))
+}
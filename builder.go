@@ -0,0 +1,249 @@
+package kuniumi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// imageBuilder builds and pushes the container image of the app.
+type imageBuilder interface {
+	// Build builds the image described by req.
+	Build(ctx context.Context, req *buildRequest) error
+	// Push pushes the image built by Build to its registry.
+	Push(ctx context.Context, req *buildRequest) error
+}
+
+// buildRequest describes an image build of the containerize command.
+type buildRequest struct {
+	// Image is the image reference (e.g. registry.example.com/app:1.0).
+	Image string
+	// Dockerfile is the content of the generated Dockerfile.
+	Dockerfile string
+	// Context is the build context directory.
+	Context string
+	// BuildArgs are KEY=VALUE (or KEY, taken from the environment) build
+	// arguments, declared as ARG in the builder stage of the Dockerfile.
+	BuildArgs []string
+	// Platforms are the target platforms (os/arch[/variant]); empty means
+	// the native platform.
+	Platforms []string
+	// AuthFile is the path of the registry auth config (e.g. ~/.docker/config.json).
+	AuthFile string
+	// Push reports whether the image will be pushed after the build.
+	Push bool
+
+	// Options and OCI configure the oci builder, which does not use the Dockerfile.
+	Options dockerfileOptions
+	OCI     ociBuildOptions
+}
+
+// imageBuilders are the builders selectable with --builder.
+var imageBuilders = map[string]func(a *App) imageBuilder{
+	"docker":  func(*App) imageBuilder { return &dockerBuilder{run: runCommand} },
+	"podman":  func(*App) imageBuilder { return &podmanBuilder{binary: "podman", run: runCommand} },
+	"buildah": func(*App) imageBuilder { return &podmanBuilder{binary: "buildah", run: runCommand} },
+	"oci":     func(a *App) imageBuilder { return &ociBuilder{app: a} },
+}
+
+// newImageBuilder returns the builder with the given name.
+func (a *App) newImageBuilder(name string) (imageBuilder, error) {
+	newBuilder, ok := imageBuilders[name]
+	if !ok {
+		names := make([]string, 0, len(imageBuilders))
+		for n := range imageBuilders {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("invalid builder %q: must be one of %s", name, strings.Join(names, ", "))
+	}
+	return newBuilder(a), nil
+}
+
+// commandRunner runs a command with additional environment variables.
+type commandRunner func(ctx context.Context, env []string, args []string) error
+
+// runCommand runs a command, forwarding its output.
+func runCommand(ctx context.Context, env []string, args []string) error {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// withDockerfile writes the Dockerfile of req to a temporary file and calls f with its path.
+func withDockerfile(req *buildRequest, f func(path string) error) error {
+	tmpFile, err := os.CreateTemp("", "dockerfile-kuniumi-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	dockerfilename := tmpFile.Name()
+	defer os.Remove(dockerfilename)
+
+	if _, err := tmpFile.Write([]byte(req.Dockerfile)); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write dockerfile: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+	return f(dockerfilename)
+}
+
+// buildArgFlags returns the --build-arg flags of req.
+func buildArgFlags(req *buildRequest) []string {
+	var args []string
+	for _, arg := range req.BuildArgs {
+		args = append(args, "--build-arg", arg)
+	}
+	return args
+}
+
+// dockerBuilder builds with docker. Multi-platform images are built with
+// buildx, which pushes them while building: they cannot be loaded into the
+// local image store.
+type dockerBuilder struct {
+	run commandRunner
+}
+
+func (b *dockerBuilder) Build(ctx context.Context, req *buildRequest) error {
+	if req.Image == "" {
+		return fmt.Errorf("image name is required")
+	}
+	env, err := b.env(req)
+	if err != nil {
+		return err
+	}
+	multi := len(req.Platforms) > 1
+	if multi && !req.Push {
+		return fmt.Errorf("docker can only push multi-platform images: add --push, or use podman or buildah")
+	}
+
+	return withDockerfile(req, func(dockerfile string) error {
+		args := []string{"docker", "build"}
+		if multi {
+			args = []string{"docker", "buildx", "build"}
+		}
+		args = append(args, "-f", dockerfile, "-t", req.Image)
+		if len(req.Platforms) > 0 {
+			args = append(args, "--platform", strings.Join(req.Platforms, ","))
+		}
+		args = append(args, buildArgFlags(req)...)
+		if multi {
+			args = append(args, "--push")
+		}
+		args = append(args, req.Context)
+
+		fmt.Printf("Building image %s...\n", req.Image)
+		// The Dockerfile uses heredocs, which the legacy builder lacks
+		return b.run(ctx, append(slices.Clip(env), "DOCKER_BUILDKIT=1"), args)
+	})
+}
+
+func (b *dockerBuilder) Push(ctx context.Context, req *buildRequest) error {
+	if len(req.Platforms) > 1 {
+		// Pushed by buildx
+		return nil
+	}
+	env, err := b.env(req)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Pushing image %s...\n", req.Image)
+	return b.run(ctx, env, []string{"docker", "push", req.Image})
+}
+
+// env returns the environment pointing docker at the auth file, which docker
+// reads as config.json of its config directory.
+func (b *dockerBuilder) env(req *buildRequest) ([]string, error) {
+	if req.AuthFile == "" {
+		return nil, nil
+	}
+	if filepath.Base(req.AuthFile) != "config.json" {
+		return nil, fmt.Errorf("docker reads auth from config.json in its config directory: rename %s", req.AuthFile)
+	}
+	return []string{"DOCKER_CONFIG=" + filepath.Dir(req.AuthFile)}, nil
+}
+
+// podmanBuilder builds with podman or buildah, which share their command
+// line. Multi-platform images are built into a manifest list.
+type podmanBuilder struct {
+	binary string
+	run    commandRunner
+}
+
+func (b *podmanBuilder) Build(ctx context.Context, req *buildRequest) error {
+	if req.Image == "" {
+		return fmt.Errorf("image name is required")
+	}
+	return withDockerfile(req, func(dockerfile string) error {
+		args := []string{b.binary, "build", "-f", dockerfile}
+		args = append(args, b.authFlags(req)...)
+		if len(req.Platforms) > 1 {
+			args = append(args, "--manifest", req.Image)
+		} else {
+			args = append(args, "-t", req.Image)
+		}
+		if len(req.Platforms) > 0 {
+			args = append(args, "--platform", strings.Join(req.Platforms, ","))
+		}
+		args = append(args, buildArgFlags(req)...)
+		args = append(args, req.Context)
+
+		fmt.Printf("Building image %s...\n", req.Image)
+		return b.run(ctx, nil, args)
+	})
+}
+
+func (b *podmanBuilder) Push(ctx context.Context, req *buildRequest) error {
+	args := []string{b.binary, "push"}
+	if len(req.Platforms) > 1 {
+		args = []string{b.binary, "manifest", "push", "--all"}
+	}
+	args = append(args, b.authFlags(req)...)
+	args = append(args, req.Image, "docker://"+req.Image)
+
+	fmt.Printf("Pushing image %s...\n", req.Image)
+	return b.run(ctx, nil, args)
+}
+
+func (b *podmanBuilder) authFlags(req *buildRequest) []string {
+	if req.AuthFile == "" {
+		return nil
+	}
+	return []string{"--authfile", req.AuthFile}
+}
+
+// ociBuilder assembles the image without a container engine (see buildOCIImage).
+type ociBuilder struct {
+	app *App
+}
+
+func (b *ociBuilder) Build(ctx context.Context, req *buildRequest) error {
+	if req.Push {
+		return fmt.Errorf("the oci builder cannot push: push the archive with a registry client (e.g. skopeo, crane)")
+	}
+	if len(req.BuildArgs) > 0 {
+		return fmt.Errorf("the oci builder does not use build args: set the environment of go build instead")
+	}
+	o := req.OCI
+	o.Image = req.Image
+	for _, p := range req.Platforms {
+		platform, err := parsePlatform(p)
+		if err != nil {
+			return err
+		}
+		o.Platforms = append(o.Platforms, platform)
+	}
+	return b.app.buildOCIImage(req.Options, o)
+}
+
+func (b *ociBuilder) Push(ctx context.Context, req *buildRequest) error {
+	return fmt.Errorf("the oci builder cannot push")
+}
@@ -0,0 +1,175 @@
+package kuniumi
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBuilder records the requests of the containerize command.
+type fakeBuilder struct {
+	built  []*buildRequest
+	pushed []*buildRequest
+}
+
+func (b *fakeBuilder) Build(ctx context.Context, req *buildRequest) error {
+	b.built = append(b.built, req)
+	return nil
+}
+
+func (b *fakeBuilder) Push(ctx context.Context, req *buildRequest) error {
+	b.pushed = append(b.pushed, req)
+	return nil
+}
+
+// useFakeBuilder registers a fake builder as --builder fake for the test.
+func useFakeBuilder(t *testing.T) *fakeBuilder {
+	t.Helper()
+	fake := &fakeBuilder{}
+	imageBuilders["fake"] = func(*App) imageBuilder { return fake }
+	t.Cleanup(func() { delete(imageBuilders, "fake") })
+	return fake
+}
+
+// recordedCommand is a command run by a builder.
+type recordedCommand struct {
+	env  []string
+	args []string
+}
+
+// recordCommands returns a commandRunner recording the commands it runs,
+// with the Dockerfile path (a temporary file) replaced by "Dockerfile".
+func recordCommands(commands *[]recordedCommand) commandRunner {
+	return func(ctx context.Context, env []string, args []string) error {
+		args = append([]string(nil), args...)
+		for i, arg := range args {
+			if i > 0 && args[i-1] == "-f" {
+				args[i] = "Dockerfile"
+				if _, err := os.Stat(arg); err != nil {
+					return err
+				}
+			}
+		}
+		*commands = append(*commands, recordedCommand{env, args})
+		return nil
+	}
+}
+
+func TestContainerizeCmd_Builder(t *testing.T) {
+	fake := useFakeBuilder(t)
+	app := newCgiTestApp()
+
+	cmd := app.buildContainerizeCmd()
+	cmd.SetArgs([]string{
+		"--builder", "fake", "--image", "registry.example.com/app:1.0", "--push",
+		"--platform", "linux/amd64,linux/arm64", "--build-arg", "GOPROXY=https://proxy.example.com",
+		"--build-arg", "GOPRIVATE", "--authfile", "/secrets/config.json",
+	})
+	require.NoError(t, cmd.Execute())
+
+	require.Len(t, fake.built, 1)
+	req := fake.built[0]
+	assert.Equal(t, "registry.example.com/app:1.0", req.Image)
+	assert.Equal(t, ".", req.Context)
+	assert.Equal(t, []string{"linux/amd64", "linux/arm64"}, req.Platforms)
+	assert.Equal(t, []string{"GOPROXY=https://proxy.example.com", "GOPRIVATE"}, req.BuildArgs)
+	assert.Equal(t, "/secrets/config.json", req.AuthFile)
+	assert.True(t, req.Push)
+	assert.Contains(t, req.Dockerfile, "FROM --platform=$BUILDPLATFORM golang:1.24-alpine AS builder\nARG GOPROXY\nARG GOPRIVATE\nARG TARGETOS\nARG TARGETARCH\n")
+	assert.Contains(t, req.Dockerfile, "ENV GOOS=$TARGETOS GOARCH=$TARGETARCH\n")
+	assert.Equal(t, fake.built, fake.pushed)
+}
+
+func TestContainerizeCmd_InvalidBuilder(t *testing.T) {
+	cmd := newCgiTestApp().buildContainerizeCmd()
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	cmd.SetArgs([]string{"--builder", "kaniko", "--image", "app"})
+	assert.ErrorContains(t, cmd.Execute(), "must be one of buildah, docker, oci, podman")
+}
+
+func TestDockerBuilder(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("single platform", func(t *testing.T) {
+		var commands []recordedCommand
+		b := &dockerBuilder{run: recordCommands(&commands)}
+		req := &buildRequest{
+			Image: "app:1.0", Context: ".", Platforms: []string{"linux/arm64"},
+			BuildArgs: []string{"GOPROXY=off"}, AuthFile: "/secrets/config.json",
+		}
+		require.NoError(t, b.Build(ctx, req))
+		require.NoError(t, b.Push(ctx, req))
+
+		env := []string{"DOCKER_CONFIG=" + filepath.Dir("/secrets/config.json")}
+		assert.Equal(t, []recordedCommand{
+			{append(env, "DOCKER_BUILDKIT=1"), []string{"docker", "build", "-f", "Dockerfile", "-t", "app:1.0", "--platform", "linux/arm64", "--build-arg", "GOPROXY=off", "."}},
+			{env, []string{"docker", "push", "app:1.0"}},
+		}, commands)
+	})
+
+	t.Run("multi-platform", func(t *testing.T) {
+		var commands []recordedCommand
+		b := &dockerBuilder{run: recordCommands(&commands)}
+		req := &buildRequest{Image: "app:1.0", Context: ".", Platforms: []string{"linux/amd64", "linux/arm64"}}
+		assert.ErrorContains(t, b.Build(ctx, req), "add --push")
+
+		req.Push = true
+		require.NoError(t, b.Build(ctx, req))
+		require.NoError(t, b.Push(ctx, req))
+		assert.Equal(t, []recordedCommand{
+			{[]string{"DOCKER_BUILDKIT=1"}, []string{"docker", "buildx", "build", "-f", "Dockerfile", "-t", "app:1.0", "--platform", "linux/amd64,linux/arm64", "--push", "."}},
+		}, commands, "pushed by buildx")
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		b := &dockerBuilder{run: recordCommands(new([]recordedCommand))}
+		assert.ErrorContains(t, b.Build(ctx, &buildRequest{Context: "."}), "image name is required")
+		assert.ErrorContains(t, b.Build(ctx, &buildRequest{Image: "app", AuthFile: "auth.json"}), "config.json")
+	})
+}
+
+func TestPodmanBuilder(t *testing.T) {
+	ctx := context.Background()
+
+	for _, binary := range []string{"podman", "buildah"} {
+		t.Run(binary, func(t *testing.T) {
+			var commands []recordedCommand
+			b := &podmanBuilder{binary: binary, run: recordCommands(&commands)}
+
+			single := &buildRequest{Image: "app:1.0", Context: ".", AuthFile: "/run/auth.json"}
+			require.NoError(t, b.Build(ctx, single))
+			require.NoError(t, b.Push(ctx, single))
+
+			multi := &buildRequest{Image: "app:1.0", Context: ".", Platforms: []string{"linux/amd64", "linux/arm64"}, BuildArgs: []string{"GOPROXY"}}
+			require.NoError(t, b.Build(ctx, multi))
+			require.NoError(t, b.Push(ctx, multi))
+
+			assert.Equal(t, []recordedCommand{
+				{nil, []string{binary, "build", "-f", "Dockerfile", "--authfile", "/run/auth.json", "-t", "app:1.0", "."}},
+				{nil, []string{binary, "push", "--authfile", "/run/auth.json", "app:1.0", "docker://app:1.0"}},
+				{nil, []string{binary, "build", "-f", "Dockerfile", "--manifest", "app:1.0", "--platform", "linux/amd64,linux/arm64", "--build-arg", "GOPROXY", "."}},
+				{nil, []string{binary, "manifest", "push", "--all", "app:1.0", "docker://app:1.0"}},
+			}, commands)
+		})
+	}
+}
+
+func TestOCIBuilder_Errors(t *testing.T) {
+	ctx := context.Background()
+	b := &ociBuilder{app: newCgiTestApp()}
+	assert.ErrorContains(t, b.Build(ctx, &buildRequest{Push: true}), "cannot push")
+	assert.ErrorContains(t, b.Build(ctx, &buildRequest{BuildArgs: []string{"GOPROXY"}}), "build args")
+	assert.ErrorContains(t, b.Build(ctx, &buildRequest{Platforms: []string{"linux"}}), "invalid platform")
+
+	err := b.app.buildOCIImage(defaultDockerfileOptions(), ociBuildOptions{
+		Platforms: []ociPlatform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}},
+		Format:    imageFormatDocker,
+	})
+	assert.ErrorContains(t, err, "single platform")
+}
@@ -0,0 +1,80 @@
+package kuniumi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronNext(t *testing.T) {
+	// 2026-01-15 is a Thursday
+	from := time.Date(2026, 1, 15, 10, 30, 45, 0, time.UTC)
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 1, 15, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 1, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2026, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2026, 1, 16, 10, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2026, 1, 15, 13, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * mon", time.Date(2026, 1, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 1, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 1-5", time.Date(2026, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 mar *", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2026, 1, 15, 10, 45, 0, 0, time.UTC)},
+		// Both day fields restricted: either matches (the 20th or a Friday)
+		{"0 0 20 * fri", time.Date(2026, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := parseCron(tt.expr, time.UTC)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, s.Next(from))
+		})
+	}
+}
+
+func TestCronNext_TimeZone(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	s, err := parseCron("0 9 * * *", tokyo)
+	require.NoError(t, err)
+
+	next := s.Next(time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2026, 1, 16, 0, 0, 0, 0, time.UTC), next.UTC())
+}
+
+func TestCronNext_Never(t *testing.T) {
+	s, err := parseCron("0 0 30 2 *", time.UTC)
+	require.NoError(t, err)
+	assert.True(t, s.Next(time.Now()).IsZero())
+}
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@often",
+	} {
+		_, err := parseCron(expr, time.UTC)
+		assert.Error(t, err, expr)
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"fmt"
-	"os"
 
 	"github.com/axsh/kuniumi"
 )
@@ -12,13 +11,15 @@ import (
 func Add(ctx context.Context, x int, y int) (int, error) {
 	// Example of using VirtualEnvironment
 	env := kuniumi.GetVirtualEnv(ctx)
+	// Never print to stdout: it carries the MCP protocol stream and CGI responses
+	logger := kuniumi.Logger(ctx)
 
 	// Check for a debug flag or similar from Env
 	if env.Getenv("DEBUG") == "true" {
-		fmt.Println("Debug mode is on")
+		logger.Info("Debug mode is on", "x", x, "y", y)
 		// Try writing to a file if mount is present
 		if err := env.WriteFile("debug.log", []byte(fmt.Sprintf("Adding %d + %d", x, y))); err != nil {
-			fmt.Fprintf(os.Stderr, "DEBUG: WriteFile failed: %v\n", err)
+			logger.Error("WriteFile failed", "error", err)
 		}
 	}
 
@@ -0,0 +1,140 @@
+package kuniumi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// ErrUnsupported is returned by context helpers that need a capability which the
+// current adapter or the connected client does not provide. Use errors.Is to detect it.
+var ErrUnsupported = errors.New("operation not supported by the current adapter")
+
+// Elicitation actions reported in ElicitResult.Action.
+const (
+	ElicitAccept  = "accept"
+	ElicitDecline = "decline"
+	ElicitCancel  = "cancel"
+)
+
+// ElicitResult is the client's answer to an elicitation request.
+type ElicitResult struct {
+	// Action is the user's choice: ElicitAccept, ElicitDecline or ElicitCancel.
+	Action string
+	// Content holds the submitted values. It is only set when Action is ElicitAccept.
+	Content map[string]any
+}
+
+// Accepted reports whether the user accepted the request and submitted content.
+func (r *ElicitResult) Accepted() bool {
+	return r.Action == ElicitAccept
+}
+
+// Elicit asks the connected MCP client to collect input from the user in the
+// middle of a function call, e.g. a confirmation or a missing parameter.
+//
+// Arguments:
+//   - schema: A flat JSON Schema object describing the requested fields.
+//   - message: The message shown to the user.
+//
+// Returns an error wrapping ErrUnsupported when the function is not running under
+// the mcp adapter or the client does not support elicitation.
+//
+// Example:
+//
+//	res, err := kuniumi.Elicit(ctx, map[string]any{
+//		"type": "object",
+//		"properties": map[string]any{
+//			"confirm": map[string]any{"type": "boolean"},
+//		},
+//	}, "Delete all files?")
+func Elicit(ctx context.Context, schema map[string]any, message string) (*ElicitResult, error) {
+	call := getMcpCall(ctx)
+	if call == nil {
+		return nil, fmt.Errorf("elicit: %w", ErrUnsupported)
+	}
+	if caps := clientCapabilities(call.session); caps == nil || caps.Elicitation == nil {
+		return nil, fmt.Errorf("elicit: client does not support elicitation: %w", ErrUnsupported)
+	}
+
+	params := &mcp.ElicitParams{Message: message}
+	if schema != nil {
+		params.RequestedSchema = schema
+	}
+	res, err := call.session.Elicit(ctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("elicit: %w", err)
+	}
+	return &ElicitResult{Action: res.Action, Content: res.Content}, nil
+}
+
+// defaultSampleMaxTokens is the completion limit used when WithMaxTokens is not given.
+const defaultSampleMaxTokens = 1024
+
+// SampleOption is a functional option for configuring a Sample request.
+type SampleOption func(*mcp.CreateMessageParams)
+
+// WithSystemPrompt sets the system prompt for a Sample request.
+func WithSystemPrompt(prompt string) SampleOption {
+	return func(p *mcp.CreateMessageParams) {
+		p.SystemPrompt = prompt
+	}
+}
+
+// WithMaxTokens sets the maximum number of tokens the client may sample.
+func WithMaxTokens(n int64) SampleOption {
+	return func(p *mcp.CreateMessageParams) {
+		p.MaxTokens = n
+	}
+}
+
+// Sample asks the connected MCP client to generate an LLM completion for prompt
+// and returns the generated text.
+//
+// Returns an error wrapping ErrUnsupported when the function is not running under
+// the mcp adapter or the client does not support sampling.
+//
+// Example:
+//
+//	summary, err := kuniumi.Sample(ctx, "Summarize: "+text, kuniumi.WithMaxTokens(200))
+func Sample(ctx context.Context, prompt string, opts ...SampleOption) (string, error) {
+	call := getMcpCall(ctx)
+	if call == nil {
+		return "", fmt.Errorf("sample: %w", ErrUnsupported)
+	}
+	if caps := clientCapabilities(call.session); caps == nil || caps.Sampling == nil {
+		return "", fmt.Errorf("sample: client does not support sampling: %w", ErrUnsupported)
+	}
+
+	params := &mcp.CreateMessageParams{
+		MaxTokens: defaultSampleMaxTokens,
+		Messages: []*mcp.SamplingMessage{
+			{Role: "user", Content: &mcp.TextContent{Text: prompt}},
+		},
+	}
+	for _, opt := range opts {
+		opt(params)
+	}
+
+	res, err := call.session.CreateMessage(ctx, params)
+	if err != nil {
+		return "", fmt.Errorf("sample: %w", err)
+	}
+	text, ok := res.Content.(*mcp.TextContent)
+	if !ok {
+		return "", fmt.Errorf("sample: expected text content, got %T", res.Content)
+	}
+	return text.Text, nil
+}
+
+// clientCapabilities returns the capabilities announced by the client, or nil
+// if the session has not been initialized.
+func clientCapabilities(ss *mcp.ServerSession) *mcp.ClientCapabilities {
+	params := ss.InitializeParams()
+	if params == nil {
+		return nil
+	}
+	return params.Capabilities
+}
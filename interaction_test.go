@@ -0,0 +1,94 @@
+package kuniumi
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// callToolText calls the named tool and returns its first text content.
+func callToolText(t *testing.T, session *mcp.ClientSession, name string) (string, bool) {
+	t.Helper()
+	result, err := session.CallTool(context.Background(), &mcp.CallToolParams{Name: name})
+	require.NoError(t, err)
+	require.NotEmpty(t, result.Content)
+	text, ok := result.Content[0].(*mcp.TextContent)
+	require.True(t, ok, "content should be TextContent")
+	return text.Text, result.IsError
+}
+
+func newInteractionApp() *App {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	app.RegisterFunc(func(ctx context.Context) (string, error) {
+		res, err := Elicit(ctx, map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"name": map[string]any{"type": "string"},
+			},
+		}, "Who are you?")
+		if err != nil {
+			return "", err
+		}
+		if !res.Accepted() {
+			return res.Action, nil
+		}
+		return "hello " + res.Content["name"].(string), nil
+	}, "asks for a name")
+	app.RegisterFunc(func(ctx context.Context) (string, error) {
+		return Sample(ctx, "Say hi", WithSystemPrompt("be brief"))
+	}, "asks the client LLM")
+	return app
+}
+
+func TestElicitAndSample(t *testing.T) {
+	app := newInteractionApp()
+	session := connectMcp(t, app, &mcp.ClientOptions{
+		ElicitationHandler: func(ctx context.Context, req *mcp.ElicitRequest) (*mcp.ElicitResult, error) {
+			assert.Equal(t, "Who are you?", req.Params.Message)
+			return &mcp.ElicitResult{Action: "accept", Content: map[string]any{"name": "kuniumi"}}, nil
+		},
+		CreateMessageHandler: func(ctx context.Context, req *mcp.CreateMessageRequest) (*mcp.CreateMessageResult, error) {
+			assert.Equal(t, "be brief", req.Params.SystemPrompt)
+			assert.Equal(t, int64(defaultSampleMaxTokens), req.Params.MaxTokens)
+			return &mcp.CreateMessageResult{
+				Content: &mcp.TextContent{Text: "hi"},
+				Model:   "test-model",
+				Role:    "assistant",
+			}, nil
+		},
+	})
+
+	text, isErr := callToolText(t, session, app.functions[0].OperationID())
+	require.False(t, isErr, text)
+	assert.JSONEq(t, `{"result":"hello kuniumi"}`, text)
+
+	text, isErr = callToolText(t, session, app.functions[1].OperationID())
+	require.False(t, isErr, text)
+	assert.JSONEq(t, `{"result":"hi"}`, text)
+}
+
+func TestElicitAndSample_ClientWithoutCapabilities(t *testing.T) {
+	app := newInteractionApp()
+	session := connectMcp(t, app, nil)
+
+	for _, fn := range app.functions {
+		text, isErr := callToolText(t, session, fn.OperationID())
+		require.True(t, isErr)
+
+		var parsed map[string]any
+		require.NoError(t, json.Unmarshal([]byte(text), &parsed))
+		assert.Contains(t, parsed["error"], ErrUnsupported.Error())
+	}
+}
+
+func TestElicitAndSample_NoMcp(t *testing.T) {
+	_, err := Elicit(context.Background(), nil, "confirm?")
+	assert.ErrorIs(t, err, ErrUnsupported)
+
+	_, err = Sample(context.Background(), "prompt")
+	assert.ErrorIs(t, err, ErrUnsupported)
+}
@@ -0,0 +1,42 @@
+package kuniumi
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+)
+
+// listen opens a listener from an address spec:
+//
+//	unix:/run/app.sock   Unix domain socket
+//	tcp:127.0.0.1:8080   TCP address
+//	127.0.0.1:8080       TCP address
+//	:8080                TCP port on all interfaces
+func listen(spec string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(spec, "unix:"); ok {
+		if path == "" {
+			return nil, fmt.Errorf("invalid listen address %q: missing socket path", spec)
+		}
+		return listenUnix(path)
+	}
+	return net.Listen("tcp", strings.TrimPrefix(spec, "tcp:"))
+}
+
+// listenUnix listens on a Unix domain socket. A stale socket file left by a
+// previous run is removed, but any other file at path is left untouched.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("refusing to replace non-socket file: %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
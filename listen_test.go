@@ -0,0 +1,58 @@
+package kuniumi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListen(t *testing.T) {
+	t.Run("tcp", func(t *testing.T) {
+		for _, spec := range []string{"127.0.0.1:0", "tcp:127.0.0.1:0"} {
+			l, err := listen(spec)
+			require.NoError(t, err, spec)
+			assert.Equal(t, "tcp", l.Addr().Network())
+			l.Close()
+		}
+	})
+
+	t.Run("unix", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "app.sock")
+		l, err := listen("unix:" + path)
+		require.NoError(t, err)
+		assert.Equal(t, "unix", l.Addr().Network())
+		assert.Equal(t, path, l.Addr().String())
+		l.Close()
+	})
+
+	t.Run("missing socket path", func(t *testing.T) {
+		_, err := listen("unix:")
+		assert.Error(t, err)
+	})
+}
+
+func TestListenUnix_StaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	l, err := listenUnix(path)
+	require.NoError(t, err)
+	// Simulate a crash: the socket file is left behind
+	l.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	l.Close()
+	require.FileExists(t, path)
+
+	l, err = listenUnix(path)
+	require.NoError(t, err)
+	l.Close()
+}
+
+func TestListenUnix_RefusesRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not-a-socket")
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0644))
+
+	_, err := listenUnix(path)
+	assert.Error(t, err)
+	assert.FileExists(t, path)
+}
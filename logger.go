@@ -0,0 +1,31 @@
+package kuniumi
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// Logger returns a logger for use inside registered functions.
+//
+// Under the mcp adapter, records are sent to the client as `notifications/message`
+// at or above the level the client requested with `logging/setLevel` (nothing is
+// sent until the client sets a level). Under every other adapter, records are
+// written to stderr.
+//
+// Functions must not write debug output to stdout: under the mcp adapter stdout
+// carries the protocol stream, and under the cgi adapter it carries the response.
+//
+// Example:
+//
+//	kuniumi.Logger(ctx).Info("processing", "file", path)
+func Logger(ctx context.Context) *slog.Logger {
+	if call := getMcpCall(ctx); call != nil {
+		return slog.New(mcp.NewLoggingHandler(call.session, &mcp.LoggingHandlerOptions{
+			LoggerName: call.toolName,
+		}))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, nil))
+}
@@ -0,0 +1,62 @@
+package kuniumi
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogger_Mcp(t *testing.T) {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	app.RegisterFunc(func(ctx context.Context) error {
+		logger := Logger(ctx)
+		logger.Debug("hidden")
+		logger.Warn("visible", "key", "value")
+		return nil
+	}, "logs")
+
+	var mu sync.Mutex
+	var messages []*mcp.LoggingMessageParams
+	session := connectMcp(t, app, &mcp.ClientOptions{
+		LoggingMessageHandler: func(ctx context.Context, req *mcp.LoggingMessageRequest) {
+			mu.Lock()
+			defer mu.Unlock()
+			messages = append(messages, req.Params)
+		},
+	})
+
+	ctx := context.Background()
+	require.NoError(t, session.SetLoggingLevel(ctx, &mcp.SetLoggingLevelParams{Level: "info"}))
+
+	toolName := app.functions[0].OperationID()
+	res, err := session.CallTool(ctx, &mcp.CallToolParams{Name: toolName})
+	require.NoError(t, err)
+	require.False(t, res.IsError)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(messages) > 0
+	}, time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, messages, 1, "debug records should be filtered by the client level")
+	assert.Equal(t, mcp.LoggingLevel("warning"), messages[0].Level)
+	assert.Equal(t, toolName, messages[0].Logger)
+	data, ok := messages[0].Data.(map[string]any)
+	require.True(t, ok, "data should be a JSON object")
+	assert.Equal(t, "visible", data["msg"])
+	assert.Equal(t, "value", data["key"])
+}
+
+func TestLogger_NoMcp(t *testing.T) {
+	logger := Logger(context.Background())
+	require.NotNil(t, logger)
+	assert.True(t, logger.Enabled(context.Background(), 0), "stderr logger should log at info level")
+}
@@ -0,0 +1,189 @@
+package kuniumi
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	vpath "path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// rootsPolicy controls how the roots advertised by an MCP client are mounted
+// into the VirtualEnvironment of that client's session.
+type rootsPolicy string
+
+const (
+	// rootsReadWrite mounts every root with write access.
+	rootsReadWrite rootsPolicy = "rw"
+	// rootsReadOnly mounts every root read-only.
+	rootsReadOnly rootsPolicy = "ro"
+	// rootsIgnore never asks the client for roots.
+	rootsIgnore rootsPolicy = "ignore"
+)
+
+// rootsMountDir is the virtual directory under which client roots are mounted.
+const rootsMountDir = "/roots"
+
+// parseRootsPolicy validates the value of the --roots flag.
+func parseRootsPolicy(s string) (rootsPolicy, error) {
+	switch p := rootsPolicy(s); p {
+	case rootsReadWrite, rootsReadOnly, rootsIgnore:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid roots policy %q (expected rw, ro or ignore)", s)
+	}
+}
+
+// mcpRoots tracks the client roots of every MCP session and the
+// VirtualEnvironment derived from them.
+//
+// Roots are fetched lazily on the first tool call of a session, and fetched
+// again after the client sends notifications/roots/list_changed.
+type mcpRoots struct {
+	policy rootsPolicy
+	server *mcp.Server // Used to forget disconnected sessions
+
+	mu       sync.Mutex
+	sessions map[*mcp.ServerSession]*rootsState
+}
+
+// rootsState is the per-session roots state.
+type rootsState struct {
+	env   *VirtualEnvironment
+	owned bool // env mounts the roots and is closed with the state
+	stale bool
+}
+
+// close closes the root mounts of the state. Calls still running in its
+// environment fail on these mounts with fs.ErrClosed.
+func (st *rootsState) close() {
+	if st.owned {
+		st.env.Close()
+	}
+}
+
+func newMcpRoots(policy rootsPolicy) *mcpRoots {
+	return &mcpRoots{
+		policy:   policy,
+		sessions: make(map[*mcp.ServerSession]*rootsState),
+	}
+}
+
+// invalidate marks the roots of a session as outdated.
+func (r *mcpRoots) invalidate(ss *mcp.ServerSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if st, ok := r.sessions[ss]; ok {
+		st.stale = true
+	}
+}
+
+// sessionEnv returns the VirtualEnvironment for a session: base plus the
+// session's client roots mounted under rootsMountDir.
+// If the roots cannot be listed (e.g. the client does not support roots),
+// base is used unchanged.
+func (r *mcpRoots) sessionEnv(ctx context.Context, ss *mcp.ServerSession, base *VirtualEnvironment) *VirtualEnvironment {
+	r.mu.Lock()
+	st, ok := r.sessions[ss]
+	if ok && !st.stale {
+		r.mu.Unlock()
+		return st.env
+	}
+	r.mu.Unlock()
+
+	st = &rootsState{env: base}
+	if res, err := ss.ListRoots(ctx, nil); err == nil {
+		st.env = base.withMounts(rootMounts(res.Roots, r.policy == rootsReadOnly))
+		st.owned = true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pruneLocked()
+	if old, ok := r.sessions[ss]; ok {
+		old.close()
+	}
+	r.sessions[ss] = st
+	return st.env
+}
+
+// pruneLocked forgets the sessions that are no longer connected to the
+// server and closes their root mounts.
+func (r *mcpRoots) pruneLocked() {
+	if r.server == nil {
+		return
+	}
+	live := make(map[*mcp.ServerSession]bool)
+	for ss := range r.server.Sessions() {
+		live[ss] = true
+	}
+	for ss, st := range r.sessions {
+		if !live[ss] {
+			st.close()
+			delete(r.sessions, ss)
+		}
+	}
+}
+
+// rootNameSanitizer matches characters not allowed in a root mount name.
+var rootNameSanitizer = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// rootMounts converts client roots into mounts at /roots/<name>.
+// The name is the root's name, or the base name of its directory when the
+// client did not name it. Roots that are not file:// URIs are skipped.
+func rootMounts(roots []*mcp.Root, readOnly bool) map[string]mountPoint {
+	mounts := make(map[string]mountPoint)
+	for _, root := range roots {
+		if root == nil {
+			continue
+		}
+		hostPath, err := fileURIToPath(root.URI)
+		if err != nil {
+			continue
+		}
+
+		name := root.Name
+		if name == "" {
+			name = filepath.Base(hostPath)
+		}
+		name = strings.Trim(rootNameSanitizer.ReplaceAllString(name, "_"), "._")
+		if name == "" {
+			name = "root"
+		}
+
+		// Disambiguate roots with the same name
+		virt := vpath.Join(rootsMountDir, name)
+		for i := 2; ; i++ {
+			if _, taken := mounts[virt]; !taken {
+				break
+			}
+			virt = vpath.Join(rootsMountDir, fmt.Sprintf("%s-%d", name, i))
+		}
+
+		mounts[virt] = mountPoint{host: hostPath, readOnly: readOnly}
+	}
+	return mounts
+}
+
+// fileURIToPath converts a file:// URI to a host path.
+func fileURIToPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported root URI scheme: %s", u.Scheme)
+	}
+	p := u.Path
+	// file:///C:/work -> C:/work
+	if runtime.GOOS == "windows" && len(p) > 2 && p[0] == '/' && p[2] == ':' {
+		p = p[1:]
+	}
+	return filepath.FromSlash(p), nil
+}
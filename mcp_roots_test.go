@@ -0,0 +1,112 @@
+package kuniumi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootMounts(t *testing.T) {
+	mounts := rootMounts([]*mcp.Root{
+		{URI: "file:///home/user/project", Name: "My Project"},
+		{URI: "file:///home/user/other"},
+		{URI: "file:///tmp/other"},
+		{URI: "https://example.com/repo"},
+	}, true)
+
+	assert.Equal(t, map[string]mountPoint{
+		"/roots/My_Project": {host: filepath.FromSlash("/home/user/project"), readOnly: true},
+		"/roots/other":      {host: filepath.FromSlash("/home/user/other"), readOnly: true},
+		"/roots/other-2":    {host: filepath.FromSlash("/tmp/other"), readOnly: true},
+	}, mounts)
+}
+
+func TestParseRootsPolicy(t *testing.T) {
+	for _, valid := range []string{"rw", "ro", "ignore"} {
+		p, err := parseRootsPolicy(valid)
+		require.NoError(t, err)
+		assert.Equal(t, rootsPolicy(valid), p)
+	}
+	_, err := parseRootsPolicy("yes")
+	assert.Error(t, err)
+}
+
+func TestMcpRoots(t *testing.T) {
+	dirA := t.TempDir()
+	dirB := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dirA, "a.txt"), []byte("from a"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dirB, "b.txt"), []byte("from b"), 0644))
+
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	app.RegisterFunc(func(ctx context.Context, path string) (string, error) {
+		data, err := GetVirtualEnv(ctx).ReadFile(path, 0, 1024)
+		return string(data), err
+	}, "reads a file", WithParams(Param("path", "virtual path")))
+	app.RegisterFunc(func(ctx context.Context, path string) error {
+		return GetVirtualEnv(ctx).WriteFile(path, []byte("new"))
+	}, "writes a file", WithParams(Param("path", "virtual path")))
+	readTool, writeTool := app.functions[0].OperationID(), app.functions[1].OperationID()
+
+	connect := func(t *testing.T, policy rootsPolicy) (*mcp.Client, *mcp.ClientSession) {
+		ctx := context.Background()
+		serverTransport, clientTransport := mcp.NewInMemoryTransports()
+		serverSession, err := app.newMcpServer(policy).Connect(ctx, serverTransport, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { serverSession.Close() })
+
+		client := mcp.NewClient(&mcp.Implementation{Name: "test-client", Version: "1.0.0"}, nil)
+		client.AddRoots(&mcp.Root{URI: "file://" + filepath.ToSlash(dirA), Name: "a"})
+		session, err := client.Connect(ctx, clientTransport, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { session.Close() })
+		return client, session
+	}
+
+	call := func(t *testing.T, session *mcp.ClientSession, tool, path string) *mcp.CallToolResult {
+		res, err := session.CallTool(context.Background(), &mcp.CallToolParams{
+			Name:      tool,
+			Arguments: map[string]any{"path": path},
+		})
+		require.NoError(t, err)
+		return res
+	}
+
+	t.Run("read-only", func(t *testing.T) {
+		client, session := connect(t, rootsReadOnly)
+
+		res := call(t, session, readTool, "/roots/a/a.txt")
+		require.False(t, res.IsError)
+		assert.JSONEq(t, `{"result":"from a"}`, res.Content[0].(*mcp.TextContent).Text)
+
+		res = call(t, session, writeTool, "/roots/a/new.txt")
+		assert.True(t, res.IsError, "writes to read-only roots should fail")
+		assert.NoFileExists(t, filepath.Join(dirA, "new.txt"))
+
+		// Roots are refreshed after notifications/roots/list_changed
+		client.AddRoots(&mcp.Root{URI: "file://" + filepath.ToSlash(dirB), Name: "b"})
+		assert.Eventually(t, func() bool {
+			return !call(t, session, readTool, "/roots/b/b.txt").IsError
+		}, 2*time.Second, 20*time.Millisecond)
+	})
+
+	t.Run("read-write", func(t *testing.T) {
+		_, session := connect(t, rootsReadWrite)
+
+		res := call(t, session, writeTool, "/roots/a/new.txt")
+		require.False(t, res.IsError)
+		assert.FileExists(t, filepath.Join(dirA, "new.txt"))
+	})
+
+	t.Run("ignore", func(t *testing.T) {
+		_, session := connect(t, rootsIgnore)
+
+		res := call(t, session, readTool, "/roots/a/a.txt")
+		assert.True(t, res.IsError, "roots should not be mounted")
+	})
+}
@@ -0,0 +1,162 @@
+package kuniumi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// Blob is a binary function result with an explicit MIME type.
+//
+// When a function returns a Blob as its only result, the HTTP and CGI adapters
+// send Data as the raw response body with MIME as the Content-Type, and the mcp
+// adapter returns it as an embedded resource.
+type Blob struct {
+	MIME string
+	Data []byte
+}
+
+// Image is an image function result (e.g. MIME "image/png").
+// The mcp adapter returns it as image content.
+type Image struct {
+	MIME string
+	Data []byte
+}
+
+// Audio is an audio function result (e.g. MIME "audio/wav").
+// The mcp adapter returns it as audio content.
+type Audio struct {
+	MIME string
+	Data []byte
+}
+
+// defaultBinaryMIME is the MIME type used for binary results without one,
+// including io.Reader results.
+const defaultBinaryMIME = "application/octet-stream"
+
+var (
+	blobType   = reflect.TypeOf(Blob{})
+	imageType  = reflect.TypeOf(Image{})
+	audioType  = reflect.TypeOf(Audio{})
+	readerType = reflect.TypeOf((*io.Reader)(nil)).Elem()
+)
+
+// binaryKind classifies binary results.
+type binaryKind int
+
+const (
+	binaryBlob binaryKind = iota
+	binaryImage
+	binaryAudio
+)
+
+// binaryValue is a binary function result ready to be written by an adapter.
+type binaryValue struct {
+	kind binaryKind
+	mime string
+	body io.Reader
+}
+
+// Close releases the underlying reader if it is an io.Closer.
+func (b *binaryValue) Close() error {
+	if c, ok := b.body.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// binaryResult reports whether the function results consist of a single binary
+// value (Blob, Image, Audio or io.Reader, or pointers to them) and returns it.
+// Functions with several return values always use the JSON response format.
+func binaryResult(results []any) (*binaryValue, bool) {
+	if len(results) != 1 {
+		return nil, false
+	}
+	switch v := results[0].(type) {
+	case Blob:
+		return newBinaryValue(binaryBlob, v.MIME, v.Data), true
+	case *Blob:
+		if v != nil {
+			return newBinaryValue(binaryBlob, v.MIME, v.Data), true
+		}
+	case Image:
+		return newBinaryValue(binaryImage, v.MIME, v.Data), true
+	case *Image:
+		if v != nil {
+			return newBinaryValue(binaryImage, v.MIME, v.Data), true
+		}
+	case Audio:
+		return newBinaryValue(binaryAudio, v.MIME, v.Data), true
+	case *Audio:
+		if v != nil {
+			return newBinaryValue(binaryAudio, v.MIME, v.Data), true
+		}
+	case io.Reader:
+		if rv := reflect.ValueOf(v); rv.Kind() != reflect.Pointer || !rv.IsNil() {
+			return &binaryValue{kind: binaryBlob, mime: defaultBinaryMIME, body: v}, true
+		}
+	}
+	return nil, false
+}
+
+func newBinaryValue(kind binaryKind, mime string, data []byte) *binaryValue {
+	if mime == "" {
+		mime = defaultBinaryMIME
+	}
+	return &binaryValue{kind: kind, mime: mime, body: bytes.NewReader(data)}
+}
+
+// binaryJSON is the JSON form of a binary result, used by the adapters that
+// only write JSON (batch, jsonrpc, lambda and schedule). Data is encoded in
+// base64.
+type binaryJSON struct {
+	MIME string `json:"mime"`
+	Data []byte `json:"data"`
+}
+
+// jsonResults returns results with the binary values (see binaryResult)
+// replaced by their binaryJSON form. Readers are read and closed, even if
+// reading another one fails.
+func jsonResults(results []any) ([]any, error) {
+	out := make([]any, len(results))
+	var errs []error
+	for i, res := range results {
+		bin, ok := binaryResult([]any{res})
+		if !ok {
+			out[i] = res
+			continue
+		}
+		data, err := io.ReadAll(bin.body)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read result: %w", err))
+		}
+		bin.Close()
+		out[i] = binaryJSON{MIME: bin.mime, Data: data}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// binaryMediaType returns the OpenAPI media type documented for a binary
+// return type, and false if t is not a binary type.
+func binaryMediaType(t reflect.Type) (string, bool) {
+	if t.Implements(readerType) {
+		return defaultBinaryMIME, true
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case imageType:
+		return "image/*", true
+	case audioType:
+		return "audio/*", true
+	case blobType:
+		return defaultBinaryMIME, true
+	}
+	return "", false
+}
@@ -0,0 +1,167 @@
+package kuniumi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBinaryResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		results  []any
+		wantOK   bool
+		wantKind binaryKind
+		wantMIME string
+		wantBody string
+	}{
+		{"image", []any{Image{MIME: "image/png", Data: []byte("png")}}, true, binaryImage, "image/png", "png"},
+		{"audio pointer", []any{&Audio{MIME: "audio/wav", Data: []byte("wav")}}, true, binaryAudio, "audio/wav", "wav"},
+		{"blob without MIME", []any{Blob{Data: []byte("raw")}}, true, binaryBlob, defaultBinaryMIME, "raw"},
+		{"reader", []any{strings.NewReader("stream")}, true, binaryBlob, defaultBinaryMIME, "stream"},
+		{"nil reader", []any{(*bytes.Buffer)(nil)}, false, 0, "", ""},
+		{"nil blob pointer", []any{(*Blob)(nil)}, false, 0, "", ""},
+		{"json value", []any{42}, false, 0, "", ""},
+		{"multiple returns", []any{Blob{Data: []byte("raw")}, 1}, false, 0, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bin, ok := binaryResult(tt.results)
+			require.Equal(t, tt.wantOK, ok)
+			if !ok {
+				return
+			}
+			assert.Equal(t, tt.wantKind, bin.kind)
+			assert.Equal(t, tt.wantMIME, bin.mime)
+			body, err := io.ReadAll(bin.body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantBody, string(body))
+		})
+	}
+}
+
+func TestBinaryMediaType(t *testing.T) {
+	tests := []struct {
+		typ    reflect.Type
+		want   string
+		wantOK bool
+	}{
+		{reflect.TypeOf(Image{}), "image/*", true},
+		{reflect.TypeOf(&Audio{}), "audio/*", true},
+		{reflect.TypeOf(Blob{}), defaultBinaryMIME, true},
+		{reflect.TypeOf((*io.Reader)(nil)).Elem(), defaultBinaryMIME, true},
+		{reflect.TypeOf(&bytes.Buffer{}), defaultBinaryMIME, true},
+		{reflect.TypeOf(""), "", false},
+		{reflect.TypeOf(struct{}{}), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ.String(), func(t *testing.T) {
+			got, ok := binaryMediaType(tt.typ)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func renderChart(ctx context.Context) (Image, error) {
+	return Image{MIME: "image/png", Data: []byte{0x89, 'P', 'N', 'G'}}, nil
+}
+
+func exportCSV(ctx context.Context) (io.Reader, error) {
+	return strings.NewReader("a,b\n1,2\n"), nil
+}
+
+// closeTrackingReader is an io.Reader result that records whether it was
+// closed.
+type closeTrackingReader struct {
+	io.Reader
+	closed atomic.Bool
+}
+
+func (r *closeTrackingReader) Close() error {
+	r.closed.Store(true)
+	return nil
+}
+
+// newReaderApp returns an app with one function, which returns a new
+// closeTrackingReader of "a,b\n" and sends it to readers.
+func newReaderApp(readers chan<- *closeTrackingReader) *App {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	app.RegisterFunc(func(ctx context.Context) (io.Reader, error) {
+		r := &closeTrackingReader{Reader: strings.NewReader("a,b\n")}
+		readers <- r
+		return r, nil
+	}, "exports CSV")
+	return app
+}
+
+// readerResultJSON is the JSON form of the result of newReaderApp.
+const readerResultJSON = `{"mime": "application/octet-stream", "data": "YSxiCg=="}`
+
+func newMediaApp() *App {
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	app.RegisterFunc(renderChart, "renders a chart", WithReturns("PNG chart"))
+	app.RegisterFunc(exportCSV, "exports CSV")
+	return app
+}
+
+func TestBinaryResult_Http(t *testing.T) {
+	app := newMediaApp()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/functions/renderChart", strings.NewReader(`{}`))
+	app.createHttpHandler(app.functions[0])(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+	assert.Equal(t, []byte{0x89, 'P', 'N', 'G'}, rec.Body.Bytes())
+}
+
+func TestBinaryResult_Mcp(t *testing.T) {
+	app := newMediaApp()
+	session := connectMcp(t, app, nil)
+	ctx := context.Background()
+
+	res, err := session.CallTool(ctx, &mcp.CallToolParams{Name: "functions.renderChart"})
+	require.NoError(t, err)
+	require.False(t, res.IsError)
+	img, ok := res.Content[0].(*mcp.ImageContent)
+	require.True(t, ok, "content should be ImageContent, got %T", res.Content[0])
+	assert.Equal(t, "image/png", img.MIMEType)
+	assert.Equal(t, []byte{0x89, 'P', 'N', 'G'}, img.Data)
+
+	res, err = session.CallTool(ctx, &mcp.CallToolParams{Name: "functions.exportCSV"})
+	require.NoError(t, err)
+	require.False(t, res.IsError)
+	embedded, ok := res.Content[0].(*mcp.EmbeddedResource)
+	require.True(t, ok, "content should be EmbeddedResource, got %T", res.Content[0])
+	assert.Equal(t, defaultBinaryMIME, embedded.Resource.MIMEType)
+	assert.Equal(t, []byte("a,b\n1,2\n"), embedded.Resource.Blob)
+}
+
+func TestBinaryResult_OpenAPI(t *testing.T) {
+	app := newMediaApp()
+	spec := app.generateOpenAPISpec()
+
+	paths := spec["paths"].(map[string]any)
+	post := paths["/functions/renderChart"].(map[string]any)["post"].(map[string]any)
+	resp200 := post["responses"].(map[string]any)["200"].(map[string]any)
+	content := resp200["content"].(map[string]any)
+
+	require.Contains(t, content, "image/*")
+	assert.NotContains(t, content, "application/json")
+	schema := content["image/*"].(map[string]any)["schema"].(map[string]any)
+	assert.Equal(t, "string", schema["type"])
+	assert.Equal(t, "binary", schema["format"])
+	assert.Equal(t, "PNG chart", schema["description"])
+}
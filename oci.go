@@ -0,0 +1,542 @@
+package kuniumi
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Media types of OCI and Docker images.
+const (
+	mediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIConfig    = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCILayer     = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeOCILayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar"
+	mediaTypeDockerLayerGzip    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// Image archive formats.
+const (
+	imageFormatOCI    = "oci"            // OCI image layout in a tarball (oci-archive)
+	imageFormatDocker = "docker-archive" // tarball loadable with docker load
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociPlatform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p ociPlatform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// parsePlatform parses a platform such as "linux/amd64" or "linux/arm/v7".
+func parsePlatform(s string) (ociPlatform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return ociPlatform{}, fmt.Errorf("invalid platform %q: expected os/arch[/variant]", s)
+	}
+	p := ociPlatform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// dockerArchiveManifest is an entry of the manifest.json of a docker-archive.
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// imageLayer is a layer blob of an image.
+type imageLayer struct {
+	mediaType string
+	digest    string
+	size      int64
+	// diffID is the digest of the uncompressed layer.
+	diffID string
+	// open returns the content of the blob.
+	open func() (io.ReadCloser, error)
+}
+
+// ociImage is an image being assembled: its config, kept as a generic
+// document so that fields of the base image are preserved, and its layers.
+type ociImage struct {
+	config map[string]any
+	layers []imageLayer
+}
+
+// layerFile is a regular file of a layer.
+type layerFile struct {
+	name string
+	mode int64
+	data []byte
+}
+
+// newFileLayer returns a gzipped layer holding files and their parent directories.
+func newFileLayer(files []layerFile, modTime time.Time) (imageLayer, error) {
+	var raw bytes.Buffer
+	tw := tar.NewWriter(&raw)
+	dirs := map[string]bool{}
+	for _, f := range files {
+		var parents []string
+		for dir := path.Dir(f.name); dir != "." && dir != "/" && !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+			parents = append([]string{dir}, parents...)
+		}
+		for _, dir := range parents {
+			if err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0755, ModTime: modTime,
+			}); err != nil {
+				return imageLayer{}, err
+			}
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg, Name: f.name, Mode: f.mode, Size: int64(len(f.data)), ModTime: modTime,
+		}); err != nil {
+			return imageLayer{}, err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return imageLayer{}, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return imageLayer{}, err
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(raw.Bytes()); err != nil {
+		return imageLayer{}, err
+	}
+	if err := zw.Close(); err != nil {
+		return imageLayer{}, err
+	}
+
+	blob := compressed.Bytes()
+	return imageLayer{
+		mediaType: mediaTypeOCILayerGzip,
+		digest:    sha256Digest(blob),
+		size:      int64(len(blob)),
+		diffID:    sha256Digest(raw.Bytes()),
+		open: func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(blob)), nil
+		},
+	}, nil
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// blobPath returns the path of a blob in an OCI image layout.
+func blobPath(digest string) string {
+	return "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+// openTarEntry returns the content of the named entry of a tarball.
+func openTarEntry(tarball, name string) (io.ReadCloser, error) {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(bufio.NewReader(f))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			f.Close()
+			if err == io.EOF {
+				return nil, fmt.Errorf("%s: %s not found", tarball, name)
+			}
+			return nil, fmt.Errorf("%s: %w", tarball, err)
+		}
+		if path.Clean(strings.TrimPrefix(hdr.Name, "./")) == name {
+			return struct {
+				io.Reader
+				io.Closer
+			}{tr, f}, nil
+		}
+	}
+}
+
+// readTarJSON decodes the named JSON entry of a tarball into v.
+func readTarJSON(tarball, name string, v any) error {
+	r, err := openTarEntry(tarball, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		return fmt.Errorf("%s: invalid %s: %w", tarball, name, err)
+	}
+	return nil
+}
+
+// readImageArchive reads the image for platform from an oci-archive or a
+// docker-archive tarball (e.g. the output of docker save).
+func readImageArchive(tarball string, platform ociPlatform) (*ociImage, error) {
+	var manifests []dockerArchiveManifest
+	err := readTarJSON(tarball, "manifest.json", &manifests)
+	if err == nil && len(manifests) > 0 {
+		return readDockerArchive(tarball, manifests[0])
+	}
+
+	var index ociIndex
+	if err := readTarJSON(tarball, "index.json", &index); err != nil {
+		return nil, fmt.Errorf("%s: not a docker-archive or oci-archive", tarball)
+	}
+	desc, err := selectManifest(tarball, index, platform)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ociManifest
+	if err := readTarJSON(tarball, blobPath(desc.Digest), &manifest); err != nil {
+		return nil, err
+	}
+
+	img := &ociImage{}
+	if err := readTarJSON(tarball, blobPath(manifest.Config.Digest), &img.config); err != nil {
+		return nil, err
+	}
+	for _, l := range manifest.Layers {
+		mediaType := l.MediaType
+		switch mediaType {
+		case mediaTypeDockerLayer:
+			mediaType = mediaTypeOCILayer
+		case mediaTypeDockerLayerGzip:
+			mediaType = mediaTypeOCILayerGzip
+		}
+		name := blobPath(l.Digest)
+		img.layers = append(img.layers, imageLayer{
+			mediaType: mediaType,
+			digest:    l.Digest,
+			size:      l.Size,
+			open:      func() (io.ReadCloser, error) { return openTarEntry(tarball, name) },
+		})
+	}
+	return img, nil
+}
+
+// selectManifest returns the manifest for platform, descending into nested
+// indexes (multi-platform images).
+func selectManifest(tarball string, index ociIndex, platform ociPlatform) (ociDescriptor, error) {
+	for _, desc := range index.Manifests {
+		switch desc.MediaType {
+		case mediaTypeOCIIndex, mediaTypeDockerManifestList:
+			var nested ociIndex
+			if err := readTarJSON(tarball, blobPath(desc.Digest), &nested); err != nil {
+				return ociDescriptor{}, err
+			}
+			if m, err := selectManifest(tarball, nested, platform); err == nil {
+				return m, nil
+			}
+		default:
+			if desc.Platform == nil || platformMatches(*desc.Platform, platform) {
+				return desc, nil
+			}
+		}
+	}
+	return ociDescriptor{}, fmt.Errorf("%s: no image for platform %s", tarball, platform)
+}
+
+// platformMatches reports whether p satisfies want; the zero platform
+// matches any platform.
+func platformMatches(p, want ociPlatform) bool {
+	if want.OS == "" {
+		return true
+	}
+	return p.OS == want.OS && p.Architecture == want.Architecture &&
+		(want.Variant == "" || p.Variant == "" || p.Variant == want.Variant)
+}
+
+// readDockerArchive reads the image described by manifest from a docker-archive.
+// Layers are hashed here, since docker-archive does not record their digests.
+func readDockerArchive(tarball string, manifest dockerArchiveManifest) (*ociImage, error) {
+	img := &ociImage{}
+	if err := readTarJSON(tarball, path.Clean(manifest.Config), &img.config); err != nil {
+		return nil, err
+	}
+	for _, name := range manifest.Layers {
+		name := path.Clean(name)
+		r, err := openTarEntry(tarball, name)
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		br := bufio.NewReader(r)
+		magic, _ := br.Peek(2)
+		mediaType := mediaTypeOCILayer
+		if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+			mediaType = mediaTypeOCILayerGzip
+		}
+		size, err := io.Copy(h, br)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", tarball, name, err)
+		}
+		img.layers = append(img.layers, imageLayer{
+			mediaType: mediaType,
+			digest:    "sha256:" + hex.EncodeToString(h.Sum(nil)),
+			size:      size,
+			open:      func() (io.ReadCloser, error) { return openTarEntry(tarball, name) },
+		})
+	}
+	return img, nil
+}
+
+// platform returns the platform of the image config.
+func (img *ociImage) platform() ociPlatform {
+	p := ociPlatform{}
+	p.OS, _ = img.config["os"].(string)
+	p.Architecture, _ = img.config["architecture"].(string)
+	p.Variant, _ = img.config["variant"].(string)
+	return p
+}
+
+// runConfig returns the "config" object of the image config (execution
+// parameters), creating it if needed.
+func (img *ociImage) runConfig() map[string]any {
+	cfg, ok := img.config["config"].(map[string]any)
+	if !ok {
+		cfg = map[string]any{}
+		img.config["config"] = cfg
+	}
+	return cfg
+}
+
+// addLayer appends layer to the image and records it in the config.
+func (img *ociImage) addLayer(layer imageLayer, createdBy string, created time.Time) {
+	rootfs, ok := img.config["rootfs"].(map[string]any)
+	if !ok {
+		rootfs = map[string]any{"type": "layers"}
+		img.config["rootfs"] = rootfs
+	}
+	diffIDs, _ := rootfs["diff_ids"].([]any)
+	rootfs["diff_ids"] = append(diffIDs, layer.diffID)
+
+	history, _ := img.config["history"].([]any)
+	img.config["history"] = append(history, map[string]any{
+		"created":    created.Format(time.RFC3339),
+		"created_by": createdBy,
+	})
+	img.layers = append(img.layers, layer)
+}
+
+// blobWriter writes the blobs of an archive once each.
+type blobWriter struct {
+	tw      *tar.Writer
+	modTime time.Time
+	written map[string]bool
+}
+
+func (b *blobWriter) writeFile(name string, size int64, r io.Reader) error {
+	if b.written[name] {
+		return nil
+	}
+	b.written[name] = true
+	if err := b.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: size, ModTime: b.modTime,
+	}); err != nil {
+		return err
+	}
+	_, err := io.Copy(b.tw, r)
+	return err
+}
+
+func (b *blobWriter) writeBytes(name string, data []byte) error {
+	return b.writeFile(name, int64(len(data)), bytes.NewReader(data))
+}
+
+func (b *blobWriter) writeLayer(name string, layer imageLayer) error {
+	r, err := layer.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return b.writeFile(name, layer.size, r)
+}
+
+// writeImageArchive writes images to w in the given format, tagged with ref
+// (e.g. "my-app:1.0") if not empty. Several images, one per platform, make
+// a multi-platform image (oci format only).
+func writeImageArchive(w io.Writer, images []*ociImage, format, ref string, modTime time.Time) error {
+	tw := tar.NewWriter(w)
+	b := &blobWriter{tw: tw, modTime: modTime, written: map[string]bool{}}
+
+	var err error
+	switch {
+	case len(images) == 0:
+		err = fmt.Errorf("no image to write")
+	case format == imageFormatOCI:
+		err = writeOCILayout(b, images, ref)
+	case format == imageFormatDocker && len(images) == 1:
+		err = writeDockerArchive(b, images[0], ref)
+	case format == imageFormatDocker:
+		err = fmt.Errorf("%s holds a single platform", imageFormatDocker)
+	default:
+		err = fmt.Errorf("invalid image format %q: must be %s or %s", format, imageFormatOCI, imageFormatDocker)
+	}
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeOCIManifest writes the blobs of img and returns the descriptor of its manifest.
+func writeOCIManifest(b *blobWriter, img *ociImage) (ociDescriptor, error) {
+	config, err := json.Marshal(img.config)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIManifest,
+		Config:        ociDescriptor{MediaType: mediaTypeOCIConfig, Digest: sha256Digest(config), Size: int64(len(config))},
+	}
+	for _, layer := range img.layers {
+		if err := b.writeLayer(blobPath(layer.digest), layer); err != nil {
+			return ociDescriptor{}, err
+		}
+		manifest.Layers = append(manifest.Layers, ociDescriptor{MediaType: layer.mediaType, Digest: layer.digest, Size: layer.size})
+	}
+	if err := b.writeBytes(blobPath(manifest.Config.Digest), config); err != nil {
+		return ociDescriptor{}, err
+	}
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	if err := b.writeBytes(blobPath(sha256Digest(manifestData)), manifestData); err != nil {
+		return ociDescriptor{}, err
+	}
+
+	platform := img.platform()
+	return ociDescriptor{
+		MediaType: mediaTypeOCIManifest,
+		Digest:    sha256Digest(manifestData),
+		Size:      int64(len(manifestData)),
+		Platform:  &platform,
+	}, nil
+}
+
+func writeOCILayout(b *blobWriter, images []*ociImage, ref string) error {
+	var manifests []ociDescriptor
+	for _, img := range images {
+		desc, err := writeOCIManifest(b, img)
+		if err != nil {
+			return err
+		}
+		manifests = append(manifests, desc)
+	}
+
+	// The image is the manifest, or the index of the manifests of each platform
+	desc := manifests[0]
+	if len(manifests) > 1 {
+		data, err := json.Marshal(ociIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex, Manifests: manifests})
+		if err != nil {
+			return err
+		}
+		if err := b.writeBytes(blobPath(sha256Digest(data)), data); err != nil {
+			return err
+		}
+		desc = ociDescriptor{MediaType: mediaTypeOCIIndex, Digest: sha256Digest(data), Size: int64(len(data))}
+	}
+	if ref != "" {
+		desc.Annotations = map[string]string{
+			"io.containerd.image.name":          ref,
+			"org.opencontainers.image.ref.name": imageTag(ref),
+		}
+	}
+
+	index, err := json.Marshal(ociIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex, Manifests: []ociDescriptor{desc}})
+	if err != nil {
+		return err
+	}
+	if err := b.writeBytes("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+	return b.writeBytes("index.json", index)
+}
+
+func writeDockerArchive(b *blobWriter, img *ociImage, ref string) error {
+	config, err := json.Marshal(img.config)
+	if err != nil {
+		return err
+	}
+	configName := strings.TrimPrefix(sha256Digest(config), "sha256:") + ".json"
+	manifest := dockerArchiveManifest{Config: configName}
+	if ref != "" {
+		manifest.RepoTags = []string{ref}
+		if imageTag(ref) == "" {
+			manifest.RepoTags[0] += ":latest"
+		}
+	}
+	for _, layer := range img.layers {
+		name := strings.TrimPrefix(layer.digest, "sha256:") + "/layer.tar"
+		if err := b.writeLayer(name, layer); err != nil {
+			return err
+		}
+		manifest.Layers = append(manifest.Layers, name)
+	}
+	if err := b.writeBytes(configName, config); err != nil {
+		return err
+	}
+	data, err := json.Marshal([]dockerArchiveManifest{manifest})
+	if err != nil {
+		return err
+	}
+	return b.writeBytes("manifest.json", data)
+}
+
+// imageTag returns the tag of an image reference, or "" if it has none.
+func imageTag(ref string) string {
+	ref, _, _ = strings.Cut(ref, "@")
+	name := ref[strings.LastIndex(ref, "/")+1:]
+	if _, tag, ok := strings.Cut(name, ":"); ok {
+		return tag
+	}
+	return ""
+}
@@ -0,0 +1,237 @@
+package kuniumi
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var ociTestTime = time.Date(2026, 1, 15, 10, 30, 0, 0, time.UTC)
+
+// newTestImage returns an image holding a fake app binary, configured like
+// the oci builder does.
+func newTestImage(t *testing.T, base *ociImage) *ociImage {
+	t.Helper()
+	img := base
+	if img == nil {
+		img = &ociImage{config: map[string]any{}}
+	}
+	layer, err := newFileLayer([]layerFile{{name: "app/app", mode: 0755, data: []byte("binary")}}, ociTestTime)
+	require.NoError(t, err)
+	img.addLayer(layer, "kuniumi containerize", ociTestTime)
+	configureImage(img, defaultDockerfileOptions(), ociPlatform{OS: "linux", Architecture: "arm64"}, ociTestTime)
+	return img
+}
+
+// writeTestArchive writes img to a tarball in format and returns its path.
+func writeTestArchive(t *testing.T, img *ociImage, format string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "image.tar")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, writeImageArchive(f, []*ociImage{img}, format, "registry.example.com/app:1.0", ociTestTime))
+	require.NoError(t, f.Close())
+	return path
+}
+
+// layerFiles returns the regular files of a layer blob.
+func layerFiles(t *testing.T, layer imageLayer) map[string]string {
+	t.Helper()
+	r, err := layer.open()
+	require.NoError(t, err)
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, layer.digest, sha256Digest(data))
+
+	if layer.mediaType == mediaTypeOCILayerGzip {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		data, err = io.ReadAll(zr)
+		require.NoError(t, err)
+	}
+	files := map[string]string{}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if hdr.Typeflag == tar.TypeReg {
+			content, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			files[hdr.Name] = string(content)
+		}
+	}
+	return files
+}
+
+func TestImageArchive_RoundTrip(t *testing.T) {
+	arm64 := ociPlatform{OS: "linux", Architecture: "arm64"}
+
+	for _, format := range []string{imageFormatOCI, imageFormatDocker} {
+		t.Run(format, func(t *testing.T) {
+			img := newTestImage(t, nil)
+			path := writeTestArchive(t, img, format)
+
+			read, err := readImageArchive(path, arm64)
+			require.NoError(t, err)
+			assert.Equal(t, arm64, read.platform())
+			require.Len(t, read.layers, 1)
+			assert.Equal(t, img.layers[0].digest, read.layers[0].digest)
+			assert.Equal(t, mediaTypeOCILayerGzip, read.layers[0].mediaType)
+			assert.Equal(t, map[string]string{"app/app": "binary"}, layerFiles(t, read.layers[0]))
+
+			cfg := read.runConfig()
+			assert.Equal(t, []any{"/app/app"}, cfg["Entrypoint"])
+			assert.Equal(t, []any{"serve", "--port", "8080"}, cfg["Cmd"])
+			assert.Equal(t, "65532:65532", cfg["User"])
+			assert.Equal(t, map[string]any{"8080/tcp": map[string]any{}}, cfg["ExposedPorts"])
+			assert.Equal(t, []any{"CMD", "/app/app", "healthcheck", "--port", "8080"},
+				cfg["Healthcheck"].(map[string]any)["Test"], "exec form, which needs no shell")
+			assert.Equal(t, []any{img.layers[0].diffID}, read.config["rootfs"].(map[string]any)["diff_ids"])
+		})
+	}
+}
+
+func TestImageArchive_OnBase(t *testing.T) {
+	basePath := writeTestArchive(t, newTestImage(t, nil), imageFormatDocker)
+	base, err := readImageArchive(basePath, ociPlatform{OS: "linux", Architecture: "arm64"})
+	require.NoError(t, err)
+	base.runConfig()["Env"] = []any{"PATH=/bin"}
+
+	img := newTestImage(t, base)
+	read, err := readImageArchive(writeTestArchive(t, img, imageFormatOCI), ociPlatform{OS: "linux", Architecture: "arm64"})
+	require.NoError(t, err)
+
+	require.Len(t, read.layers, 2)
+	assert.Len(t, read.config["rootfs"].(map[string]any)["diff_ids"], 2)
+	assert.Len(t, read.config["history"], 2)
+	cfg := read.runConfig()
+	assert.Equal(t, []any{"PATH=/bin"}, cfg["Env"], "fields of the base config are kept")
+	assert.Contains(t, cfg, "Healthcheck")
+}
+
+func TestImageArchive_OCIIndex(t *testing.T) {
+	path := writeTestArchive(t, newTestImage(t, nil), imageFormatOCI)
+	entries := readTarEntries(t, path)
+
+	var index ociIndex
+	require.NoError(t, json.Unmarshal(entries["index.json"], &index))
+	require.Len(t, index.Manifests, 1)
+	desc := index.Manifests[0]
+	assert.Equal(t, mediaTypeOCIManifest, desc.MediaType)
+	assert.Equal(t, "registry.example.com/app:1.0", desc.Annotations["io.containerd.image.name"])
+	assert.Equal(t, "1.0", desc.Annotations["org.opencontainers.image.ref.name"])
+	assert.Equal(t, desc.Digest, sha256Digest(entries[blobPath(desc.Digest)]))
+	assert.Contains(t, entries, "oci-layout")
+
+	// A multi-platform index referring to the image for arm64 only
+	nested, err := json.Marshal(ociIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex, Manifests: []ociDescriptor{desc}})
+	require.NoError(t, err)
+	entries[blobPath(sha256Digest(nested))] = nested
+	entries["index.json"], err = json.Marshal(ociIndex{SchemaVersion: 2, Manifests: []ociDescriptor{
+		{MediaType: mediaTypeOCIIndex, Digest: sha256Digest(nested), Size: int64(len(nested))},
+	}})
+	require.NoError(t, err)
+	multi := writeTarEntries(t, entries)
+
+	_, err = readImageArchive(multi, ociPlatform{OS: "linux", Architecture: "arm64"})
+	assert.NoError(t, err)
+	_, err = readImageArchive(multi, ociPlatform{OS: "linux", Architecture: "amd64"})
+	assert.ErrorContains(t, err, "no image for platform linux/amd64")
+}
+
+func TestReadImageArchive_Invalid(t *testing.T) {
+	_, err := readImageArchive(writeTarEntries(t, map[string][]byte{"hello.txt": []byte("hi")}), ociPlatform{OS: "linux", Architecture: "amd64"})
+	assert.ErrorContains(t, err, "not a docker-archive or oci-archive")
+}
+
+func readTarEntries(t *testing.T, path string) map[string][]byte {
+	t.Helper()
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	entries := map[string][]byte{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		require.NoError(t, err)
+		entries[hdr.Name], err = io.ReadAll(tr)
+		require.NoError(t, err)
+	}
+}
+
+func writeTarEntries(t *testing.T, entries map[string][]byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "archive.tar")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	tw := tar.NewWriter(f)
+	for name, data := range entries {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}))
+		_, err := tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, f.Close())
+	return path
+}
+
+func TestParsePlatform(t *testing.T) {
+	p, err := parsePlatform("linux/arm/v7")
+	require.NoError(t, err)
+	assert.Equal(t, ociPlatform{OS: "linux", Architecture: "arm", Variant: "v7"}, p)
+	assert.Equal(t, "linux/arm/v7", p.String())
+
+	for _, s := range []string{"linux", "linux/", "/amd64", "linux/arm/v7/x"} {
+		_, err := parsePlatform(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestImageTag(t *testing.T) {
+	assert.Equal(t, "1.0", imageTag("registry.example.com:5000/app:1.0"))
+	assert.Equal(t, "", imageTag("registry.example.com:5000/app"))
+	assert.Equal(t, "", imageTag("app@sha256:abc"))
+}
+
+func TestImageArchive_MultiPlatform(t *testing.T) {
+	amd64 := newTestImage(t, nil)
+	configureImage(amd64, defaultDockerfileOptions(), ociPlatform{OS: "linux", Architecture: "amd64"}, ociTestTime)
+	arm64 := newTestImage(t, nil)
+
+	path := filepath.Join(t.TempDir(), "image.tar")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, writeImageArchive(f, []*ociImage{amd64, arm64}, imageFormatOCI, "app:1.0", ociTestTime))
+	require.NoError(t, f.Close())
+
+	var index ociIndex
+	require.NoError(t, json.Unmarshal(readTarEntries(t, path)["index.json"], &index))
+	require.Len(t, index.Manifests, 1)
+	assert.Equal(t, mediaTypeOCIIndex, index.Manifests[0].MediaType)
+	assert.Equal(t, "app:1.0", index.Manifests[0].Annotations["io.containerd.image.name"])
+
+	for _, arch := range []string{"amd64", "arm64"} {
+		img, err := readImageArchive(path, ociPlatform{OS: "linux", Architecture: arch})
+		require.NoError(t, err)
+		assert.Equal(t, arch, img.platform().Architecture)
+	}
+
+	var buf bytes.Buffer
+	assert.Error(t, writeImageArchive(&buf, []*ociImage{amd64, arm64}, imageFormatDocker, "app:1.0", ociTestTime))
+}
@@ -31,39 +31,52 @@ func (a *App) generateOpenAPISpec() map[string]any {
 						},
 					},
 				},
-			"responses": map[string]any{
-				"200": func() map[string]any {
-					responseDef := map[string]any{
-						"description": "Successful execution",
-					}
-					outputSchema := GenerateOutputJSONSchema(fn.Meta)
-					if outputSchema != nil {
-						responseDef["content"] = map[string]any{
+				"responses": map[string]any{
+					"200": func() map[string]any {
+						responseDef := map[string]any{
+							"description": "Successful execution",
+						}
+						if len(fn.Meta.Returns) == 1 {
+							// Binary results are sent as the raw response body
+							if mediaType, ok := binaryMediaType(fn.Meta.Returns[0].Type); ok {
+								schema := typeToSchema(fn.Meta.Returns[0].Type)
+								if fn.Meta.Returns[0].Description != "" {
+									schema["description"] = fn.Meta.Returns[0].Description
+								}
+								responseDef["content"] = map[string]any{
+									mediaType: map[string]any{"schema": schema},
+								}
+								return responseDef
+							}
+						}
+						outputSchema := GenerateOutputJSONSchema(fn.Meta)
+						if outputSchema != nil {
+							responseDef["content"] = map[string]any{
+								"application/json": map[string]any{
+									"schema": outputSchema,
+								},
+							}
+						}
+						return responseDef
+					}(),
+					"400": map[string]any{
+						"description": "Invalid request",
+						"content": map[string]any{
 							"application/json": map[string]any{
-								"schema": outputSchema,
+								"schema": errorResponseSchema(),
 							},
-						}
-					}
-					return responseDef
-				}(),
-				"400": map[string]any{
-					"description": "Invalid request",
-					"content": map[string]any{
-						"application/json": map[string]any{
-							"schema": errorResponseSchema(),
 						},
 					},
-				},
-				"500": map[string]any{
-					"description": "Internal server error",
-					"content": map[string]any{
-						"application/json": map[string]any{
-							"schema": errorResponseSchema(),
+					"500": map[string]any{
+						"description": "Internal server error",
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": errorResponseSchema(),
+							},
 						},
 					},
 				},
 			},
-			},
 		}
 	}
 
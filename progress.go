@@ -0,0 +1,40 @@
+package kuniumi
+
+import (
+	"context"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// ReportProgress reports the progress of a long-running function to its caller.
+//
+// Under the mcp adapter, it sends a `notifications/progress` message to the client
+// when the client supplied a progress token with the tool call. Under every other
+// adapter (serve, cgi), or when no progress token was supplied, it is a no-op.
+//
+// Arguments:
+//   - done: The progress thus far. It should increase with every call.
+//   - total: The total amount of work, or 0 if unknown.
+//   - msg: An optional human-readable status message.
+//
+// Example:
+//
+//	for i, item := range items {
+//		if err := ctx.Err(); err != nil {
+//			return err // the caller cancelled the request
+//		}
+//		process(item)
+//		kuniumi.ReportProgress(ctx, float64(i+1), float64(len(items)), "processing")
+//	}
+func ReportProgress(ctx context.Context, done, total float64, msg string) error {
+	call := getMcpCall(ctx)
+	if call == nil || call.progressToken == nil {
+		return nil
+	}
+	return call.session.NotifyProgress(ctx, &mcp.ProgressNotificationParams{
+		ProgressToken: call.progressToken,
+		Progress:      done,
+		Total:         total,
+		Message:       msg,
+	})
+}
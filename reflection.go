@@ -2,6 +2,7 @@ package kuniumi
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"strconv"
@@ -71,6 +72,8 @@ func AnalyzeFunction(fn interface{}, name, desc string) (*FunctionMetadata, erro
 }
 
 // CallFunction invokes the function with a map of arguments.
+// The context is passed to the function unchanged; if it is already cancelled,
+// the function is not invoked and the context error is returned.
 func CallFunction(ctx context.Context, meta *FunctionMetadata, args map[string]interface{}) ([]interface{}, error) {
 	in := []reflect.Value{reflect.ValueOf(ctx)}
 
@@ -103,21 +106,26 @@ func CallFunction(ctx context.Context, meta *FunctionMetadata, args map[string]i
 				case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 					in = append(in, reflect.ValueOf(uint64(targetVal.Float())).Convert(targetType))
 				default:
-					return nil, fmt.Errorf("cannot convert %v to %v", targetVal.Type(), targetType)
+					return nil, &argError{fmt.Errorf("cannot convert %v to %v", targetVal.Type(), targetType)}
 				}
 			} else if targetVal.Kind() == reflect.String {
 				// String to numeric/bool conversion using strconv
 				converted, err := convertStringToType(targetVal.String(), targetType)
 				if err != nil {
-					return nil, fmt.Errorf("cannot convert string %q to %v: %w", targetVal.String(), targetType, err)
+					return nil, &argError{fmt.Errorf("cannot convert string %q to %v: %w", targetVal.String(), targetType, err)}
 				}
 				in = append(in, converted)
 			} else {
-				return nil, fmt.Errorf("cannot convert %v to %v", targetVal.Type(), targetType)
+				return nil, &argError{fmt.Errorf("cannot convert %v to %v", targetVal.Type(), targetType)}
 			}
 		}
 	}
 
+	// Do not start work the caller has already abandoned
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	// Invoke the function
 	out := meta.FnValue.Call(in)
 
@@ -136,6 +144,21 @@ func CallFunction(ctx context.Context, meta *FunctionMetadata, args map[string]i
 	return results, nil
 }
 
+// argError is returned by CallFunction when an argument cannot be converted
+// to its parameter type, as opposed to errors returned by the function itself.
+type argError struct {
+	err error
+}
+
+func (e *argError) Error() string { return e.err.Error() }
+func (e *argError) Unwrap() error { return e.err }
+
+// isArgError reports whether err was caused by invalid arguments.
+func isArgError(err error) bool {
+	var ae *argError
+	return errors.As(err, &ae)
+}
+
 // GenerateJSONSchema generates a JSON Schema for the function arguments.
 func GenerateJSONSchema(meta *FunctionMetadata) map[string]interface{} {
 	properties := make(map[string]interface{})
@@ -193,6 +216,9 @@ func GenerateOutputJSONSchema(meta *FunctionMetadata) map[string]interface{} {
 
 // typeToSchema converts a Go reflect.Type to a JSON Schema definition.
 func typeToSchema(t reflect.Type) map[string]interface{} {
+	if _, ok := binaryMediaType(t); ok {
+		return map[string]interface{}{"type": "string", "format": "binary"}
+	}
 	switch t.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
 		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
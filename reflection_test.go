@@ -109,6 +109,22 @@ func TestCallFunction_StringArgs(t *testing.T) {
 	}
 }
 
+func TestCallFunction_CancelledContext(t *testing.T) {
+	called := false
+	meta, err := AnalyzeFunction(func(ctx context.Context) error {
+		called = true
+		return nil
+	}, "noop", "test noop")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = CallFunction(ctx, meta, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, called, "function should not run with a cancelled context")
+}
+
 // Test helper functions for GenerateOutputJSONSchema
 func singleReturnFunc(ctx context.Context, x int) (string, error) { return "", nil }
 func multiReturnFunc(ctx context.Context) (int, string, error)    { return 0, "", nil }
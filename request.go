@@ -0,0 +1,59 @@
+package kuniumi
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// RequestInfo describes the HTTP request that triggered a function call.
+// It is available under the serve and cgi adapters via GetRequestInfo.
+type RequestInfo struct {
+	// Method is the HTTP method (e.g. "POST").
+	Method string
+	// Path is the request path, e.g. "/functions/Add" or, under cgi, SCRIPT_NAME + PATH_INFO.
+	Path string
+	// Query holds the parsed query string.
+	Query url.Values
+	// Header holds the request headers. Under cgi they are built from the HTTP_* variables
+	// and CONTENT_TYPE.
+	Header http.Header
+	// Host is the requested host name, if known.
+	Host string
+	// RemoteAddr is the address of the client ("host:port" under serve, REMOTE_ADDR under cgi).
+	RemoteAddr string
+	// ScriptName is the CGI SCRIPT_NAME. It is empty under serve.
+	ScriptName string
+	// PathInfo is the CGI PATH_INFO. It is empty under serve.
+	PathInfo string
+}
+
+// requestInfoKey is the context key for RequestInfo.
+type requestInfoKey struct{}
+
+// GetRequestInfo retrieves the metadata of the HTTP request that triggered the
+// current function call. It returns nil under adapters that are not driven by
+// an HTTP request, such as mcp.
+func GetRequestInfo(ctx context.Context) *RequestInfo {
+	if v, ok := ctx.Value(requestInfoKey{}).(*RequestInfo); ok {
+		return v
+	}
+	return nil
+}
+
+// withRequestInfo adds the request metadata to the context.
+func withRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// newRequestInfo builds RequestInfo from an http.Request.
+func newRequestInfo(r *http.Request) *RequestInfo {
+	return &RequestInfo{
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Query:      r.URL.Query(),
+		Header:     r.Header.Clone(),
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+	}
+}
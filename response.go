@@ -3,6 +3,7 @@ package kuniumi
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 )
 
@@ -35,6 +36,14 @@ func writeJSONError(w http.ResponseWriter, msg string, statusCode int) {
 	json.NewEncoder(w).Encode(buildErrorResponse(msg))
 }
 
+// writeBinaryResponse streams a binary function result as the raw response body.
+func writeBinaryResponse(w http.ResponseWriter, bin *binaryValue) {
+	defer bin.Close()
+	w.Header().Set("Content-Type", bin.mime)
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, bin.body)
+}
+
 // errorResponseSchema returns the OpenAPI schema definition for error responses.
 func errorResponseSchema() map[string]any {
 	return map[string]any{
@@ -0,0 +1,265 @@
+package kuniumi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// envScope controls how long the changes a call makes to its
+// VirtualEnvironment, such as the current directory, last.
+type envScope string
+
+const (
+	// envScopeInvocation gives every call its own copy of the environment.
+	envScopeInvocation envScope = "invocation"
+	// envScopeSession shares a copy between the calls of a session.
+	envScopeSession envScope = "session"
+)
+
+// defaultSessionHeader is the HTTP header identifying the session of a request.
+const defaultSessionHeader = "X-Session-Id"
+
+// parseEnvScope validates the value of the --env-scope flag.
+func parseEnvScope(s string) (envScope, error) {
+	switch scope := envScope(s); scope {
+	case envScopeInvocation, envScopeSession:
+		return scope, nil
+	default:
+		return "", fmt.Errorf("invalid env scope %q (expected invocation or session)", s)
+	}
+}
+
+// defaultMaxSessions is the default limit of live sessions.
+const defaultMaxSessions = 1000
+
+// Errors of session lookups.
+var (
+	errSessionNotFound = errors.New("session not found")
+	errTooManySessions = errors.New("too many sessions")
+)
+
+// addEnvScopeFlags adds the flags read by setupEnvScope to cmd.
+func addEnvScopeFlags(cmd *cobra.Command) {
+	cmd.Flags().String("env-scope", string(envScopeInvocation),
+		"Lifetime of the Virtual Environment state (current directory) of a call: invocation or session")
+	cmd.Flags().Duration("session-ttl", 30*time.Minute,
+		"With --env-scope session, forget sessions idle for this long (0 keeps them until they end)")
+	cmd.Flags().Int("max-sessions", defaultMaxSessions,
+		"With --env-scope session, the maximum number of live sessions (0 for no limit)")
+}
+
+// setupEnvScope enables session-scoped environments if cmd has
+// --env-scope session. Idle sessions are expired until the context of cmd
+// is done.
+func (a *App) setupEnvScope(cmd *cobra.Command) error {
+	scopeFlag, _ := cmd.Flags().GetString("env-scope")
+	scope, err := parseEnvScope(scopeFlag)
+	if err != nil {
+		return err
+	}
+	ttl, _ := cmd.Flags().GetDuration("session-ttl")
+	maxSessions, _ := cmd.Flags().GetInt("max-sessions")
+
+	a.sessions = nil
+	if scope == envScopeSession {
+		a.sessions = newEnvSessions(ttl, maxSessions)
+		go a.sessions.run(cmd.Context())
+	}
+	return nil
+}
+
+// callEnv returns the VirtualEnvironment of a call derived from base: the
+// environment of the session key when environments are session-scoped and
+// key is not nil, or a clone of base otherwise. It returns
+// errSessionNotFound for sessions that were not started or have ended.
+func (a *App) callEnv(base *VirtualEnvironment, key any) (*VirtualEnvironment, error) {
+	if a.sessions != nil && key != nil {
+		return a.sessions.env(key, base)
+	}
+	return base.Clone(), nil
+}
+
+// envSessions keeps the VirtualEnvironment of each session, so that the
+// calls of a session see the current directory set by previous calls.
+// Sessions end when they are idle for longer than ttl, or when they are
+// ended explicitly (e.g. on DELETE /session, or when an MCP session is
+// closed). At most max sessions are live at a time.
+type envSessions struct {
+	ttl time.Duration
+	max int // 0 for no limit
+	now func() time.Time
+
+	mu       sync.Mutex
+	sessions map[any]*envSession
+}
+
+// envSession is the state of a session.
+type envSession struct {
+	base     *VirtualEnvironment // Environment env was cloned from
+	env      *VirtualEnvironment
+	lastUsed time.Time
+}
+
+func newEnvSessions(ttl time.Duration, maxSessions int) *envSessions {
+	return &envSessions{
+		ttl:      ttl,
+		max:      maxSessions,
+		now:      time.Now,
+		sessions: make(map[any]*envSession),
+	}
+}
+
+// start starts the session key with a clone of base, unless it is live
+// already. It returns errTooManySessions if max sessions are live.
+func (s *envSessions) start(key any, base *VirtualEnvironment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if s.liveLocked(key, now) != nil {
+		return nil
+	}
+	if s.max > 0 && len(s.sessions) >= s.max {
+		s.expireLocked(now)
+		if len(s.sessions) >= s.max {
+			return errTooManySessions
+		}
+	}
+	s.sessions[key] = &envSession{base: base, env: base.Clone(), lastUsed: now}
+	return nil
+}
+
+// env returns the environment of the session key, or errSessionNotFound.
+// If base changed since the session started (e.g. MCP client roots were
+// mounted again), the session moves to a clone of the new base, keeping
+// its current directory.
+func (s *envSessions) env(key any, base *VirtualEnvironment) (*VirtualEnvironment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	st := s.liveLocked(key, now)
+	if st == nil {
+		return nil, errSessionNotFound
+	}
+	if st.base != base {
+		env := base.Clone()
+		env.cwd = st.env.GetCurrentDirectory()
+		st.base, st.env = base, env
+	}
+	st.lastUsed = now
+	return st.env, nil
+}
+
+// end forgets the session key. It reports whether the session was live.
+func (s *envSessions) end(key any) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.liveLocked(key, s.now())
+	delete(s.sessions, key)
+	return st != nil
+}
+
+// liveLocked returns the session key, or nil if it does not exist or has
+// expired, forgetting it then. The caller holds s.mu.
+func (s *envSessions) liveLocked(key any, now time.Time) *envSession {
+	st, ok := s.sessions[key]
+	if !ok {
+		return nil
+	}
+	if s.expired(st, now) {
+		delete(s.sessions, key)
+		return nil
+	}
+	return st
+}
+
+func (s *envSessions) expired(st *envSession, now time.Time) bool {
+	return s.ttl > 0 && now.Sub(st.lastUsed) > s.ttl
+}
+
+// expireLocked forgets the idle sessions. The caller holds s.mu.
+func (s *envSessions) expireLocked(now time.Time) {
+	for key, st := range s.sessions {
+		if s.expired(st, now) {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+// run forgets idle sessions periodically until ctx is done, so that they
+// do not hold memory until they are looked up again.
+func (s *envSessions) run(ctx context.Context) {
+	if s.ttl <= 0 {
+		return
+	}
+	ticker := time.NewTicker(max(s.ttl/2, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			s.expireLocked(s.now())
+			s.mu.Unlock()
+		}
+	}
+}
+
+// httpSessionKey is the key of the session of an HTTP request, the value
+// of its session header.
+type httpSessionKey string
+
+// httpSession returns the session key of r, or nil if r has no session.
+func (a *App) httpSession(r *http.Request) any {
+	if a.sessions == nil {
+		return nil
+	}
+	if id := r.Header.Get(a.sessionHeader); id != "" {
+		return httpSessionKey(id)
+	}
+	return nil
+}
+
+// startHttpSession serves POST /session, which starts a session and
+// returns its ID in the session header (and the JSON body). IDs are
+// random, so that clients cannot pick, or guess, the session of others.
+func (a *App) startHttpSession(w http.ResponseWriter, r *http.Request) {
+	base := a.env
+	if base == nil {
+		base = NewVirtualEnvironment(nil, nil)
+	}
+	id := rand.Text()
+	if err := a.sessions.start(httpSessionKey(id), base); err != nil {
+		writeJSONError(w, "Too many sessions", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set(a.sessionHeader, id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"session_id": id})
+}
+
+// endHttpSession serves DELETE /session, which ends the session of the
+// request before its ttl.
+func (a *App) endHttpSession(w http.ResponseWriter, r *http.Request) {
+	key := a.httpSession(r)
+	if key == nil {
+		writeJSONError(w, fmt.Sprintf("Missing %s header", a.sessionHeader), http.StatusBadRequest)
+		return
+	}
+	if !a.sessions.end(key) {
+		writeJSONError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
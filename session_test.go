@@ -0,0 +1,255 @@
+package kuniumi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEnvScope(t *testing.T) {
+	for _, valid := range []string{"invocation", "session"} {
+		scope, err := parseEnvScope(valid)
+		require.NoError(t, err)
+		assert.Equal(t, envScope(valid), scope)
+	}
+	_, err := parseEnvScope("global")
+	assert.Error(t, err)
+}
+
+func TestEnvSessions(t *testing.T) {
+	base := NewVirtualEnvironment(nil, nil)
+	base.Mount("/a", NewMemFS())
+	require.NoError(t, base.MkdirAll("/a/dir"))
+
+	now := time.Now()
+	s := newEnvSessions(time.Minute, 3)
+	s.now = func() time.Time { return now }
+	mustEnv := func(key any, base *VirtualEnvironment) *VirtualEnvironment {
+		t.Helper()
+		env, err := s.env(key, base)
+		require.NoError(t, err)
+		return env
+	}
+
+	// Sessions must be started
+	_, err := s.env("one", base)
+	assert.ErrorIs(t, err, errSessionNotFound)
+	require.NoError(t, s.start("one", base))
+	require.NoError(t, s.start("two", base))
+
+	// A session keeps its environment, separate from base and other sessions
+	env := mustEnv("one", base)
+	require.NoError(t, env.ChangeCurrentDirectory("/a/dir"))
+	assert.Same(t, env, mustEnv("one", base))
+	require.NoError(t, s.start("one", base), "starting a live session keeps it")
+	assert.Same(t, env, mustEnv("one", base))
+	assert.Equal(t, "/", mustEnv("two", base).GetCurrentDirectory())
+	assert.Equal(t, "/", base.GetCurrentDirectory())
+
+	// A new base keeps the current directory of the session
+	rebased := base.withMounts(map[string]mountPoint{"/b": {fs: NewMemFS()}})
+	env = mustEnv("one", rebased)
+	assert.Equal(t, "/a/dir", env.GetCurrentDirectory())
+	assert.NoError(t, env.WriteFile("/b/x.txt", nil))
+
+	// Idle sessions expire
+	now = now.Add(50 * time.Second)
+	mustEnv("two", base)
+	now = now.Add(50 * time.Second)
+	_, err = s.env("one", base)
+	assert.ErrorIs(t, err, errSessionNotFound, "session one expired")
+	mustEnv("two", base)
+
+	// The number of live sessions is limited; idle ones make room
+	require.NoError(t, s.start("three", base))
+	require.NoError(t, s.start("four", base))
+	assert.ErrorIs(t, s.start("five", base), errTooManySessions)
+	now = now.Add(2 * time.Minute)
+	require.NoError(t, s.start("five", base))
+	assert.Len(t, s.sessions, 1)
+
+	assert.True(t, s.end("five"))
+	assert.False(t, s.end("five"))
+}
+
+func TestEnvSessions_Run(t *testing.T) {
+	s := newEnvSessions(time.Millisecond, 0)
+	require.NoError(t, s.start("one", NewVirtualEnvironment(nil, nil)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.sessions) == 0
+	}, 5*time.Second, 10*time.Millisecond, "idle sessions are forgotten without lookups")
+}
+
+// newSessionTestApp returns an app with functions changing and returning
+// the current directory of the environment.
+func newSessionTestApp() (app *App, cd, pwd *RegisteredFunc) {
+	app = New(Config{Name: "test", Version: "1.0.0"})
+	app.RegisterFunc(func(ctx context.Context, dir string) (string, error) {
+		env := GetVirtualEnv(ctx)
+		if err := env.ChangeCurrentDirectory(dir); err != nil {
+			return "", err
+		}
+		time.Sleep(time.Millisecond) // Let concurrent calls interleave
+		return env.GetCurrentDirectory(), nil
+	}, "changes directory", WithParams(Param("dir", "directory")))
+	app.RegisterFunc(func(ctx context.Context) (string, error) {
+		return GetVirtualEnv(ctx).GetCurrentDirectory(), nil
+	}, "returns the current directory")
+
+	app.env = NewVirtualEnvironment(nil, nil)
+	app.env.Mount("/work", NewMemFS())
+	for i := range 10 {
+		app.env.MkdirAll(fmt.Sprintf("/work/%d", i))
+	}
+	return app, app.functions[0], app.functions[1]
+}
+
+func TestHttpEnvScope(t *testing.T) {
+	call := func(t *testing.T, app *App, fn *RegisteredFunc, session, body string) string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/functions/"+fn.Name, strings.NewReader(body))
+		if session != "" {
+			req.Header.Set(defaultSessionHeader, session)
+		}
+		rec := httptest.NewRecorder()
+		app.newHttpMux().ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var resp struct{ Result string }
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp.Result
+	}
+
+	t.Run("invocation", func(t *testing.T) {
+		app, cd, pwd := newSessionTestApp()
+
+		var wg sync.WaitGroup
+		for i := range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				dir := fmt.Sprintf("/work/%d", i)
+				assert.Equal(t, dir, call(t, app, cd, "", fmt.Sprintf(`{"dir": %q}`, dir)))
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, "/", call(t, app, pwd, "s1", ""), "sessions are ignored")
+	})
+
+	t.Run("session", func(t *testing.T) {
+		app, cd, pwd := newSessionTestApp()
+		app.sessions = newEnvSessions(time.Hour, 2)
+		app.sessionHeader = defaultSessionHeader
+		session := func(method, id string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, "/session", nil)
+			if id != "" {
+				req.Header.Set(defaultSessionHeader, id)
+			}
+			rec := httptest.NewRecorder()
+			app.newHttpMux().ServeHTTP(rec, req)
+			return rec
+		}
+		start := func() string {
+			rec := session(http.MethodPost, "")
+			require.Equal(t, http.StatusCreated, rec.Code)
+			var resp struct {
+				SessionID string `json:"session_id"`
+			}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Equal(t, resp.SessionID, rec.Header().Get(defaultSessionHeader))
+			return resp.SessionID
+		}
+
+		s1, s2 := start(), start()
+		assert.NotEqual(t, s1, s2)
+		assert.Len(t, s1, 26, "128 random bits")
+		assert.Equal(t, http.StatusServiceUnavailable, session(http.MethodPost, "").Code, "the number of sessions is limited")
+
+		call(t, app, cd, s1, `{"dir": "/work/1"}`)
+		call(t, app, cd, s2, `{"dir": "/work"}`)
+		call(t, app, cd, s2, `{"dir": "2"}`)
+		assert.Equal(t, "/work/1", call(t, app, pwd, s1, ""))
+		assert.Equal(t, "/work/2", call(t, app, pwd, s2, ""))
+		assert.Equal(t, "/", call(t, app, pwd, "", ""), "requests without a session get their own environment")
+
+		// Sessions are not created from the IDs chosen by clients
+		req := httptest.NewRequest(http.MethodPost, "/functions/"+pwd.Name, nil)
+		req.Header.Set(defaultSessionHeader, "chosen")
+		rec := httptest.NewRecorder()
+		app.newHttpMux().ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Len(t, app.sessions.sessions, 2)
+
+		assert.Equal(t, http.StatusNoContent, session(http.MethodDelete, s1).Code)
+		assert.Equal(t, http.StatusNotFound, session(http.MethodDelete, s1).Code)
+		assert.Equal(t, http.StatusBadRequest, session(http.MethodDelete, "").Code)
+		assert.Equal(t, "/work/2", call(t, app, pwd, s2, ""))
+		assert.Equal(t, "/", call(t, app, pwd, start(), ""), "a new session starts over")
+	})
+}
+
+func TestMcpEnvScope(t *testing.T) {
+	call := func(t *testing.T, session *mcp.ClientSession, fn *RegisteredFunc, args map[string]any) string {
+		t.Helper()
+		res, err := session.CallTool(context.Background(), &mcp.CallToolParams{Name: fn.OperationID(), Arguments: args})
+		require.NoError(t, err)
+		require.False(t, res.IsError)
+		var resp struct{ Result string }
+		require.NoError(t, json.Unmarshal([]byte(res.Content[0].(*mcp.TextContent).Text), &resp))
+		return resp.Result
+	}
+
+	t.Run("invocation", func(t *testing.T) {
+		app, cd, pwd := newSessionTestApp()
+		session := connectMcp(t, app, nil)
+		call(t, session, cd, map[string]any{"dir": "/work/1"})
+		assert.Equal(t, "/", call(t, session, pwd, nil))
+	})
+
+	t.Run("session", func(t *testing.T) {
+		app, cd, pwd := newSessionTestApp()
+		app.sessions = newEnvSessions(0, 0)
+		server := app.newMcpServer(rootsReadOnly)
+		connect := func() *mcp.ClientSession {
+			serverTransport, clientTransport := mcp.NewInMemoryTransports()
+			serverSession, err := server.Connect(context.Background(), serverTransport, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() { serverSession.Close() })
+			client := mcp.NewClient(&mcp.Implementation{Name: "test-client", Version: "1.0.0"}, nil)
+			session, err := client.Connect(context.Background(), clientTransport, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() { session.Close() })
+			return session
+		}
+		one, two := connect(), connect()
+
+		call(t, one, cd, map[string]any{"dir": "/work/1"})
+		assert.Equal(t, "/work/1", call(t, one, pwd, nil))
+		assert.Equal(t, "/", call(t, two, pwd, nil))
+		assert.Equal(t, "/", app.env.GetCurrentDirectory())
+
+		// Closed sessions are forgotten
+		require.NoError(t, one.Close())
+		assert.Eventually(t, func() bool {
+			app.sessions.mu.Lock()
+			defer app.sessions.mu.Unlock()
+			return len(app.sessions.sessions) == 1
+		}, 2*time.Second, 20*time.Millisecond)
+		assert.Equal(t, "/", call(t, two, pwd, nil))
+	})
+}
@@ -0,0 +1,176 @@
+//go:build unix
+
+package kuniumi
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenNotifySocket creates a NOTIFY_SOCKET for the test and returns it.
+func listenNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	assert.NoError(t, sdNotify("READY=1"), "no-op without NOTIFY_SOCKET")
+
+	conn := listenNotifySocket(t)
+	require.NoError(t, sdNotify("READY=1"))
+	assert.Equal(t, "READY=1", readNotify(t, conn))
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	assert.Zero(t, sdWatchdogInterval())
+
+	t.Setenv("WATCHDOG_USEC", "2000000")
+	t.Setenv("WATCHDOG_PID", "")
+	assert.Equal(t, 2*time.Second, sdWatchdogInterval())
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	assert.Equal(t, 2*time.Second, sdWatchdogInterval())
+
+	// The watchdog is meant for another process
+	t.Setenv("WATCHDOG_PID", "1")
+	assert.Zero(t, sdWatchdogInterval())
+}
+
+func TestSystemdListeners(t *testing.T) {
+	t.Run("not activated", func(t *testing.T) {
+		t.Setenv("LISTEN_FDS", "")
+		ls, err := systemdListeners()
+		assert.NoError(t, err)
+		assert.Nil(t, ls)
+	})
+
+	t.Run("activated for another process", func(t *testing.T) {
+		t.Setenv("LISTEN_PID", "1")
+		t.Setenv("LISTEN_FDS", "1")
+		ls, err := systemdListeners()
+		assert.NoError(t, err)
+		assert.Nil(t, ls)
+		assert.Equal(t, "1", os.Getenv("LISTEN_FDS"), "variables of another process are kept")
+	})
+
+	t.Run("invalid LISTEN_FDS", func(t *testing.T) {
+		t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		t.Setenv("LISTEN_FDS", "many")
+		_, err := systemdListeners()
+		assert.Error(t, err)
+		_, ok := os.LookupEnv("LISTEN_FDS")
+		assert.False(t, ok, "activation variables are unset")
+	})
+}
+
+func TestFileListeners(t *testing.T) {
+	// Stand in for the descriptors passed by systemd with a real socket
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(t, err)
+	defer f.Close()
+	// fileListeners takes ownership of the descriptor, so give it its own copy
+	fd, err := syscall.Dup(int(f.Fd()))
+	require.NoError(t, err)
+
+	ls, err := fileListeners(fd, 1)
+	require.NoError(t, err)
+	require.Len(t, ls, 1)
+	defer ls[0].Close()
+	assert.Equal(t, l.Addr().String(), ls[0].Addr().String())
+}
+
+func TestServeHttp_UnixSocketAndShutdown(t *testing.T) {
+	notify := listenNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", "")
+
+	app := New(Config{Name: "test", Version: "1.0.0"})
+	started := make(chan struct{})
+	release := make(chan struct{})
+	app.RegisterFunc(func(ctx context.Context) (string, error) {
+		close(started)
+		<-release
+		return "done", nil
+	}, "slow")
+	slow := app.functions[0].Name
+
+	path := filepath.Join(t.TempDir(), "app.sock")
+	l, err := listen("unix:" + path)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- app.serveHttp(ctx, []net.Listener{l}, 5*time.Second)
+	}()
+	assert.Equal(t, "READY=1", readNotify(t, notify))
+	assert.Equal(t, "WATCHDOG=1", readNotify(t, notify))
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	respc := make(chan *http.Response, 1)
+	go func() {
+		resp, err := client.Post("http://app/functions/"+slow, "application/json", strings.NewReader("{}"))
+		assert.NoError(t, err)
+		respc <- resp
+	}()
+	select {
+	case <-started:
+	case <-time.After(3 * time.Second):
+		t.Fatal("request did not reach the function")
+	}
+
+	// Shutdown waits for the in-flight request
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	resp := <-respc
+	require.NotNil(t, resp)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.JSONEq(t, `{"result": "done"}`, string(body))
+	assert.NoError(t, <-served)
+
+	// Drain watchdog pings until the stop notification
+	for {
+		if msg := readNotify(t, notify); msg != "WATCHDOG=1" {
+			assert.Equal(t, "STOPPING=1", msg)
+			break
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package kuniumi
 
+import "io/fs"
+
 // Config holds the application configuration.
 // It defines the metadata for the application, such as its name and version,
 // which are used in CLI help messages and Open API specifications.
@@ -20,3 +22,24 @@ func WithName(name string) Option {
 		a.config.Name = name
 	}
 }
+
+// WithFS registers a read-only filesystem, such as an embed.FS holding
+// reference data shipped inside the binary, under name. It is mounted with
+// --mount embed:NAME:/virt (or embed:/NAME), or with --mount overlay:NAME:/virt
+// to let functions modify an in-memory copy.
+//
+// Example:
+//
+//	//go:embed assets
+//	var assets embed.FS
+//
+//	sub, _ := fs.Sub(assets, "assets")
+//	app := kuniumi.New(cfg, kuniumi.WithFS("assets", sub))
+func WithFS(name string, fsys fs.FS) Option {
+	return func(a *App) {
+		if a.filesystems == nil {
+			a.filesystems = make(map[string]fs.FS)
+		}
+		a.filesystems[name] = fsys
+	}
+}
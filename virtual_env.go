@@ -2,14 +2,15 @@ package kuniumi
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	vpath "path" // Renamed to avoid shadowing
-	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 // VirtualEnvironment provides a sandboxed environment for functions.
@@ -18,12 +19,13 @@ import (
 //
 // It supports:
 //   - **Environment Variables**: Managed set of environment variables separate from the host process.
-//   - **File System Mounting**: Explicitly mounted directories map host paths to virtual paths.
-//   - **Path Resolution**: Securely resolves virtual paths to host paths, preventing access outside mounted areas.
+//   - **File System Mounting**: Explicitly mounted filesystems (host directories, in-memory
+//     filesystems, embedded files, overlays; see FileSystem) are mapped to virtual paths.
+//   - **Path Resolution**: Securely resolves virtual paths to mounted files, preventing access outside mounted areas.
 type VirtualEnvironment struct {
 	envVars map[string]string
-	fsRoot  string            // Root path for virtual FS (mapped from --mount)
-	mounts  map[string]string // Host path -> Virtual path mapping
+	fsRoot  string                // Root path for virtual FS (mapped from --mount)
+	mounts  map[string]mountPoint // Virtual path -> mount mapping
 
 	pathMutex sync.RWMutex
 	cwd       string // Virtual CWD, defaults to "/"
@@ -55,9 +57,9 @@ func NewVirtualEnvironment(envVars map[string]string, mounts map[string]string)
 		envVars = make(map[string]string)
 	}
 	// Normalize mounts
-	normalizedMounts := make(map[string]string)
+	normalizedMounts := make(map[string]mountPoint)
 	for h, v := range mounts {
-		normalizedMounts[v] = h
+		normalizedMounts[vpath.Clean("/"+v)] = openMount(mountPoint{host: h})
 	}
 
 	return &VirtualEnvironment{
@@ -67,6 +69,138 @@ func NewVirtualEnvironment(envVars map[string]string, mounts map[string]string)
 	}
 }
 
+// mountPoint describes a filesystem mounted into the virtual filesystem.
+type mountPoint struct {
+	host   string     // Host directory of host mounts
+	fs     FileSystem // Filesystem of the mount (see openMount for host mounts)
+	source string     // --mount source of other mounts (e.g. "mem"), if any
+	closer io.Closer  // Host directory opened for the mount, closed with the environment
+
+	// Permissions (--mount options ro, noexec and nodelete)
+	readOnly bool // No modification at all
+	noExec   bool // No execute permission bits
+	noDelete bool // No removal of files
+}
+
+// options returns the --mount options of the permissions of the mount.
+func (m mountPoint) options() string {
+	var opts []string
+	if m.readOnly {
+		opts = append(opts, "ro")
+	}
+	if m.noExec {
+		opts = append(opts, "noexec")
+	}
+	if m.noDelete {
+		opts = append(opts, "nodelete")
+	}
+	return strings.Join(opts, ",")
+}
+
+// MountPermissionError is returned when an operation is denied by the
+// permissions of a mount (see the options of --mount). It matches
+// fs.ErrPermission with errors.Is.
+type MountPermissionError struct {
+	Op    string // Operation, e.g. "write"
+	Path  string // Virtual path of the file
+	Mount string // Virtual path of the mount
+	Flag  string // Mount option denying the operation: "ro", "noexec" or "nodelete"
+}
+
+func (e *MountPermissionError) Error() string {
+	reason := e.Flag
+	if reason == "ro" {
+		reason = "read-only"
+	}
+	return fmt.Sprintf("%s %s: permission denied (mount %s is %s)", e.Op, e.Path, e.Mount, reason)
+}
+
+func (e *MountPermissionError) Unwrap() error {
+	return fs.ErrPermission
+}
+
+// openMount returns m with the filesystem of its host directory, if it is
+// a host mount: the directory is opened once per mount, not per operation.
+func openMount(m mountPoint) mountPoint {
+	if m.host != "" && m.fs == nil {
+		h := &hostFS{dir: m.host}
+		m.fs, m.closer = h, h
+	}
+	return m
+}
+
+// Mount mounts fsys at the virtual path, replacing any mount at that path.
+// It lets an environment be built without touching the disk, e.g. in tests:
+//
+//	env := kuniumi.NewVirtualEnvironment(nil, nil)
+//	env.Mount("/scratch", kuniumi.NewMemFS())
+//	ctx = kuniumi.WithVirtualEnv(ctx, env)
+func (v *VirtualEnvironment) Mount(virtualPath string, fsys FileSystem) {
+	v.mount(virtualPath, mountPoint{fs: fsys})
+}
+
+// mount adds a mount at the virtual path.
+func (v *VirtualEnvironment) mount(virtualPath string, m mountPoint) {
+	v.pathMutex.Lock()
+	defer v.pathMutex.Unlock()
+	if v.mounts == nil {
+		v.mounts = make(map[string]mountPoint)
+	}
+	v.mounts[vpath.Clean("/"+virtualPath)] = openMount(m)
+}
+
+// Clone returns a copy of the environment with its own current directory
+// and mount table. The copy shares the mounted filesystems: files written
+// through one are visible through the other. Adapters give every call a
+// clone, so that calls do not change each other's current directory.
+// Closing the copy does not close the shared filesystems.
+func (v *VirtualEnvironment) Clone() *VirtualEnvironment {
+	return v.withMounts(nil)
+}
+
+// withMounts returns a copy of the environment with additional mounts.
+// Existing mounts at the same virtual paths are replaced. The copy starts
+// with the same environment variables and current directory as v. Only
+// the additional mounts are closed by closing the copy.
+func (v *VirtualEnvironment) withMounts(extra map[string]mountPoint) *VirtualEnvironment {
+	v.pathMutex.RLock()
+	defer v.pathMutex.RUnlock()
+
+	mounts := make(map[string]mountPoint, len(v.mounts)+len(extra))
+	for virt, m := range v.mounts {
+		m.closer = nil
+		mounts[virt] = m
+	}
+	for virt, m := range extra {
+		mounts[virt] = openMount(m)
+	}
+
+	return &VirtualEnvironment{
+		envVars: v.envVars,
+		fsRoot:  v.fsRoot,
+		mounts:  mounts,
+		cwd:     v.cwd,
+	}
+}
+
+// Close closes the host directories opened for the mounts of the
+// environment (host mounts and overlays of host directories). Clones of the
+// environment share these mounts, so they must not be used afterwards.
+func (v *VirtualEnvironment) Close() error {
+	v.pathMutex.Lock()
+	defer v.pathMutex.Unlock()
+
+	var errs []error
+	for virt, m := range v.mounts {
+		if m.closer != nil {
+			errs = append(errs, m.closer.Close())
+			m.closer = nil
+			v.mounts[virt] = m
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // --- Environment Variables ---
 
 // Getenv retrieves the value of the environment variable named by the key.
@@ -89,9 +223,42 @@ func (v *VirtualEnvironment) ListEnv() map[string]string {
 
 // --- File System Operations ---
 
-// resolvePath converts a virtual path to a real host path.
-// It ensures the path is within the mounted directories.
-func (v *VirtualEnvironment) resolvePath(virtualPath string) (string, error) {
+// resolvedPath is a virtual path resolved to a file of a mount.
+type resolvedPath struct {
+	fs        FileSystem
+	name      string // Name of the file in fs
+	path      string // Virtual path, as given
+	mount     mountPoint
+	mountPath string // Virtual path of the mount
+}
+
+// virtual returns the clean absolute virtual path of the file.
+func (r resolvedPath) virtual() string {
+	return vpath.Join(r.mountPath, r.name)
+}
+
+// deny returns the error of op denied by the mount option flag.
+func (r resolvedPath) deny(op, flag string) error {
+	return &MountPermissionError{Op: op, Path: r.path, Mount: r.mountPath, Flag: flag}
+}
+
+// resolveWritable is like resolve, but additionally rejects paths
+// that live on a read-only mount. op names the operation in errors.
+func (v *VirtualEnvironment) resolveWritable(op, virtualPath string) (resolvedPath, error) {
+	r, err := v.resolve(virtualPath)
+	if err != nil {
+		return resolvedPath{}, err
+	}
+	if r.mount.readOnly {
+		return resolvedPath{}, r.deny(op, "ro")
+	}
+	return r, nil
+}
+
+// resolve converts a virtual path to the filesystem of its mount and the
+// name of the file in that filesystem, and returns the mount the path was
+// resolved through. It ensures the path is within the mounted filesystems.
+func (v *VirtualEnvironment) resolve(virtualPath string) (resolvedPath, error) {
 	v.pathMutex.RLock()
 	defer v.pathMutex.RUnlock()
 
@@ -103,42 +270,58 @@ func (v *VirtualEnvironment) resolvePath(virtualPath string) (string, error) {
 	// Clean the path (resolve ..)
 	p = vpath.Clean(p)
 
-	// Logic: Find the longest matching mount prefix
-	var bestMatchVirtual string
-	var bestMatchHost string
+	// Find the longest mount containing the path. Mounts match whole path
+	// segments: a mount at /data does not contain /database.
+	var bestMatchVirtual, rel string
+	var bestMatch mountPoint
 
-	for virt, host := range v.mounts {
-		// Ensure exact match or prefix
-		if strings.HasPrefix(p, virt) {
-			if len(virt) > len(bestMatchVirtual) {
-				bestMatchVirtual = virt
-				bestMatchHost = host
-			}
+	for virt, m := range v.mounts {
+		if r, ok := mountRel(p, virt); ok && len(virt) > len(bestMatchVirtual) {
+			bestMatchVirtual, bestMatch, rel = virt, m, r
 		}
 	}
 
 	if bestMatchVirtual == "" {
-		return "", fmt.Errorf("path not mounted: %s", virtualPath)
+		return resolvedPath{}, fmt.Errorf("path not mounted: %s", virtualPath)
 	}
 
-	// Relativize path from the virtual mount point
-	// Manual calculation since path package lacks Rel
-	var rel string
-	if p == bestMatchVirtual {
-		rel = "."
-	} else {
-		// p starts with bestMatchVirtual
-		rel = strings.TrimPrefix(p, bestMatchVirtual)
-		rel = strings.TrimPrefix(rel, "/")
-	}
+	return resolvedPath{
+		fs:        bestMatch.fs,
+		name:      rel,
+		path:      virtualPath,
+		mount:     bestMatch,
+		mountPath: bestMatchVirtual,
+	}, nil
+}
 
-	// Convert relative path to host OS separator
-	relHost := filepath.FromSlash(rel)
+// mountRel returns the name of the clean absolute virtual path p relative
+// to the mount at virt, if p is virt or below it.
+func mountRel(p, virt string) (string, bool) {
+	switch {
+	case p == virt:
+		return ".", true
+	case virt == "/":
+		return p[1:], true
+	case strings.HasPrefix(p, virt+"/"):
+		return p[len(virt)+1:], true
+	}
+	return "", false
+}
 
-	// Join with host path
-	realPath := filepath.Join(bestMatchHost, relHost)
+// errSameFile is returned when copying a file onto itself.
+var errSameFile = errors.New("same file")
 
-	return realPath, nil
+// writeFile writes data to the named file of fsys, creating or truncating it.
+func writeFile(fsys FileSystem, name string, data []byte, perm fs.FileMode) error {
+	f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 // WriteFile writes data to a file at the specified virtual path.
@@ -149,14 +332,15 @@ func (v *VirtualEnvironment) resolvePath(virtualPath string) (string, error) {
 //   - path: The virtual path to write to.
 //   - data: The content to write.
 //
-// Returns an error if the path cannot be resolved (not mounted) or if the write fails.
+// Returns an error if the path cannot be resolved (not mounted), is on a read-only mount
+// (*MountPermissionError), or if the write fails.
 func (v *VirtualEnvironment) WriteFile(path string, data []byte) error {
-	realPath, err := v.resolvePath(path)
+	r, err := v.resolveWritable("write", path)
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(realPath, data, 0644)
+	return writeFile(r.fs, r.name, data, 0644)
 }
 
 // ReadFile reads data from a file at the specified virtual path.
@@ -169,28 +353,38 @@ func (v *VirtualEnvironment) WriteFile(path string, data []byte) error {
 //
 // Returns the read data, or an error if the path cannot be resolved or reading fails.
 // If the file is shorter than (offset + length), it returns the available bytes.
+// Use Open to stream large files instead.
 func (v *VirtualEnvironment) ReadFile(path string, offset int64, length int64) ([]byte, error) {
-	realPath, err := v.resolvePath(path)
+	r, err := v.resolve(path)
 	if err != nil {
 		return nil, err
 	}
 
-	f, err := os.Open(realPath)
+	f, err := r.fs.OpenFile(r.name, os.O_RDONLY, 0)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
+	// Do not allocate more than the file holds, nor seek past its end
+	if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+		length = max(0, min(length, info.Size()-offset))
+		if length == 0 {
+			return []byte{}, nil
+		}
+	}
+
 	if offset > 0 {
-		_, err = f.Seek(offset, 0)
+		_, err = f.Seek(offset, io.SeekStart)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	// A single Read may return fewer bytes than available
 	buf := make([]byte, length)
-	n, err := f.Read(buf)
-	if err != nil && err != io.EOF {
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return nil, err
 	}
 
@@ -205,14 +399,15 @@ func (v *VirtualEnvironment) ReadFile(path string, offset int64, length int64) (
 //   - offset: The byte offset to start writing at.
 //   - data: The new content to write.
 //
-// Returns an error if the file cannot be opened, path is invalid, or write fails.
+// Returns an error if the file cannot be opened, path is invalid or on a read-only mount
+// (*MountPermissionError), or write fails.
 func (v *VirtualEnvironment) RewriteFile(path string, offset int64, data []byte) error {
-	realPath, err := v.resolvePath(path)
+	r, err := v.resolveWritable("write", path)
 	if err != nil {
 		return err
 	}
 
-	f, err := os.OpenFile(realPath, os.O_WRONLY, 0644)
+	f, err := r.fs.OpenFile(r.name, os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
@@ -223,42 +418,69 @@ func (v *VirtualEnvironment) RewriteFile(path string, offset int64, data []byte)
 }
 
 // CopyFile copies a file from a source virtual path to a destination virtual path.
-// It reads the entire source file and writes it to the destination.
+// The content is streamed, so files of any size can be copied, also across mounts.
+// The destination is created if it does not exist, or truncated if it does.
 //
 // Arguments:
 //   - src: The source virtual path.
 //   - dst: The destination virtual path.
 //
-// Returns an error if either path cannot be resolved or IO operations fail.
+// Returns an error if either path cannot be resolved, the destination is on a
+// read-only mount (*MountPermissionError), or IO operations fail.
 func (v *VirtualEnvironment) CopyFile(src, dst string) error {
-	realSrc, err := v.resolvePath(src)
+	rs, err := v.resolve(src)
+	if err != nil {
+		return err
+	}
+	rd, err := v.resolveWritable("copy", dst)
 	if err != nil {
 		return err
 	}
-	realDst, err := v.resolvePath(dst)
+
+	in, err := rs.fs.OpenFile(rs.name, os.O_RDONLY, 0)
 	if err != nil {
 		return err
 	}
+	defer in.Close()
 
-	input, err := os.ReadFile(realSrc)
+	// Truncating the destination would lose the source
+	srcInfo, err := in.Stat()
 	if err != nil {
 		return err
 	}
+	if rs.virtual() == rd.virtual() {
+		return &os.LinkError{Op: "copy", Old: src, New: dst, Err: errSameFile}
+	}
+	if dstInfo, err := rd.fs.Stat(rd.name); err == nil && os.SameFile(srcInfo, dstInfo) {
+		return &os.LinkError{Op: "copy", Old: src, New: dst, Err: errSameFile}
+	}
 
-	return os.WriteFile(realDst, input, 0644)
+	out, err := rd.fs.OpenFile(rd.name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 // RemoveFile deletes the file at the specified virtual path.
 //
 // Warnings:
 //   - This operation is permanent.
-//   - It operates on the underlying host file system via the mount point.
+//   - It operates on the underlying file system of the mount point (e.g. the host directory).
+//   - It is denied (*MountPermissionError) on mounts with the ro or nodelete option.
 func (v *VirtualEnvironment) RemoveFile(path string) error {
-	realPath, err := v.resolvePath(path)
+	r, err := v.resolveWritable("remove", path)
 	if err != nil {
 		return err
 	}
-	return os.Remove(realPath)
+	if r.mount.noDelete {
+		return r.deny("remove", "nodelete")
+	}
+	return r.fs.Remove(r.name)
 }
 
 // Chmod changes the permissions of the file at the specified virtual path.
@@ -266,47 +488,88 @@ func (v *VirtualEnvironment) RemoveFile(path string) error {
 // Arguments:
 //   - path: The virtual path of the file.
 //   - mode: The new file mode (permissions).
+//
+// It is denied (*MountPermissionError) on mounts with the ro option, and on
+// mounts with the noexec option when mode has execute bits.
 func (v *VirtualEnvironment) Chmod(path string, mode os.FileMode) error {
-	realPath, err := v.resolvePath(path)
+	r, err := v.resolveWritable("chmod", path)
 	if err != nil {
 		return err
 	}
-	return os.Chmod(realPath, mode)
+	if r.mount.noExec && mode&0111 != 0 {
+		return r.deny("chmod", "noexec")
+	}
+	return r.fs.Chmod(r.name, mode)
 }
 
 // FileInfo is a simplified file info.
 type FileInfo struct {
-	Name  string
-	Size  int64
-	IsDir bool
+	Name    string
+	Size    int64
+	IsDir   bool
+	Mode    fs.FileMode // Type and permission bits
+	ModTime time.Time
+}
+
+// newFileInfo returns the FileInfo of info.
+func newFileInfo(info fs.FileInfo) FileInfo {
+	return FileInfo{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		IsDir:   info.IsDir(),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+	}
+}
+
+// Stat returns the file info of the file at the specified virtual path,
+// following symlinks.
+//
+// Returns an error if the path cannot be resolved or the file does not exist.
+func (v *VirtualEnvironment) Stat(path string) (FileInfo, error) {
+	r, err := v.resolve(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := r.fs.Stat(r.name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	fi := newFileInfo(info)
+	if r.name == "." {
+		fi.Name = vpath.Base(r.mountPath) // Not the host directory name
+	}
+	return fi, nil
 }
 
 // ListFile returns a list of files and directories in the specified virtual directory.
-// It returns a slice of FileInfo structs containing name, size, and type information.
+// It returns a slice of FileInfo structs containing name, size, type, mode and
+// modification time. Symlinks are listed as such (Mode has fs.ModeSymlink).
 //
 // Arguments:
 //   - path: The virtual directory structure to list.
 //
 // Returns an error if the path is invalid or cannot be read.
 func (v *VirtualEnvironment) ListFile(path string) ([]FileInfo, error) {
-	realPath, err := v.resolvePath(path)
+	r, err := v.resolve(path)
 	if err != nil {
 		return nil, err
 	}
 
-	entries, err := os.ReadDir(realPath)
+	entries, err := r.fs.ReadDir(r.name)
 	if err != nil {
 		return nil, err
 	}
 
 	var infos []FileInfo
 	for _, e := range entries {
-		info, _ := e.Info()
-		infos = append(infos, FileInfo{
-			Name:  e.Name(),
-			Size:  info.Size(),
-			IsDir: e.IsDir(),
-		})
+		info, err := e.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // Removed meanwhile
+		} else if err != nil {
+			return nil, err
+		}
+		infos = append(infos, newFileInfo(info))
 	}
 	return infos, nil
 }
@@ -320,39 +583,44 @@ func (v *VirtualEnvironment) ListFile(path string) ([]FileInfo, error) {
 //
 // Returns a list of matching virtual paths.
 func (v *VirtualEnvironment) FindFile(root string, pattern string, recursive bool) ([]string, error) {
-	realRoot, err := v.resolvePath(root)
+	r, err := v.resolve(root)
 	if err != nil {
 		return nil, err
 	}
+	rootName := r.name
 
 	var matches []string
 
 	// Walk function
-	walkFn := func(path string, d fs.DirEntry, err error) error {
+	walkFn := func(name string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		if !recursive && path != realRoot && filepath.Dir(path) != realRoot {
+		if !recursive && name != rootName && vpath.Dir(name) != rootName {
 			if d.IsDir() {
 				return fs.SkipDir
 			}
 		}
 
-		matched, err := filepath.Match(pattern, d.Name())
+		matched, err := vpath.Match(pattern, d.Name())
 		if err != nil {
 			return err
 		}
 		if matched {
-			rel, _ := filepath.Rel(realRoot, path)
-			// Convert host path separator to virtual (forward slash)
-			relVirt := filepath.ToSlash(rel)
-			virtualPath := vpath.Join(root, relVirt)
-			matches = append(matches, virtualPath)
+			// Names of the walk are relative to the mount, not to root
+			rel := "."
+			if name != rootName {
+				rel = strings.TrimPrefix(name, rootName+"/")
+				if rootName == "." {
+					rel = name
+				}
+			}
+			matches = append(matches, vpath.Join(root, rel))
 		}
 		return nil
 	}
 
-	err = filepath.WalkDir(realRoot, walkFn)
+	err = fs.WalkDir(r.fs, rootName, walkFn)
 	return matches, err
 }
 
@@ -364,12 +632,12 @@ func (v *VirtualEnvironment) FindFile(root string, pattern string, recursive boo
 //
 // Returns an error if the path does not exist, is not a directory, or cannot be resolved.
 func (v *VirtualEnvironment) ChangeCurrentDirectory(path string) error {
-	realPath, err := v.resolvePath(path)
+	r, err := v.resolve(path)
 	if err != nil {
 		return err
 	}
 
-	stat, err := os.Stat(realPath)
+	stat, err := r.fs.Stat(r.name)
 	if err != nil {
 		return err
 	}
@@ -379,10 +647,10 @@ func (v *VirtualEnvironment) ChangeCurrentDirectory(path string) error {
 
 	// Normalize virtual path
 	p := path
+	v.pathMutex.Lock()
 	if !strings.HasPrefix(p, "/") {
 		p = vpath.Join(v.cwd, p)
 	}
-	v.pathMutex.Lock()
 	v.cwd = vpath.Clean(p)
 	v.pathMutex.Unlock()
 
@@ -0,0 +1,251 @@
+package kuniumi
+
+import (
+	"errors"
+	"io/fs"
+	vpath "path"
+	"sort"
+	"strings"
+)
+
+// FS returns a read-only view of the environment rooted at the virtual path
+// root (relative to the current directory, if not absolute). The view
+// implements fs.FS, fs.ReadDirFS, fs.StatFS, fs.GlobFS and fs.SubFS, so it
+// can be passed to the standard library:
+//
+//	env := kuniumi.GetVirtualEnv(ctx)
+//	tmpl, err := template.ParseFS(env.FS("/templates"), "*.html")
+//	http.Handle("/", http.FileServer(http.FS(env.FS("/public"))))
+//	err = fs.WalkDir(env.FS("/data"), ".", walkFn)
+//
+// The view goes through the same path resolution as the other operations.
+// Directories leading to mounts (e.g. "/roots" for a mount at "/roots/ws")
+// are listed as read-only directories, and mounts nested in another mount
+// are listed in the directory of that mount.
+func (v *VirtualEnvironment) FS(root string) fs.FS {
+	v.pathMutex.RLock()
+	if !strings.HasPrefix(root, "/") {
+		root = vpath.Join(v.cwd, root)
+	}
+	v.pathMutex.RUnlock()
+	return &envFS{env: v, root: vpath.Clean(root)}
+}
+
+// envFS is the fs.FS view of a VirtualEnvironment returned by FS.
+type envFS struct {
+	env  *VirtualEnvironment
+	root string // Clean absolute virtual path
+}
+
+// path returns the virtual path of name.
+func (e *envFS) path(op, name string) (string, error) {
+	if err := checkName(op, name); err != nil {
+		return "", err
+	}
+	return vpath.Join(e.root, name), nil
+}
+
+func (e *envFS) Open(name string) (fs.File, error) {
+	p, err := e.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := e.env.resolve(p)
+	if err != nil {
+		return e.openVirtualDir(name, p)
+	}
+
+	f, err := r.fs.Open(r.name)
+	if err != nil {
+		return nil, renamePathError(err, "open", name)
+	}
+	info, err := f.Stat()
+	if err != nil || !info.IsDir() {
+		return f, nil
+	}
+	entries, err := e.readMountDir(name, p, r)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &envDir{File: f, info: renamedFileInfo{info, vpath.Base(name)}, entries: entries}, nil
+}
+
+func (e *envFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := e.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := e.env.resolve(p)
+	if err != nil {
+		if len(e.env.childMounts(p)) == 0 {
+			return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+		}
+		return virtualDirInfo(vpath.Base(name)), nil
+	}
+	info, err := r.fs.Stat(r.name)
+	if err != nil {
+		return nil, renamePathError(err, "stat", name)
+	}
+	return renamedFileInfo{info, vpath.Base(name)}, nil
+}
+
+func (e *envFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := e.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := e.env.resolve(p)
+	if err != nil {
+		entries := e.mountEntries(p, nil)
+		if len(entries) == 0 {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+		}
+		return entries, nil
+	}
+	return e.readMountDir(name, p, r)
+}
+
+func (e *envFS) Glob(pattern string) ([]string, error) {
+	// Hide this method, so that fs.Glob walks the view with ReadDir
+	return fs.Glob(struct{ fs.ReadDirFS }{e}, pattern)
+}
+
+func (e *envFS) Sub(dir string) (fs.FS, error) {
+	p, err := e.path("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	return &envFS{env: e.env, root: p}, nil
+}
+
+// openVirtualDir opens the virtual path p, which is not mounted, as a
+// directory if mounts are below it.
+func (e *envFS) openVirtualDir(name, p string) (fs.File, error) {
+	entries := e.mountEntries(p, nil)
+	if len(entries) == 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &envDir{info: virtualDirInfo(vpath.Base(name)), entries: entries}, nil
+}
+
+// readMountDir returns the entries of the directory name at the virtual
+// path p, resolved to r, with the mounts below it.
+func (e *envFS) readMountDir(name, p string, r resolvedPath) ([]fs.DirEntry, error) {
+	entries, err := r.fs.ReadDir(r.name)
+	if err != nil {
+		return nil, renamePathError(err, "readdir", name)
+	}
+	return e.mountEntries(p, entries), nil
+}
+
+// mountEntries adds to the entries of the virtual directory p the entries
+// leading to mounts below it. Mount points replace the entries of the
+// same name; other directories are only added if missing.
+func (e *envFS) mountEntries(p string, entries []fs.DirEntry) []fs.DirEntry {
+	children := e.env.childMounts(p)
+	if len(children) == 0 {
+		return entries
+	}
+
+	merged := make(map[string]fs.DirEntry, len(entries)+len(children))
+	for _, entry := range entries {
+		merged[entry.Name()] = entry
+	}
+	for child, isMount := range children {
+		if !isMount {
+			if _, ok := merged[child]; !ok {
+				merged[child] = fs.FileInfoToDirEntry(virtualDirInfo(child))
+			}
+			continue
+		}
+		r, err := e.env.resolve(vpath.Join(p, child))
+		if err != nil {
+			continue
+		}
+		info, err := r.fs.Stat(r.name)
+		if err != nil {
+			delete(merged, child) // Unavailable, as when opened
+			continue
+		}
+		merged[child] = fs.FileInfoToDirEntry(renamedFileInfo{info, child})
+	}
+
+	entries = make([]fs.DirEntry, 0, len(merged))
+	for _, entry := range merged {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+// childMounts returns the names of the entries of the clean virtual
+// directory p that lead to mounts, mapped to whether the entry is itself
+// a mount point.
+func (v *VirtualEnvironment) childMounts(p string) map[string]bool {
+	v.pathMutex.RLock()
+	defer v.pathMutex.RUnlock()
+
+	children := map[string]bool{}
+	for virt := range v.mounts {
+		rel, ok := mountRel(virt, p)
+		if !ok || rel == "." {
+			continue
+		}
+		child, rest, _ := strings.Cut(rel, "/")
+		children[child] = children[child] || rest == ""
+	}
+	return children
+}
+
+// renamePathError returns err as a *fs.PathError on name, the name of the
+// file in the view rather than in its mount.
+func renamePathError(err error, op, name string) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		return &fs.PathError{Op: pe.Op, Path: name, Err: pe.Err}
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// renamedFileInfo is a file info with the name of the file in the view
+// (e.g. the name of a mount point instead of ".").
+type renamedFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (i renamedFileInfo) Name() string { return i.name }
+
+// virtualDirInfo returns the file info of a directory leading to mounts.
+func virtualDirInfo(name string) fs.FileInfo {
+	return &memFileInfo{name: name, mode: fs.ModeDir | 0555}
+}
+
+// envDir is an open directory of an envFS, listing the mounts below it.
+// File is nil for directories leading to mounts.
+type envDir struct {
+	fs.File
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	pos     int
+}
+
+func (d *envDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *envDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errIsDir}
+}
+
+func (d *envDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	return readDirPage(d.entries, &d.pos, n)
+}
+
+func (d *envDir) Close() error {
+	if d.File == nil {
+		return nil
+	}
+	return d.File.Close()
+}
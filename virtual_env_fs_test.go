@@ -0,0 +1,105 @@
+package kuniumi
+
+import (
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFSTestEnv returns an environment with a host mount, nested and
+// embedded mounts, and a mount below a directory that is not mounted.
+func newFSTestEnv(t *testing.T) *VirtualEnvironment {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "logs"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "logs", "app.log"), []byte("started"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("<p>{{.}}</p>"), 0644))
+
+	scratch := NewMemFS()
+	require.NoError(t, writeFile(scratch, "note.txt", []byte("note"), 0644))
+
+	env := NewVirtualEnvironment(nil, map[string]string{dir: "/data"})
+	env.mount("/data/assets", mountPoint{fs: NewReadOnlyFS(testLowerFS()), readOnly: true})
+	env.Mount("/roots/ws/scratch", scratch)
+	return env
+}
+
+func TestVirtualEnvironment_FS(t *testing.T) {
+	env := newFSTestEnv(t)
+
+	require.NoError(t, fstest.TestFS(env.FS("/"),
+		"data/index.html", "data/logs/app.log", "data/assets/readme.txt", "data/assets/data/cities.csv",
+		"roots/ws/scratch/note.txt"))
+	require.NoError(t, fstest.TestFS(env.FS("/data"), "index.html", "assets/readme.txt"))
+
+	// Directories leading to mounts, and nested mounts, are listed
+	entries, err := fs.ReadDir(env.FS("/"), ".")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "data", entries[0].Name())
+	assert.Equal(t, "roots", entries[1].Name())
+	assert.True(t, entries[1].IsDir())
+
+	var walked []string
+	require.NoError(t, fs.WalkDir(env.FS("/data"), ".", func(name string, d fs.DirEntry, err error) error {
+		if !d.IsDir() {
+			walked = append(walked, name)
+		}
+		return err
+	}))
+	assert.Equal(t, []string{"assets/data/cities.csv", "assets/data/old.txt", "assets/readme.txt", "index.html", "logs/app.log"}, walked)
+
+	matches, err := fs.Glob(env.FS("/"), "data/*/*.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"data/assets/readme.txt"}, matches)
+
+	// Relative roots and Sub
+	require.NoError(t, env.ChangeCurrentDirectory("/data"))
+	sub, err := fs.Sub(env.FS("logs"), ".")
+	require.NoError(t, err)
+	data, err := fs.ReadFile(sub, "app.log")
+	require.NoError(t, err)
+	assert.Equal(t, "started", string(data))
+
+	info, err := fs.Stat(env.FS("/roots/ws"), "scratch")
+	require.NoError(t, err)
+	assert.Equal(t, "scratch", info.Name())
+	assert.True(t, info.IsDir())
+
+	for _, name := range []string{"missing", "../data", "/data", "data/../../etc"} {
+		_, err := env.FS("/").Open(name)
+		assert.Error(t, err, name)
+	}
+	_, err = fs.Stat(env.FS("/"), "other")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestVirtualEnvironment_FSStdlib(t *testing.T) {
+	env := newFSTestEnv(t)
+
+	tmpl, err := template.ParseFS(env.FS("/data"), "*.html")
+	require.NoError(t, err)
+	var out strings.Builder
+	require.NoError(t, tmpl.Execute(&out, "hi"))
+	assert.Equal(t, "<p>hi</p>", out.String())
+
+	srv := httptest.NewServer(http.FileServer(http.FS(env.FS("/data"))))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/assets/data/cities.csv")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "tokyo,osaka", string(body))
+}
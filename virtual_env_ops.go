@@ -0,0 +1,261 @@
+package kuniumi
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	vpath "path"
+	"sort"
+	"strings"
+)
+
+// errCrossMount is returned when renaming or linking across mounts.
+var errCrossMount = errors.New("not on the same mount")
+
+// errSymlinkDir is returned when creating a symlink in, or to a file in, a
+// directory reached through a symlink.
+var errSymlinkDir = errors.New("path goes through a symlinked directory")
+
+// --- Streaming ---
+
+// Open opens the file at the specified virtual path for reading.
+// The content is read as it is consumed, which suits files too large for
+// ReadFile. The caller must close the file.
+//
+// Returns an error if the path cannot be resolved or the file cannot be opened.
+func (v *VirtualEnvironment) Open(path string) (io.ReadCloser, error) {
+	return v.OpenFile(path, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates the file at the specified virtual path and
+// opens it for writing. The permission is fixed to 0644. The caller must
+// close the file, and check the error of Close.
+//
+// Returns an error if the path cannot be resolved, is on a read-only mount
+// (*MountPermissionError), or the file cannot be created.
+func (v *VirtualEnvironment) Create(path string) (io.WriteCloser, error) {
+	return v.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// OpenFile opens the file at the specified virtual path with the flags of
+// os.OpenFile (os.O_RDWR, os.O_CREATE, os.O_APPEND, ...), creating it with
+// perm if needed. The returned File can seek and read or write at offsets.
+//
+// Opening for writing is denied (*MountPermissionError) on mounts with the
+// ro option, and creating a file with execute bits on mounts with the
+// noexec option.
+func (v *VirtualEnvironment) OpenFile(path string, flag int, perm fs.FileMode) (File, error) {
+	var r resolvedPath
+	var err error
+	if flag&writeFlags != 0 {
+		r, err = v.resolveWritable("open", path)
+	} else {
+		r, err = v.resolve(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.mount.noExec && flag&os.O_CREATE != 0 && perm&0111 != 0 {
+		return nil, r.deny("open", "noexec")
+	}
+	return r.fs.OpenFile(r.name, flag, perm)
+}
+
+// AppendFile appends data to the file at the specified virtual path,
+// creating it with permission 0644 if it does not exist.
+//
+// Returns an error if the path cannot be resolved, is on a read-only mount
+// (*MountPermissionError), or the write fails.
+func (v *VirtualEnvironment) AppendFile(path string, data []byte) error {
+	f, err := v.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// --- Directories and Names ---
+
+// MkdirAll creates the directory at the specified virtual path, along with
+// any missing parents. The permission is fixed to 0755. It does nothing if
+// the directory already exists.
+//
+// Returns an error if the path cannot be resolved, is on a read-only mount
+// (*MountPermissionError), or a file is in the way.
+func (v *VirtualEnvironment) MkdirAll(path string) error {
+	r, err := v.resolveWritable("mkdir", path)
+	if err != nil {
+		return err
+	}
+	return mkdirAll(r.fs, r.name, 0755)
+}
+
+// Rename moves a file or directory to a new virtual path on the same mount,
+// replacing an existing file there. To move files across mounts, use
+// CopyFile and RemoveFile.
+//
+// It is denied (*MountPermissionError) on mounts with the ro or nodelete
+// option: a rename removes oldpath, and may replace newpath.
+func (v *VirtualEnvironment) Rename(oldpath, newpath string) error {
+	ro, err := v.resolveWritable("rename", oldpath)
+	if err != nil {
+		return err
+	}
+	rn, err := v.resolveWritable("rename", newpath)
+	if err != nil {
+		return err
+	}
+	if ro.mountPath != rn.mountPath {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errCrossMount}
+	}
+	if ro.mount.noDelete {
+		return ro.deny("rename", "nodelete")
+	}
+	return ro.fs.Rename(ro.name, rn.name)
+}
+
+// RemoveAll deletes the file or directory at the specified virtual path,
+// with everything it contains. Symlinks are removed, not followed. It
+// does nothing if the path does not exist.
+//
+// Warnings:
+//   - This operation is permanent.
+//   - Mount points cannot be removed.
+//   - It is denied (*MountPermissionError) on mounts with the ro or nodelete option.
+func (v *VirtualEnvironment) RemoveAll(path string) error {
+	r, err := v.resolveWritable("remove", path)
+	if err != nil {
+		return err
+	}
+	if r.mount.noDelete {
+		return r.deny("remove", "nodelete")
+	}
+	if r.name == "." {
+		return &fs.PathError{Op: "remove", Path: path, Err: fs.ErrPermission}
+	}
+	return removeAll(r.fs, r.name)
+}
+
+// Symlink creates a symlink at the virtual path link, pointing to the virtual
+// path target (relative to the directory of link, if not absolute).
+//
+// Symlink policy: symlinks stay on their mount. The target must be on the
+// same mount as link, and is stored relative to link so that it is valid
+// on the host as well. Since the relative path is computed from the
+// virtual paths, neither the directory of link nor that of target may be
+// reached through a symlink (errSymlinkDir). Symlinks that resolve outside
+// of their mount (e.g. created on the host) are never followed. Only host
+// directories support symlinks; other filesystems return an error wrapping
+// errors.ErrUnsupported.
+//
+// It is denied (*MountPermissionError) on mounts with the ro option.
+func (v *VirtualEnvironment) Symlink(target, link string) error {
+	rl, err := v.resolveWritable("symlink", link)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(target, "/") {
+		target = vpath.Join(vpath.Dir(rl.virtual()), target)
+	}
+	rt, err := v.resolve(target)
+	if err != nil {
+		return err
+	}
+	if rt.mountPath != rl.mountPath {
+		return &os.LinkError{Op: "symlink", Old: target, New: link, Err: errCrossMount}
+	}
+	if hasSymlinkDir(rl.fs, rl.name) || hasSymlinkDir(rt.fs, rt.name) {
+		return &os.LinkError{Op: "symlink", Old: target, New: link, Err: errSymlinkDir}
+	}
+	return rl.fs.Symlink(relName(vpath.Dir(rl.name), rt.name), rl.name)
+}
+
+// hasSymlinkDir reports whether a directory leading to name in fsys (name
+// itself excepted) is a symlink.
+func hasSymlinkDir(fsys FileSystem, name string) bool {
+	for dir := vpath.Dir(name); dir != "."; dir = vpath.Dir(dir) {
+		if info, err := fsys.Lstat(dir); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// relName returns the slash-separated path of name relative to dir, both
+// being clean names of the same filesystem.
+func relName(dir, name string) string {
+	split := func(p string) []string {
+		if p == "." {
+			return nil
+		}
+		return strings.Split(p, "/")
+	}
+	from, to := split(dir), split(name)
+	i := 0
+	for i < len(from) && i < len(to) && from[i] == to[i] {
+		i++
+	}
+	var parts []string
+	for range from[i:] {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, to[i:]...)
+	if len(parts) == 0 {
+		return "."
+	}
+	return strings.Join(parts, "/")
+}
+
+// --- Hashing ---
+
+// hashAlgorithms are the algorithms of HashFile.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// HashFile returns the hex-encoded digest of the file at the specified
+// virtual path. The file is streamed, so it can be of any size.
+//
+// Arguments:
+//   - path: The virtual path of the file.
+//   - algorithm: "md5", "sha1", "sha256" or "sha512".
+//
+// Returns an error if the algorithm is unknown, the path cannot be resolved
+// or reading fails.
+func (v *VirtualEnvironment) HashFile(path, algorithm string) (string, error) {
+	newHash, ok := hashAlgorithms[algorithm]
+	if !ok {
+		names := make([]string, 0, len(hashAlgorithms))
+		for name := range hashAlgorithms {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("unknown hash algorithm %q (must be one of %s)", algorithm, strings.Join(names, ", "))
+	}
+
+	f, err := v.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
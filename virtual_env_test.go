@@ -0,0 +1,319 @@
+package kuniumi
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEscapeTestEnv returns an environment mounting a host directory at
+// /data, next to a directory holding a secret that must stay unreachable.
+// The mounted directory contains symlinks pointing inside and outside of it.
+func newEscapeTestEnv(t *testing.T) (env *VirtualEnvironment, dataDir, outsideDir string) {
+	t.Helper()
+	base := t.TempDir()
+	dataDir = filepath.Join(base, "data")
+	outsideDir = filepath.Join(base, "database")
+	require.NoError(t, os.MkdirAll(filepath.Join(dataDir, "sub"), 0755))
+	require.NoError(t, os.Mkdir(outsideDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "sub", "public.txt"), []byte("public"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(outsideDir, "secret.txt"), []byte("secret"), 0600))
+
+	for link, target := range map[string]string{
+		"abs-file":  filepath.Join(outsideDir, "secret.txt"),
+		"abs-dir":   outsideDir,
+		"rel-file":  filepath.Join("..", "database", "secret.txt"),
+		"rel-dir":   filepath.Join("..", "database"),
+		"sub/up":    filepath.Join("..", "..", "database"),
+		"inside":    filepath.Join("sub", "public.txt"),
+		"inside-up": filepath.Join("sub", "..", "sub", "public.txt"),
+	} {
+		require.NoError(t, os.Symlink(target, filepath.Join(dataDir, filepath.FromSlash(link))), "the escape tests need symlinks")
+	}
+
+	env = NewVirtualEnvironment(nil, map[string]string{dataDir: "/data"})
+	return env, dataDir, outsideDir
+}
+
+func TestVirtualEnvironment_PrefixBoundary(t *testing.T) {
+	env, _, _ := newEscapeTestEnv(t)
+	env.mount("/data/sub/deep", mountPoint{fs: NewMemFS()})
+
+	for _, path := range []string{"/database/secret.txt", "/data2", "/dat", "/", "/datasub/public.txt"} {
+		_, err := env.ReadFile(path, 0, 100)
+		assert.ErrorContains(t, err, "path not mounted", path)
+	}
+
+	data, err := env.ReadFile("/data/sub/public.txt", 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "public", string(data))
+
+	// The longest mount wins, at segment boundaries only
+	require.NoError(t, env.WriteFile("/data/sub/deep/x.txt", []byte("mem")))
+	r, err := env.resolve("/data/sub/deeper")
+	require.NoError(t, err)
+	assert.Equal(t, "/data", r.mountPath)
+	assert.Equal(t, "sub/deeper", r.name)
+
+	// Mount paths given with a trailing slash match as well
+	env = NewVirtualEnvironment(nil, map[string]string{t.TempDir(): "/out/"})
+	assert.NoError(t, env.WriteFile("/out/a.txt", nil))
+}
+
+func TestVirtualEnvironment_TraversalEscapes(t *testing.T) {
+	env, _, _ := newEscapeTestEnv(t)
+
+	for _, path := range []string{
+		"/data/../database/secret.txt",
+		"/data/sub/../../database/secret.txt",
+		"../database/secret.txt",
+		"/../../database/secret.txt",
+		"/data/..",
+	} {
+		_, err := env.ReadFile(path, 0, 100)
+		assert.ErrorContains(t, err, "path not mounted", path)
+	}
+
+	// Relative paths cannot climb out of the current directory's mount either
+	require.NoError(t, env.ChangeCurrentDirectory("/data/sub"))
+	_, err := env.ReadFile("../../database/secret.txt", 0, 100)
+	assert.ErrorContains(t, err, "path not mounted")
+	data, err := env.ReadFile("../sub/./public.txt", 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "public", string(data))
+}
+
+func TestVirtualEnvironment_SymlinkEscapes(t *testing.T) {
+	env, dataDir, outsideDir := newEscapeTestEnv(t)
+	secret := filepath.Join(outsideDir, "secret.txt")
+
+	escapes := []string{
+		"/data/abs-file", "/data/rel-file",
+		"/data/abs-dir/secret.txt", "/data/rel-dir/secret.txt", "/data/sub/up/secret.txt",
+	}
+	for _, path := range escapes {
+		_, err := env.ReadFile(path, 0, 100)
+		assert.Error(t, err, "read %s", path)
+		assert.Error(t, env.WriteFile(path, []byte("pwned")), "write %s", path)
+		assert.Error(t, env.RewriteFile(path, 0, []byte("pwned")), "rewrite %s", path)
+		assert.Error(t, env.CopyFile(path, "/data/copy.txt"), "copy from %s", path)
+		assert.Error(t, env.CopyFile("/data/sub/public.txt", path), "copy to %s", path)
+		assert.Error(t, env.Chmod(path, 0777), "chmod %s", path)
+	}
+	for _, dir := range []string{"/data/abs-dir", "/data/rel-dir", "/data/sub/up"} {
+		_, err := env.ListFile(dir)
+		assert.Error(t, err, "list %s", dir)
+		_, err = env.FindFile(dir, "*", true)
+		assert.Error(t, err, "find in %s", dir)
+		assert.Error(t, env.ChangeCurrentDirectory(dir), "cd %s", dir)
+	}
+	// Writing through a dangling symlink must not create the target
+	require.NoError(t, os.Symlink(filepath.Join(outsideDir, "created.txt"), filepath.Join(dataDir, "dangling")))
+	assert.Error(t, env.WriteFile("/data/dangling", []byte("pwned")))
+
+	// The outside directory is untouched
+	data, err := os.ReadFile(secret)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(data))
+	info, err := os.Stat(secret)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	_, err = os.Stat(filepath.Join(outsideDir, "created.txt"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(filepath.Join(dataDir, "copy.txt"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Removing a symlink removes the link, not its target
+	require.NoError(t, env.RemoveFile("/data/abs-file"))
+	_, err = os.Stat(secret)
+	assert.NoError(t, err)
+
+	// FindFile does not descend into symlinked directories
+	matches, err := env.FindFile("/data", "secret.txt", true)
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+}
+
+func TestVirtualEnvironment_SymlinksInside(t *testing.T) {
+	env, _, _ := newEscapeTestEnv(t)
+
+	for _, path := range []string{"/data/inside", "/data/inside-up"} {
+		data, err := env.ReadFile(path, 0, 100)
+		require.NoError(t, err, path)
+		assert.Equal(t, "public", string(data), path)
+	}
+	require.NoError(t, env.WriteFile("/data/inside", []byte("changed")))
+	data, err := env.ReadFile("/data/sub/public.txt", 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "changed", string(data))
+}
+
+func TestVirtualEnvironment_OverlayHostEscapes(t *testing.T) {
+	_, dataDir, _ := newEscapeTestEnv(t)
+
+	// The lower layer of a host overlay is confined as well
+	virt, m, err := parseMountSpec("overlay:"+dataDir+":/tmpl", nil)
+	require.NoError(t, err)
+	env := NewVirtualEnvironment(nil, nil)
+	env.mount(virt, m)
+
+	_, err = env.ReadFile("/tmpl/abs-dir/secret.txt", 0, 100)
+	assert.Error(t, err)
+	assert.Error(t, env.WriteFile("/tmpl/rel-file", nil))
+	data, err := env.ReadFile("/tmpl/inside", 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "public", string(data))
+}
+
+func TestVirtualEnvironment_SymlinkPolicy(t *testing.T) {
+	env, dataDir, outsideDir := newEscapeTestEnv(t)
+	env.Mount("/tmp", NewMemFS())
+
+	// Links are stored relative to their directory
+	require.NoError(t, env.Symlink("/data/sub/public.txt", "/data/sub/link"))
+	target, err := os.Readlink(filepath.Join(dataDir, "sub", "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "public.txt", target)
+	require.NoError(t, env.MkdirAll("/data/a/b"))
+	require.NoError(t, env.Symlink("../../sub", "/data/a/b/up"))
+	data, err := env.ReadFile("/data/a/b/up/public.txt", 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "public", string(data))
+
+	info, err := env.Stat("/data/sub/link")
+	require.NoError(t, err)
+	assert.True(t, info.Mode.IsRegular(), "Stat follows links")
+	files, err := env.ListFile("/data/sub")
+	require.NoError(t, err)
+	for _, f := range files {
+		if f.Name == "link" {
+			assert.Equal(t, fs.ModeSymlink, f.Mode.Type(), "ListFile does not follow links")
+		}
+	}
+
+	// Targets on other mounts or outside of any mount are rejected
+	assert.ErrorIs(t, env.Symlink("/tmp", "/data/tmp"), errCrossMount)
+	assert.ErrorContains(t, env.Symlink("../../database/secret.txt", "/data/sub/secret"), "path not mounted")
+	assert.ErrorIs(t, env.Symlink("/data/sub", "/tmp/link"), errCrossMount)
+	assert.ErrorIs(t, env.Symlink("/tmp/x", "/tmp/link"), errors.ErrUnsupported)
+
+	// Names cannot be created or moved through escaping links
+	assert.Error(t, env.Symlink("/data/sub/public.txt", "/data/abs-dir/link"))
+	assert.Error(t, env.Rename("/data/sub/public.txt", "/data/rel-dir/public.txt"))
+	assert.Error(t, env.Rename("/data/sub/up/secret.txt", "/data/secret.txt"))
+	assert.Error(t, env.MkdirAll("/data/abs-dir/x"))
+	_, err = os.Lstat(filepath.Join(outsideDir, "link"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Lstat(filepath.Join(outsideDir, "x"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Relative targets are not computed through symlinked directories,
+	// whose host path differs from the virtual one
+	require.NoError(t, env.Symlink("/data", "/data/self"))
+	require.NoError(t, env.MkdirAll("/data/b"))
+	assert.ErrorIs(t, env.Symlink("/data/t", "/data/self/b/l"), errSymlinkDir)
+	assert.ErrorIs(t, env.Symlink("/data/self/b", "/data/l"), errSymlinkDir)
+	_, err = os.Lstat(filepath.Join(dataDir, "b", "l"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, env.Symlink("/data/self", "/data/b/self"), "links to symlinks are kept")
+	require.NoError(t, env.RemoveFile("/data/b/self"))
+
+	// Renaming and removing act on links, not on their targets
+	require.NoError(t, env.Rename("/data/abs-dir", "/data/renamed"))
+	_, err = os.Stat(outsideDir)
+	assert.NoError(t, err)
+	require.NoError(t, env.RemoveAll("/data/sub"))
+	require.NoError(t, env.RemoveAll("/data/renamed"))
+	_, err = os.Stat(filepath.Join(outsideDir, "secret.txt"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dataDir, "sub"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.ErrorIs(t, env.RemoveAll("/data"), fs.ErrPermission, "mount points cannot be removed")
+}
+
+// oneByteFS serves files that return a single byte per Read.
+type oneByteFS struct {
+	fstest.MapFS
+}
+
+func (o oneByteFS) Open(name string) (fs.File, error) {
+	f, err := o.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &oneByteFile{File: f}, nil
+}
+
+type oneByteFile struct {
+	fs.File
+}
+
+func (f *oneByteFile) Read(p []byte) (int, error) {
+	return f.File.Read(p[:min(len(p), 1)])
+}
+
+func (f *oneByteFile) Seek(offset int64, whence int) (int64, error) {
+	return f.File.(io.Seeker).Seek(offset, whence)
+}
+
+func TestVirtualEnvironment_ReadFileShortReads(t *testing.T) {
+	env := NewVirtualEnvironment(nil, nil)
+	env.Mount("/slow", NewReadOnlyFS(oneByteFS{fstest.MapFS{"a.txt": {Data: []byte("hello world")}}}))
+	env.Mount("/out", NewMemFS())
+
+	data, err := env.ReadFile("/slow/a.txt", 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+	data, err = env.ReadFile("/slow/a.txt", 6, 3)
+	require.NoError(t, err)
+	assert.Equal(t, "wor", string(data))
+	data, err = env.ReadFile("/slow/a.txt", 20, 3)
+	require.NoError(t, err)
+	assert.Empty(t, data)
+
+	require.NoError(t, env.CopyFile("/slow/a.txt", "/out/a.txt"))
+	data, err = env.ReadFile("/out/a.txt", 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+}
+
+func TestVirtualEnvironment_CopyFileSameFile(t *testing.T) {
+	env, _, _ := newEscapeTestEnv(t)
+
+	for _, dst := range []string{"/data/sub/public.txt", "/data/sub/../sub/public.txt", "/data/inside"} {
+		assert.ErrorIs(t, env.CopyFile("/data/sub/public.txt", dst), errSameFile, dst)
+	}
+	data, err := env.ReadFile("/data/sub/public.txt", 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "public", string(data), "the source is not truncated")
+}
+
+func TestVirtualEnvironment_Close(t *testing.T) {
+	env, dataDir, _ := newEscapeTestEnv(t)
+	virt, m, err := parseMountSpec("overlay:"+dataDir+":/tmpl", nil)
+	require.NoError(t, err)
+	env.mount(virt, m)
+	env.Mount("/scratch", NewMemFS())
+	require.NoError(t, env.WriteFile("/data/new.txt", []byte("new")))
+
+	// Closing a clone leaves the shared mounts open
+	require.NoError(t, env.Clone().Close())
+	_, err = env.ReadFile("/data/new.txt", 0, 100)
+	require.NoError(t, err)
+	clone := env.Clone()
+
+	require.NoError(t, env.Close())
+	_, err = env.ReadFile("/data/new.txt", 0, 100)
+	assert.ErrorIs(t, err, fs.ErrClosed)
+	_, err = clone.ReadFile("/tmpl/sub/public.txt", 0, 100)
+	assert.ErrorIs(t, err, fs.ErrClosed)
+	assert.NoError(t, env.WriteFile("/scratch/a.txt", nil), "filesystems mounted with Mount are left open")
+	assert.NoError(t, env.Close())
+}
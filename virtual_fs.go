@@ -0,0 +1,477 @@
+package kuniumi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	vpath "path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileSystem is a filesystem that can be mounted into a VirtualEnvironment.
+//
+// Names are slash-separated paths relative to the root of the filesystem,
+// as accepted by fs.ValidPath ("." is the root). Errors are *fs.PathError
+// values wrapping fs.ErrNotExist, fs.ErrExist, fs.ErrPermission, etc.
+//
+// Implementations provided by Kuniumi:
+//   - NewHostFS: a directory of the host.
+//   - NewMemFS: an in-memory filesystem.
+//   - NewReadOnlyFS: a read-only fs.FS, such as an embed.FS.
+//   - NewOverlayFS: a copy-on-write layer over a read-only fs.FS.
+type FileSystem interface {
+	fs.FS
+
+	// OpenFile opens the named file with the flags of os.OpenFile
+	// (os.O_RDONLY, os.O_CREATE, ...), creating it with perm if needed.
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	// Stat returns the file info of the named file, following symlinks.
+	Stat(name string) (fs.FileInfo, error)
+	// Lstat is like Stat, but describes a symlink itself.
+	Lstat(name string) (fs.FileInfo, error)
+	// ReadDir returns the entries of the named directory, sorted by name.
+	ReadDir(name string) ([]fs.DirEntry, error)
+	// Mkdir creates the named directory.
+	Mkdir(name string, perm fs.FileMode) error
+	// Remove removes the named file or empty directory.
+	Remove(name string) error
+	// Chmod changes the permissions of the named file.
+	Chmod(name string, mode fs.FileMode) error
+	// Rename moves the named file or directory to newname, replacing an
+	// existing file at newname.
+	Rename(oldname, newname string) error
+	// Symlink creates newname as a symlink to oldname, a slash-separated
+	// path relative to the directory of newname. Filesystems without
+	// symlinks return an error wrapping errors.ErrUnsupported.
+	Symlink(oldname, newname string) error
+}
+
+// File is an open file of a FileSystem. *os.File implements it.
+type File interface {
+	fs.File
+	io.Writer
+	io.Seeker
+	io.ReaderAt
+	io.WriterAt
+}
+
+// writeFlags are the flags of OpenFile that modify the filesystem.
+const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_TRUNC | os.O_APPEND
+
+// errNotEmpty is returned when removing a directory that has entries.
+var errNotEmpty = errors.New("directory not empty")
+
+// errIsDir is returned when opening a directory for writing.
+var errIsDir = errors.New("is a directory")
+
+// errNotDir is returned when a directory is expected.
+var errNotDir = errors.New("not a directory")
+
+// checkName returns a *fs.PathError if name is not a valid FileSystem name.
+func checkName(op, name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+// readDirPage implements fs.ReadDirFile.ReadDir over the entries of a
+// directory, of which *pos were already returned.
+func readDirPage(entries []fs.DirEntry, pos *int, n int) ([]fs.DirEntry, error) {
+	entries = entries[min(*pos, len(entries)):]
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		entries = entries[:min(n, len(entries))]
+	}
+	*pos += len(entries)
+	return entries, nil
+}
+
+// mkdirAll creates the named directory of fsys with its missing parents.
+func mkdirAll(fsys FileSystem, name string, perm fs.FileMode) error {
+	if info, err := fsys.Stat(name); err == nil {
+		if !info.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: errNotDir}
+		}
+		return nil
+	}
+	if name != "." {
+		if err := mkdirAll(fsys, vpath.Dir(name), perm); err != nil {
+			return err
+		}
+	}
+	err := fsys.Mkdir(name, perm)
+	if errors.Is(err, fs.ErrExist) {
+		// Created concurrently
+		if info, statErr := fsys.Stat(name); statErr == nil && info.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+// removeAll removes the named file of fsys, with its content if it is a
+// directory. Symlinks are removed, not followed. A missing file is not an
+// error.
+func removeAll(fsys FileSystem, name string) error {
+	info, err := fsys.Lstat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := fsys.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := removeAll(fsys, vpath.Join(name, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if err := fsys.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// --- Host ---
+
+// hostFS is a directory of the host. Every operation goes through an
+// os.Root opened on the directory, which confines it to the directory:
+// ".." components and symlinks that resolve outside of it are rejected,
+// even if the directory is changed concurrently. The operations os.Root
+// does not provide (Chmod, Rename, Symlink) are implemented per platform.
+type hostFS struct {
+	dir string
+
+	mu     sync.Mutex
+	r      *os.Root // Opened on first use
+	closed bool
+}
+
+// NewHostFS returns a FileSystem for the host directory dir. The directory
+// is opened on first use and stays open until the FileSystem is closed: it
+// implements io.Closer. The mounts of a VirtualEnvironment are closed by
+// VirtualEnvironment.Close.
+func NewHostFS(dir string) FileSystem {
+	return &hostFS{dir: dir}
+}
+
+// root returns the os.Root of the directory, opening it if needed, and the
+// host name of name in it. The root stays open until Close.
+func (h *hostFS) root(op, name string) (*os.Root, string, error) {
+	if err := checkName(op, name); err != nil {
+		return nil, "", err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrClosed}
+	}
+	if h.r == nil {
+		// A directory that does not exist yet is opened on a later call
+		r, err := os.OpenRoot(h.dir)
+		if err != nil {
+			return nil, "", err
+		}
+		h.r = r
+	}
+	return h.r, filepath.FromSlash(name), nil
+}
+
+// Close closes the directory. Files opened from it stay open.
+func (h *hostFS) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	if h.r == nil {
+		return nil
+	}
+	return h.r.Close()
+}
+
+func (h *hostFS) Open(name string) (fs.File, error) {
+	return h.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (h *hostFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	root, p, err := h.root("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := root.OpenFile(p, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (h *hostFS) Stat(name string) (fs.FileInfo, error) {
+	root, p, err := h.root("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return root.Stat(p)
+}
+
+func (h *hostFS) Lstat(name string) (fs.FileInfo, error) {
+	root, p, err := h.root("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return root.Lstat(p)
+}
+
+func (h *hostFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	root, p, err := h.root("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := root.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := f.ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, err
+}
+
+func (h *hostFS) Mkdir(name string, perm fs.FileMode) error {
+	root, p, err := h.root("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return root.Mkdir(p, perm)
+}
+
+func (h *hostFS) Remove(name string) error {
+	root, p, err := h.root("remove", name)
+	if err != nil {
+		return err
+	}
+	return root.Remove(p)
+}
+
+// --- Read-only fs.FS ---
+
+// readOnlyFS exposes an fs.FS as a FileSystem rejecting modifications.
+type readOnlyFS struct {
+	fsys fs.FS
+}
+
+// NewReadOnlyFS returns a read-only FileSystem serving fsys, e.g. an
+// embed.FS shipped inside the binary. Use fs.Sub to mount a subdirectory
+// of an embed.FS.
+func NewReadOnlyFS(fsys fs.FS) FileSystem {
+	return &readOnlyFS{fsys: fsys}
+}
+
+func (r *readOnlyFS) Open(name string) (fs.File, error) {
+	return r.fsys.Open(name)
+}
+
+func (r *readOnlyFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if flag&writeFlags != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	f, err := r.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyFile{File: f, name: name}, nil
+}
+
+func (r *readOnlyFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(r.fsys, name)
+}
+
+// Lstat is Stat: fs.FS does not expose symlinks.
+func (r *readOnlyFS) Lstat(name string) (fs.FileInfo, error) {
+	return fs.Stat(r.fsys, name)
+}
+
+func (r *readOnlyFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(r.fsys, name)
+}
+
+func (r *readOnlyFS) Mkdir(name string, perm fs.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+}
+
+func (r *readOnlyFS) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+}
+
+func (r *readOnlyFS) Chmod(name string, mode fs.FileMode) error {
+	return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrPermission}
+}
+
+func (r *readOnlyFS) Rename(oldname, newname string) error {
+	return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrPermission}
+}
+
+func (r *readOnlyFS) Symlink(oldname, newname string) error {
+	return &fs.PathError{Op: "symlink", Path: newname, Err: fs.ErrPermission}
+}
+
+// readOnlyFile is a file of a readOnlyFS.
+type readOnlyFile struct {
+	fs.File
+	name string
+}
+
+func (f *readOnlyFile) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+}
+
+func (f *readOnlyFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+}
+
+func (f *readOnlyFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.File.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errors.ErrUnsupported}
+}
+
+func (f *readOnlyFile) ReadAt(p []byte, off int64) (int, error) {
+	if r, ok := f.File.(io.ReaderAt); ok {
+		return r.ReadAt(p, off)
+	}
+	return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.ErrUnsupported}
+}
+
+// ReadDir lists the directory, if the underlying file is a directory.
+func (f *readOnlyFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d, ok := f.File.(fs.ReadDirFile); ok {
+		return d.ReadDir(n)
+	}
+	return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.ErrUnsupported}
+}
+
+// --- Mount specs ---
+
+// parseMountSpec parses a --mount flag, SOURCE:/VIRTUAL[:OPTIONS]. The
+// source selects the filesystem mounted at the virtual path:
+//
+//	HOST:/virt           host directory
+//	mem:/virt            empty in-memory filesystem
+//	embed:/virt          filesystem registered with WithFS, named after the
+//	embed:NAME:/virt     base name of the virtual path or NAME (read-only)
+//	overlay:/virt        in-memory copy-on-write layer over a registered
+//	overlay:NAME:/virt   filesystem, or over the host directory NAME
+//
+// OPTIONS is a comma-separated list of permissions (see parseMountOptions),
+// e.g. HOST:/virt:ro. filesystems are the filesystems registered with WithFS.
+func parseMountSpec(spec string, filesystems map[string]fs.FS) (string, mountPoint, error) {
+	invalid := func() (string, mountPoint, error) {
+		return "", mountPoint{}, fmt.Errorf("invalid --mount %q: expected SOURCE:/VIRTUAL[:OPTIONS]", spec)
+	}
+
+	// Split by the last colon: host paths may contain colons (C:\foo:/bar).
+	// A last part that is not a virtual path holds the options.
+	rest, opts := spec, ""
+	if i := strings.LastIndex(rest, ":"); i > 0 && !strings.HasPrefix(rest[i+1:], "/") {
+		rest, opts = rest[:i], rest[i+1:]
+	}
+	lastColon := strings.LastIndex(rest, ":")
+	if lastColon <= 0 || !strings.HasPrefix(rest[lastColon+1:], "/") {
+		return invalid()
+	}
+	source, virt := rest[:lastColon], vpath.Clean(rest[lastColon+1:])
+
+	var m mountPoint
+	scheme, name, _ := strings.Cut(source, ":")
+	switch scheme {
+	case "mem":
+		if name != "" {
+			return invalid()
+		}
+		m = mountPoint{fs: NewMemFS(), source: "mem"}
+
+	case "embed", "overlay":
+		if name == "" {
+			name = vpath.Base(virt)
+		}
+		if fsys, ok := filesystems[name]; ok {
+			if scheme == "embed" {
+				m = mountPoint{fs: NewReadOnlyFS(fsys), source: "embed:" + name, readOnly: true}
+			} else {
+				m = mountPoint{fs: NewOverlayFS(fsys, NewMemFS()), source: "overlay:" + name}
+			}
+			break
+		}
+		if scheme == "embed" {
+			return "", mountPoint{}, fmt.Errorf("invalid --mount %q: no filesystem named %q (register it with kuniumi.WithFS)", spec, name)
+		}
+		dir, err := filepath.Abs(name)
+		if err != nil {
+			return "", mountPoint{}, err
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return "", mountPoint{}, fmt.Errorf("invalid --mount %q: %q is neither a registered filesystem nor a host directory", spec, name)
+		}
+		lower := &hostFS{dir: dir}
+		m = mountPoint{fs: NewOverlayFS(lower, NewMemFS()), source: "overlay:" + dir, closer: lower}
+
+	default:
+		m = mountPoint{host: source}
+	}
+
+	if err := parseMountOptions(opts, &m); err != nil {
+		return "", mountPoint{}, fmt.Errorf("invalid --mount %q: %w", spec, err)
+	}
+	if scheme == "embed" && !m.readOnly {
+		return "", mountPoint{}, fmt.Errorf("invalid --mount %q: embedded filesystems are read-only", spec)
+	}
+	return virt, m, nil
+}
+
+// parseMountOptions sets the permissions of m from comma-separated options:
+//
+//	ro        read-only: no write, copy, chmod or removal
+//	rw        read-write (default)
+//	noexec    no execute permission bits (Chmod)
+//	nodelete  no removal of files
+func parseMountOptions(opts string, m *mountPoint) error {
+	if opts == "" {
+		return nil
+	}
+	for _, opt := range strings.Split(opts, ",") {
+		switch opt {
+		case "ro":
+			m.readOnly = true
+		case "rw":
+			m.readOnly = false
+		case "noexec":
+			m.noExec = true
+		case "nodelete":
+			m.noDelete = true
+		default:
+			return fmt.Errorf("unknown option %q (must be ro, rw, noexec or nodelete)", opt)
+		}
+	}
+	return nil
+}
+
+// mountSpec returns the --mount flag of m mounted at virt, with source
+// being the host directory for host mounts.
+func mountSpec(source, virt string, m mountPoint) string {
+	spec := source + ":" + virt
+	if opts := m.options(); opts != "" {
+		spec += ":" + opts
+	}
+	return spec
+}
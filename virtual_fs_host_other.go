@@ -0,0 +1,75 @@
+//go:build !unix
+
+package kuniumi
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+func (h *hostFS) Chmod(name string, mode fs.FileMode) error {
+	root, p, err := h.root("chmod", name)
+	if err != nil {
+		return err
+	}
+	// Change the mode of the opened file, so that a symlink cannot redirect it
+	f, err := root.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Chmod(mode)
+}
+
+// hostPath returns the host path of p, a name in root, after checking that
+// its parent directory resolves inside the root. It serves Rename and
+// Symlink, which do not follow the last element of p.
+//
+// Known limitation: the path is used after the check, so a parent replaced
+// by a symlink in between is followed. Unix systems use the *at system
+// calls instead, which have no such window.
+func (h *hostFS) hostPath(root *os.Root, op, p string) (string, error) {
+	if p == "." {
+		return "", &fs.PathError{Op: op, Path: p, Err: fs.ErrInvalid}
+	}
+	dir, err := root.Stat(filepath.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	if !dir.IsDir() {
+		return "", &fs.PathError{Op: op, Path: p, Err: errNotDir}
+	}
+	return filepath.Join(h.dir, p), nil
+}
+
+func (h *hostFS) Rename(oldname, newname string) error {
+	if err := checkName("rename", newname); err != nil {
+		return err
+	}
+	root, oldp, err := h.root("rename", oldname)
+	if err != nil {
+		return err
+	}
+	oldPath, err := h.hostPath(root, "rename", oldp)
+	if err != nil {
+		return err
+	}
+	newPath, err := h.hostPath(root, "rename", filepath.FromSlash(newname))
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func (h *hostFS) Symlink(oldname, newname string) error {
+	root, p, err := h.root("symlink", newname)
+	if err != nil {
+		return err
+	}
+	path, err := h.hostPath(root, "symlink", p)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(filepath.FromSlash(oldname), path)
+}
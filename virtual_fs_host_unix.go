@@ -0,0 +1,125 @@
+//go:build unix
+
+package kuniumi
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// openParent opens the parent directory of p, a name in root, and returns
+// it with the last element of p. Operations relative to the directory
+// (renameat, symlinkat, ...) stay inside the root, even if the path to the
+// directory is changed concurrently.
+func openParent(root *os.Root, op, p string) (*os.File, string, error) {
+	if p == "." {
+		return nil, "", &fs.PathError{Op: op, Path: p, Err: fs.ErrInvalid}
+	}
+	dir, err := root.Open(filepath.Dir(p))
+	if err != nil {
+		return nil, "", err
+	}
+	return dir, filepath.Base(p), nil
+}
+
+func (h *hostFS) Chmod(name string, mode fs.FileMode) error {
+	root, p, err := h.root("chmod", name)
+	if err != nil {
+		return err
+	}
+	dir, base, err := openParent(root, "chmod", p)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	dirfd := int(dir.Fd())
+
+	var st unix.Stat_t
+	if err := unix.Fstatat(dirfd, base, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &fs.PathError{Op: "chmod", Path: name, Err: err}
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		// Change the mode of the file the symlink resolves to in the root.
+		// O_NONBLOCK keeps a FIFO from blocking the open.
+		f, err := root.OpenFile(p, os.O_RDONLY|unix.O_NONBLOCK, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return f.Chmod(mode)
+	}
+
+	// Not opening the file lets the mode of files without read permission be
+	// changed. Without fchmodat2 (Linux before 6.6), AT_SYMLINK_NOFOLLOW is
+	// not supported, and a symlink swapped in since the check above would
+	// be followed.
+	err = unix.Fchmodat(dirfd, base, unixMode(mode), unix.AT_SYMLINK_NOFOLLOW)
+	if errors.Is(err, unix.EOPNOTSUPP) {
+		err = unix.Fchmodat(dirfd, base, unixMode(mode), 0)
+	}
+	if err != nil {
+		return &fs.PathError{Op: "chmod", Path: name, Err: err}
+	}
+	return nil
+}
+
+// unixMode returns the mode bits of mode for chmod, as os.Chmod does.
+func unixMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= unix.S_ISUID
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= unix.S_ISGID
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= unix.S_ISVTX
+	}
+	return m
+}
+
+func (h *hostFS) Rename(oldname, newname string) error {
+	if err := checkName("rename", newname); err != nil {
+		return err
+	}
+	root, oldp, err := h.root("rename", oldname)
+	if err != nil {
+		return err
+	}
+	oldDir, oldBase, err := openParent(root, "rename", oldp)
+	if err != nil {
+		return err
+	}
+	defer oldDir.Close()
+	newDir, newBase, err := openParent(root, "rename", filepath.FromSlash(newname))
+	if err != nil {
+		return err
+	}
+	defer newDir.Close()
+
+	if err := unix.Renameat(int(oldDir.Fd()), oldBase, int(newDir.Fd()), newBase); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (h *hostFS) Symlink(oldname, newname string) error {
+	root, p, err := h.root("symlink", newname)
+	if err != nil {
+		return err
+	}
+	dir, base, err := openParent(root, "symlink", p)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	if err := unix.Symlinkat(filepath.FromSlash(oldname), int(dir.Fd()), base); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+//go:build unix
+
+package kuniumi
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostFS_OpenedOnce(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dir")
+	h := NewHostFS(dir)
+
+	// The directory is opened on first use, not when it is mounted
+	_, err := h.Stat(".")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, os.Mkdir(dir, 0755))
+	require.NoError(t, h.Mkdir("sub", 0755))
+
+	// and stays open: a directory moved away is still the one served
+	moved := dir + ".moved"
+	require.NoError(t, os.Rename(dir, moved))
+	require.NoError(t, os.Mkdir(dir, 0755))
+	_, err = h.Stat("sub")
+	require.NoError(t, err)
+
+	require.NoError(t, h.(io.Closer).Close())
+	_, err = h.Stat("sub")
+	assert.ErrorIs(t, err, os.ErrClosed)
+}
+
+func TestHostFS_Chmod(t *testing.T) {
+	dir := t.TempDir()
+	h := NewHostFS(dir)
+
+	// Files without read permission can be made readable again
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "locked.txt"), []byte("x"), 0000))
+	require.NoError(t, h.Chmod("locked.txt", 0644))
+	info, err := os.Stat(filepath.Join(dir, "locked.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	// FIFOs are not opened, which would block until a writer comes
+	require.NoError(t, syscall.Mkfifo(filepath.Join(dir, "fifo"), 0600))
+	done := make(chan error, 1)
+	go func() { done <- h.Chmod("fifo", 0640) }()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("chmod of a FIFO blocked")
+	}
+	info, err = os.Lstat(filepath.Join(dir, "fifo"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	// Symlinks are followed inside the directory only
+	require.NoError(t, os.Symlink("locked.txt", filepath.Join(dir, "link")))
+	require.NoError(t, h.Chmod("link", 0600))
+	info, err = os.Stat(filepath.Join(dir, "locked.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	outside := filepath.Join(t.TempDir(), "outside.txt")
+	require.NoError(t, os.WriteFile(outside, nil, 0644))
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "escape")))
+	assert.Error(t, h.Chmod("escape", 0777))
+	info, err = os.Stat(outside)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+}
@@ -0,0 +1,417 @@
+package kuniumi
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	vpath "path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memFS is an in-memory filesystem. Open files share the content of their
+// node, so writes are visible to other open files, as on a host filesystem.
+type memFS struct {
+	mu    sync.RWMutex
+	nodes map[string]*memNode // Name -> node; "." is the root directory
+}
+
+// memNode is a file or directory of a memFS.
+type memNode struct {
+	mode    fs.FileMode
+	modTime time.Time
+	data    []byte
+}
+
+// maxMemFileSize is the largest size of a memFS file. Writes beyond it,
+// e.g. at a mistyped offset, fail rather than exhaust the memory.
+const maxMemFileSize = 4 << 30
+
+// errFileTooLarge is returned by writes that would grow a memFS file
+// beyond maxMemFileSize.
+var errFileTooLarge = errors.New("file too large")
+
+// NewMemFS returns an empty in-memory FileSystem. Its content lives as
+// long as the FileSystem, which makes it suitable for scratch space and
+// for tests that should not touch the disk. Files are limited to 4 GiB.
+func NewMemFS() FileSystem {
+	return &memFS{nodes: map[string]*memNode{
+		".": {mode: fs.ModeDir | 0755, modTime: time.Now()},
+	}}
+}
+
+// parent returns the parent directory node of name, which must exist.
+// The caller holds m.mu.
+func (m *memFS) parent(op, name string) (*memNode, error) {
+	dir, ok := m.nodes[vpath.Dir(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if !dir.mode.IsDir() {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return dir, nil
+}
+
+// children returns the sorted names of the entries of directory name.
+// The caller holds m.mu.
+func (m *memFS) children(name string) []string {
+	var names []string
+	for p := range m.nodes {
+		if p != "." && vpath.Dir(p) == name {
+			names = append(names, p)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *memFS) Open(name string) (fs.File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if err := checkName("open", name); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.nodes[name]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		dir, err := m.parent("open", name)
+		if err != nil {
+			return nil, err
+		}
+		node = &memNode{mode: perm & fs.ModePerm, modTime: time.Now()}
+		m.nodes[name] = node
+		dir.modTime = node.modTime
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case node.mode.IsDir() && flag&writeFlags != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errIsDir}
+	}
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+	return &memFile{fs: m, name: name, node: node, flag: flag}, nil
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	if err := checkName("stat", name); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	node, ok := m.nodes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return node.info(name), nil
+}
+
+// Lstat is Stat: a memFS has no symlinks.
+func (m *memFS) Lstat(name string) (fs.FileInfo, error) {
+	return m.Stat(name)
+}
+
+func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := checkName("readdir", name); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	node, ok := m.nodes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if !node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return m.entries(name), nil
+}
+
+// entries returns the entries of directory name. The caller holds m.mu.
+func (m *memFS) entries(name string) []fs.DirEntry {
+	children := m.children(name)
+	entries := make([]fs.DirEntry, len(children))
+	for i, p := range children {
+		entries[i] = fs.FileInfoToDirEntry(m.nodes[p].info(p))
+	}
+	return entries
+}
+
+func (m *memFS) Mkdir(name string, perm fs.FileMode) error {
+	if err := checkName("mkdir", name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.nodes[name]; ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	dir, err := m.parent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	m.nodes[name] = &memNode{mode: fs.ModeDir | perm&fs.ModePerm, modTime: time.Now()}
+	dir.modTime = time.Now()
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	if err := checkName("remove", name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.nodes[name]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	if node.mode.IsDir() && len(m.children(name)) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+	}
+	delete(m.nodes, name)
+	m.nodes[vpath.Dir(name)].modTime = time.Now()
+	return nil
+}
+
+func (m *memFS) Chmod(name string, mode fs.FileMode) error {
+	if err := checkName("chmod", name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.nodes[name]
+	if !ok {
+		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrNotExist}
+	}
+	node.mode = node.mode&^fs.ModePerm | mode&fs.ModePerm
+	return nil
+}
+
+func (m *memFS) Rename(oldname, newname string) error {
+	if err := checkName("rename", oldname); err != nil {
+		return err
+	}
+	if err := checkName("rename", newname); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.nodes[oldname]
+	switch {
+	case !ok:
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+	case oldname == "." || newname == "." || strings.HasPrefix(newname, oldname+"/"):
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrInvalid}
+	case oldname == newname:
+		return nil
+	}
+	if _, err := m.parent("rename", newname); err != nil {
+		return err
+	}
+	if target, ok := m.nodes[newname]; ok {
+		switch {
+		case target.mode.IsDir() && !node.mode.IsDir():
+			return &fs.PathError{Op: "rename", Path: newname, Err: errIsDir}
+		case !target.mode.IsDir() && node.mode.IsDir():
+			return &fs.PathError{Op: "rename", Path: newname, Err: errNotDir}
+		case target.mode.IsDir() && len(m.children(newname)) > 0:
+			return &fs.PathError{Op: "rename", Path: newname, Err: errNotEmpty}
+		}
+	}
+
+	// Move the node and, for directories, everything below it
+	moved := map[string]*memNode{newname: node}
+	for p, n := range m.nodes {
+		if rest, ok := strings.CutPrefix(p, oldname+"/"); ok {
+			moved[newname+"/"+rest] = n
+			delete(m.nodes, p)
+		}
+	}
+	delete(m.nodes, oldname)
+	for p, n := range moved {
+		m.nodes[p] = n
+	}
+	now := time.Now()
+	m.nodes[vpath.Dir(oldname)].modTime = now
+	m.nodes[vpath.Dir(newname)].modTime = now
+	return nil
+}
+
+func (m *memFS) Symlink(oldname, newname string) error {
+	return &fs.PathError{Op: "symlink", Path: newname, Err: errors.ErrUnsupported}
+}
+
+// info returns the file info of the node. The caller holds the lock of its memFS.
+func (n *memNode) info(name string) fs.FileInfo {
+	return &memFileInfo{name: vpath.Base(name), size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+// memFileInfo is a snapshot of the file info of a memNode.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() any           { return nil }
+
+// memFile is an open file of a memFS.
+type memFile struct {
+	fs     *memFS
+	name   string
+	node   *memNode
+	flag   int
+	offset int64
+	dirPos int // Entries already returned by ReadDir
+	closed bool
+}
+
+// check returns an error if the file is closed, or not open for writing
+// when write is set, or for reading otherwise.
+func (f *memFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	case write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0,
+		!write && f.flag&os.O_WRONLY != 0:
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	return f.node.info(f.name), nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if f.node.mode.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errIsDir}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.flag&os.O_APPEND != 0 {
+		f.fs.mu.RLock()
+		f.offset = int64(len(f.node.data))
+		f.fs.mu.RUnlock()
+	}
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrInvalid}
+	}
+	end := off + int64(len(p))
+	if end > maxMemFileSize || end < off {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: errFileTooLarge}
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if size := len(f.node.data); int(end) > size {
+		// Grow with spare capacity, so that sequential writes are linear
+		f.node.data = slices.Grow(f.node.data, int(end)-size)[:end]
+		clear(f.node.data[size:max(off, int64(size))])
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.fs.mu.RLock()
+		offset += int64(len(f.node.data))
+		f.fs.mu.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// ReadDir implements fs.ReadDirFile for directories.
+func (f *memFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrClosed}
+	}
+	if !f.node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.fs.mu.RLock()
+	entries := f.fs.entries(f.name)
+	f.fs.mu.RUnlock()
+	return readDirPage(entries, &f.dirPos, n)
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,389 @@
+package kuniumi
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	vpath "path"
+	"sort"
+	"sync"
+)
+
+// overlayFS is a copy-on-write filesystem: reads fall through to a
+// read-only lower layer, and files are copied to the upper layer before
+// they are modified. Removed lower files are hidden by whiteouts.
+type overlayFS struct {
+	lower FileSystem
+	upper FileSystem
+
+	mu        sync.Mutex
+	whiteouts map[string]bool // Names of removed lower files
+}
+
+// NewOverlayFS returns a FileSystem presenting lower with the changes
+// written to upper, which is typically NewMemFS(). lower is never modified:
+// an embed.FS or a host directory (NewHostFS) can serve as a writable
+// template whose changes are discarded with upper.
+func NewOverlayFS(lower fs.FS, upper FileSystem) FileSystem {
+	return &overlayFS{
+		lower:     NewReadOnlyFS(lower),
+		upper:     upper,
+		whiteouts: map[string]bool{},
+	}
+}
+
+// inUpper reports whether name exists in the upper layer.
+func (o *overlayFS) inUpper(name string) bool {
+	_, err := o.upper.Stat(name)
+	return err == nil
+}
+
+// stat returns the file info of name in the merged view. The caller holds o.mu.
+func (o *overlayFS) stat(name string) (fs.FileInfo, error) {
+	if info, err := o.upper.Stat(name); err == nil {
+		return info, nil
+	}
+	if o.whiteouts[name] {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return o.lower.Stat(name)
+}
+
+// lstat is stat, not following symlinks. The caller holds o.mu.
+func (o *overlayFS) lstat(name string) (fs.FileInfo, error) {
+	if info, err := o.upper.Lstat(name); err == nil {
+		return info, nil
+	}
+	if o.whiteouts[name] {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrNotExist}
+	}
+	return o.lower.Lstat(name)
+}
+
+// copyUp makes name (and its parent directories) exist in the upper layer
+// with the content of the lower layer, if it exists in the merged view.
+// The caller holds o.mu.
+func (o *overlayFS) copyUp(name string) error {
+	if name == "." || o.inUpper(name) {
+		return nil
+	}
+	if err := o.copyUp(vpath.Dir(name)); err != nil {
+		return err
+	}
+	if o.whiteouts[name] {
+		return nil
+	}
+	info, err := o.lower.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return o.upper.Mkdir(name, info.Mode().Perm())
+	}
+
+	src, err := o.lower.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := o.upper.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// copyUpAll is copyUp, copying the content of directories as well.
+// The caller holds o.mu.
+func (o *overlayFS) copyUpAll(name string) error {
+	if err := o.copyUp(name); err != nil {
+		return err
+	}
+	info, err := o.stat(name)
+	if err != nil || !info.IsDir() {
+		return err
+	}
+	entries, err := o.readDir(name)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := o.copyUpAll(vpath.Join(name, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	return o.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (o *overlayFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if err := checkName("open", name); err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if flag&writeFlags == 0 {
+		var f File
+		var err error
+		switch {
+		case o.inUpper(name):
+			f, err = o.upper.OpenFile(name, flag, perm)
+		case o.whiteouts[name]:
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		default:
+			f, err = o.lower.OpenFile(name, flag, perm)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info, err := f.Stat(); err == nil && info.IsDir() {
+			entries, err := o.readDir(name)
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			return &overlayDir{File: f, entries: entries}, nil
+		}
+		return f, nil
+	}
+
+	// The parent directory must exist in the merged view
+	if _, err := o.stat(vpath.Dir(name)); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if err := o.copyUp(name); err != nil {
+		return nil, err
+	}
+	f, err := o.upper.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	delete(o.whiteouts, name)
+	return f, nil
+}
+
+func (o *overlayFS) Stat(name string) (fs.FileInfo, error) {
+	if err := checkName("stat", name); err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.stat(name)
+}
+
+func (o *overlayFS) Lstat(name string) (fs.FileInfo, error) {
+	if err := checkName("lstat", name); err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.lstat(name)
+}
+
+func (o *overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := checkName("readdir", name); err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.readDir(name)
+}
+
+// readDir merges the entries of both layers. The caller holds o.mu.
+func (o *overlayFS) readDir(name string) ([]fs.DirEntry, error) {
+	if _, err := o.stat(name); err != nil {
+		return nil, err
+	}
+	merged := map[string]fs.DirEntry{}
+	if !o.whiteouts[name] {
+		lower, _ := o.lower.ReadDir(name)
+		for _, e := range lower {
+			if !o.whiteouts[vpath.Join(name, e.Name())] {
+				merged[e.Name()] = e
+			}
+		}
+	}
+	if o.inUpper(name) {
+		upper, err := o.upper.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range upper {
+			merged[e.Name()] = e
+		}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(merged))
+	for _, e := range merged {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (o *overlayFS) Mkdir(name string, perm fs.FileMode) error {
+	if err := checkName("mkdir", name); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, err := o.stat(name); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if _, err := o.stat(vpath.Dir(name)); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if err := o.copyUp(vpath.Dir(name)); err != nil {
+		return err
+	}
+	if err := o.upper.Mkdir(name, perm); err != nil {
+		return err
+	}
+	delete(o.whiteouts, name)
+	return nil
+}
+
+func (o *overlayFS) Remove(name string) error {
+	if err := checkName("remove", name); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	info, err := o.stat(name)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	if info.IsDir() {
+		entries, err := o.readDir(name)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+		}
+	}
+
+	if o.inUpper(name) {
+		if err := o.upper.Remove(name); err != nil {
+			return err
+		}
+	}
+	if _, err := o.lower.Stat(name); err == nil {
+		o.whiteouts[name] = true
+	}
+	return nil
+}
+
+func (o *overlayFS) Chmod(name string, mode fs.FileMode) error {
+	if err := checkName("chmod", name); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, err := o.stat(name); err != nil {
+		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrNotExist}
+	}
+	if err := o.copyUp(name); err != nil {
+		return err
+	}
+	return o.upper.Chmod(name, mode)
+}
+
+// Rename copies oldname up and moves it in the upper layer. Existing
+// directories are not replaced.
+func (o *overlayFS) Rename(oldname, newname string) error {
+	if err := checkName("rename", oldname); err != nil {
+		return err
+	}
+	if err := checkName("rename", newname); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, err := o.stat(oldname); err != nil {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+	}
+	if oldname == newname {
+		return nil
+	}
+	if info, err := o.stat(newname); err == nil && info.IsDir() {
+		return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrExist}
+	}
+	if _, err := o.stat(vpath.Dir(newname)); err != nil {
+		return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrNotExist}
+	}
+	if err := o.copyUpAll(oldname); err != nil {
+		return err
+	}
+	if err := o.copyUp(vpath.Dir(newname)); err != nil {
+		return err
+	}
+	if err := o.upper.Rename(oldname, newname); err != nil {
+		return err
+	}
+	o.whiteoutAll(oldname)
+	delete(o.whiteouts, newname)
+	return nil
+}
+
+// whiteoutAll hides name and, for directories, every entry below it in the
+// lower layer, so that they do not reappear under a new directory of the
+// same name. The caller holds o.mu.
+func (o *overlayFS) whiteoutAll(name string) {
+	fs.WalkDir(o.lower, name, func(p string, d fs.DirEntry, err error) error {
+		if d != nil {
+			o.whiteouts[p] = true
+		}
+		return nil
+	})
+}
+
+func (o *overlayFS) Symlink(oldname, newname string) error {
+	if err := checkName("symlink", newname); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, err := o.lstat(newname); err == nil {
+		return &fs.PathError{Op: "symlink", Path: newname, Err: fs.ErrExist}
+	}
+	if err := o.copyUp(vpath.Dir(newname)); err != nil {
+		return err
+	}
+	if err := o.upper.Symlink(oldname, newname); err != nil {
+		return err
+	}
+	delete(o.whiteouts, newname)
+	return nil
+}
+
+// overlayDir is an open directory of an overlayFS, listing the entries of
+// both layers.
+type overlayDir struct {
+	File
+	entries []fs.DirEntry
+	pos     int
+}
+
+func (d *overlayDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	return readDirPage(d.entries, &d.pos, n)
+}
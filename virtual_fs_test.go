@@ -0,0 +1,389 @@
+package kuniumi
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testLowerFS is a read-only tree used as embedded files and overlay lower layer.
+func testLowerFS() fstest.MapFS {
+	return fstest.MapFS{
+		"readme.txt":      {Data: []byte("hello"), Mode: 0644},
+		"data/cities.csv": {Data: []byte("tokyo,osaka"), Mode: 0644},
+		"data/old.txt":    {Data: []byte("old"), Mode: 0644},
+	}
+}
+
+// TestVirtualEnvironment_Backends runs the file operations of the
+// environment on each writable backend.
+func TestVirtualEnvironment_Backends(t *testing.T) {
+	backends := map[string]func(t *testing.T) FileSystem{
+		"host":    func(t *testing.T) FileSystem { return NewHostFS(t.TempDir()) },
+		"mem":     func(t *testing.T) FileSystem { return NewMemFS() },
+		"overlay": func(t *testing.T) FileSystem { return NewOverlayFS(fstest.MapFS{}, NewMemFS()) },
+	}
+	for name, newFS := range backends {
+		t.Run(name, func(t *testing.T) {
+			env := NewVirtualEnvironment(nil, nil)
+			env.Mount("/work", newFS(t))
+
+			require.NoError(t, env.WriteFile("/work/a.txt", []byte("hello world")))
+			data, err := env.ReadFile("/work/a.txt", 6, 100)
+			require.NoError(t, err)
+			assert.Equal(t, "world", string(data))
+
+			require.NoError(t, env.RewriteFile("/work/a.txt", 0, []byte("HELLO")))
+			require.NoError(t, env.CopyFile("/work/a.txt", "/work/b.txt"))
+			data, err = env.ReadFile("/work/b.txt", 0, 100)
+			require.NoError(t, err)
+			assert.Equal(t, "HELLO world", string(data))
+
+			require.NoError(t, env.Chmod("/work/b.txt", 0600))
+			files, err := env.ListFile("/work")
+			require.NoError(t, err)
+			require.Len(t, files, 2)
+			assert.Equal(t, FileInfo{Name: "a.txt", Size: 11, Mode: 0644, ModTime: files[0].ModTime}, files[0])
+			assert.Equal(t, FileInfo{Name: "b.txt", Size: 11, Mode: 0600, ModTime: files[1].ModTime}, files[1])
+			assert.False(t, files[0].ModTime.IsZero())
+
+			matches, err := env.FindFile("/work", "b.*", true)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"/work/b.txt"}, matches)
+
+			require.NoError(t, env.ChangeCurrentDirectory("/work"))
+			require.NoError(t, env.RemoveFile("a.txt"))
+			_, err = env.ReadFile("/work/a.txt", 0, 1)
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+
+			// Streaming
+			w, err := env.Create("/work/log.txt")
+			require.NoError(t, err)
+			for range 1000 {
+				_, err = io.WriteString(w, "0123456789")
+				require.NoError(t, err)
+			}
+			require.NoError(t, w.Close())
+			require.NoError(t, env.AppendFile("log.txt", []byte("end")))
+			rc, err := env.Open("/work/log.txt")
+			require.NoError(t, err)
+			n, err := io.Copy(io.Discard, rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+			assert.Equal(t, int64(10003), n)
+			data, err = env.ReadFile("/work/log.txt", 9995, 100)
+			require.NoError(t, err)
+			assert.Equal(t, "56789end", string(data))
+
+			f, err := env.OpenFile("/work/log.txt", os.O_RDWR, 0)
+			require.NoError(t, err)
+			_, err = f.WriteAt([]byte("AB"), 1)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+			data, err = env.ReadFile("/work/log.txt", 0, 4)
+			require.NoError(t, err)
+			assert.Equal(t, "0AB3", string(data))
+
+			sum, err := env.HashFile("/work/b.txt", "sha256")
+			require.NoError(t, err)
+			assert.Equal(t, "a6ff7376c7dfd7f009af8a1bae528f85992c645a40f7305c4ebb854a6e5527a6", sum)
+
+			// Directories and names
+			require.NoError(t, env.MkdirAll("/work/x/y/z"))
+			require.NoError(t, env.MkdirAll("/work/x/y"))
+			assert.Error(t, env.MkdirAll("/work/b.txt/c"))
+			require.NoError(t, env.Rename("/work/b.txt", "/work/x/y/z/b.txt"))
+			require.NoError(t, env.Rename("/work/x/y", "/work/x/w"))
+			info, err := env.Stat("/work/x/w/z/b.txt")
+			require.NoError(t, err)
+			assert.Equal(t, "b.txt", info.Name)
+			assert.Equal(t, int64(11), info.Size)
+			assert.Equal(t, fs.FileMode(0600), info.Mode)
+			info, err = env.Stat("/work/x/w")
+			require.NoError(t, err)
+			assert.True(t, info.IsDir)
+			_, err = env.Stat("/work/x/y")
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+
+			require.NoError(t, env.RemoveAll("/work/x"))
+			require.NoError(t, env.RemoveAll("/work/x"), "missing paths are not an error")
+			files, err = env.ListFile("/work")
+			require.NoError(t, err)
+			require.Len(t, files, 1)
+			assert.Equal(t, "log.txt", files[0].Name)
+		})
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	m := NewMemFS()
+	require.NoError(t, m.Mkdir("dir", 0755))
+	require.NoError(t, writeFile(m, "dir/a.txt", []byte("a"), 0644))
+	require.NoError(t, writeFile(m, "b.txt", []byte("bb"), 0644))
+	require.NoError(t, fstest.TestFS(m, "dir/a.txt", "b.txt"))
+
+	assert.ErrorIs(t, m.Mkdir("dir", 0755), fs.ErrExist)
+	assert.ErrorIs(t, m.Mkdir("missing/dir", 0755), fs.ErrNotExist)
+	assert.ErrorIs(t, m.Remove("dir"), errNotEmpty)
+	_, err := m.OpenFile("dir", os.O_WRONLY, 0)
+	assert.ErrorIs(t, err, errIsDir)
+	_, err = m.OpenFile("b.txt", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	assert.ErrorIs(t, err, fs.ErrExist)
+	_, err = m.Open("../b.txt")
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+
+	f, err := m.OpenFile("b.txt", os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("cc"))
+	require.NoError(t, err)
+	_, err = f.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, fs.ErrPermission, "write-only file")
+	require.NoError(t, f.Close())
+	data, err := fs.ReadFile(m, "b.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "bbcc", string(data))
+
+	require.NoError(t, m.Rename("dir", "dir2"))
+	require.NoError(t, fstest.TestFS(m, "dir2/a.txt", "b.txt"))
+	assert.ErrorIs(t, m.Rename("dir2", "dir2/sub"), fs.ErrInvalid)
+	assert.ErrorIs(t, m.Rename("b.txt", "dir2"), errIsDir)
+	assert.ErrorIs(t, m.Rename("missing", "x"), fs.ErrNotExist)
+	assert.ErrorIs(t, m.Symlink("b.txt", "link"), errors.ErrUnsupported)
+
+	// Sparse and oversized writes
+	f, err = m.OpenFile("b.txt", os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.(io.WriterAt).WriteAt([]byte("e"), 6)
+	require.NoError(t, err)
+	_, err = f.(io.WriterAt).WriteAt([]byte("x"), 1<<40)
+	assert.ErrorIs(t, err, errFileTooLarge)
+	require.NoError(t, f.Close())
+	data, err = fs.ReadFile(m, "b.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "bbcc\x00\x00e", string(data))
+}
+
+func TestMemFS_SequentialWrites(t *testing.T) {
+	m := NewMemFS()
+	f, err := m.OpenFile("big", os.O_CREATE|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	chunk := bytes.Repeat([]byte{'x'}, 32<<10)
+	allocs := testing.AllocsPerRun(1, func() {
+		for range 1024 { // 32 MiB
+			_, err := f.Write(chunk)
+			require.NoError(t, err)
+		}
+	})
+	require.NoError(t, f.Close())
+	assert.Less(t, allocs, float64(100), "the file grows with spare capacity rather than on every write")
+
+	info, err := m.Stat("big")
+	require.NoError(t, err)
+	assert.Equal(t, int64(64<<20), info.Size(), "AllocsPerRun also runs the writes once to warm up")
+
+	// A write that starts inside the file and ends past its end
+	f, err = m.OpenFile("overlap", os.O_CREATE|os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("0123456789"))
+	require.NoError(t, err)
+	_, err = f.Seek(5, io.SeekStart)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("abcdefghijklmnop"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	data, err := fs.ReadFile(m, "overlap")
+	require.NoError(t, err)
+	assert.Equal(t, "01234abcdefghijklmnop", string(data))
+}
+
+func TestReadOnlyFS(t *testing.T) {
+	ro := NewReadOnlyFS(testLowerFS())
+	require.NoError(t, fstest.TestFS(ro, "readme.txt", "data/cities.csv"))
+
+	_, err := ro.OpenFile("readme.txt", os.O_WRONLY, 0)
+	assert.ErrorIs(t, err, fs.ErrPermission)
+	assert.ErrorIs(t, ro.Remove("readme.txt"), fs.ErrPermission)
+
+	env := NewVirtualEnvironment(nil, nil)
+	env.mount("/assets", mountPoint{fs: ro, source: "embed:assets", readOnly: true})
+	data, err := env.ReadFile("/assets/data/cities.csv", 6, 5)
+	require.NoError(t, err)
+	assert.Equal(t, "osaka", string(data))
+	assert.ErrorIs(t, env.WriteFile("/assets/readme.txt", nil), fs.ErrPermission)
+}
+
+func TestOverlayFS(t *testing.T) {
+	lower := testLowerFS()
+	o := NewOverlayFS(lower, NewMemFS())
+
+	require.NoError(t, writeFile(o, "readme.txt", []byte("changed"), 0644))
+	require.NoError(t, writeFile(o, "data/new.txt", []byte("new"), 0644))
+	require.NoError(t, o.Remove("data/old.txt"))
+	require.NoError(t, o.Mkdir("empty", 0755))
+	require.NoError(t, fstest.TestFS(o, "readme.txt", "data/cities.csv", "data/new.txt", "empty"))
+
+	data, err := fs.ReadFile(o, "readme.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "changed", string(data))
+	assert.Equal(t, "hello", string(lower["readme.txt"].Data), "the lower layer is not modified")
+
+	_, err = o.Stat("data/old.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist, "removed lower files are hidden")
+	entries, err := o.ReadDir("data")
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.Equal(t, []string{"cities.csv", "new.txt"}, names)
+
+	// A removed file can be created again
+	require.NoError(t, writeFile(o, "data/old.txt", []byte("again"), 0644))
+	data, err = fs.ReadFile(o, "data/old.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "again", string(data))
+
+	assert.ErrorIs(t, o.Remove("data"), errNotEmpty)
+	assert.ErrorIs(t, o.Mkdir("readme.txt", 0755), fs.ErrExist)
+
+	// Renaming a lower directory moves its merged content
+	require.NoError(t, o.Rename("data", "moved"))
+	require.NoError(t, fstest.TestFS(o, "readme.txt", "moved/cities.csv", "moved/new.txt", "moved/old.txt"))
+	_, err = o.Stat("data")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.Contains(t, lower, "data/cities.csv", "the lower layer is not modified")
+
+	// The content of the renamed directory is gone from its old path, even
+	// under a new directory of the same name
+	_, err = o.Stat("data/cities.csv")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = o.Open("data/cities.csv")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	require.NoError(t, o.Mkdir("data", 0755))
+	entries, err = o.ReadDir("data")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	_, err = o.Stat("data/cities.csv")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestParseMountSpec(t *testing.T) {
+	filesystems := map[string]fs.FS{"assets": testLowerFS()}
+	hostDir := t.TempDir()
+
+	virt, m, err := parseMountSpec("./data:/data/", filesystems)
+	require.NoError(t, err)
+	assert.Equal(t, "/data", virt)
+	assert.Equal(t, mountPoint{host: "./data"}, m)
+
+	virt, m, err = parseMountSpec(`C:\work:/work`, filesystems)
+	require.NoError(t, err)
+	assert.Equal(t, "/work", virt)
+	assert.Equal(t, `C:\work`, m.host)
+
+	for spec, want := range map[string]struct {
+		virt, source string
+		readOnly     bool
+	}{
+		"mem:/scratch":               {"/scratch", "mem", false},
+		"embed:/assets":              {"/assets", "embed:assets", true},
+		"embed:assets:/ref":          {"/ref", "embed:assets", true},
+		"overlay:assets:/tmpl":       {"/tmpl", "overlay:assets", false},
+		"overlay:" + hostDir + ":/h": {"/h", "overlay:" + hostDir, false},
+	} {
+		virt, m, err := parseMountSpec(spec, filesystems)
+		require.NoError(t, err, spec)
+		assert.Equal(t, want.virt, virt, spec)
+		assert.Equal(t, want.source, m.source, spec)
+		assert.Equal(t, want.readOnly, m.readOnly, spec)
+		assert.NotNil(t, m.fs, spec)
+	}
+
+	for _, spec := range []string{
+		"/data", "data:relative", "mem:x:/scratch", "embed:/missing", "embed:/assets:rw", "./data:/data:rx",
+		"overlay:" + filepath.Join(hostDir, "missing") + ":/x",
+	} {
+		_, _, err := parseMountSpec(spec, filesystems)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestParseMountSpec_Options(t *testing.T) {
+	virt, m, err := parseMountSpec(`C:\src:/src:ro`, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "/src", virt)
+	assert.Equal(t, mountPoint{host: `C:\src`, readOnly: true}, m)
+
+	_, m, err = parseMountSpec("./out:/out:rw,noexec,nodelete", nil)
+	require.NoError(t, err)
+	assert.Equal(t, mountPoint{host: "./out", noExec: true, noDelete: true}, m)
+	assert.Equal(t, "/abs/out:/out:noexec,nodelete", mountSpec("/abs/out", "/out", m))
+
+	_, m, err = parseMountSpec("mem:/tmp:nodelete", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "mem:/tmp:nodelete", mountSpec(m.source, "/tmp", m))
+}
+
+func TestVirtualEnvironment_MountPermissions(t *testing.T) {
+	env := NewVirtualEnvironment(nil, nil)
+	src := NewMemFS()
+	require.NoError(t, writeFile(src, "main.go", []byte("package main"), 0644))
+	env.mount("/src", mountPoint{fs: src, readOnly: true})
+	env.mount("/out", mountPoint{fs: NewMemFS(), noExec: true, noDelete: true})
+
+	// Sources can be read, and copied to the output directory only
+	data, err := env.ReadFile("/src/main.go", 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "package main", string(data))
+	require.NoError(t, env.CopyFile("/src/main.go", "/out/main.go"))
+	require.NoError(t, env.RewriteFile("/out/main.go", 0, []byte("PACKAGE")))
+	require.NoError(t, env.Chmod("/out/main.go", 0600))
+
+	for name, err := range map[string]error{
+		"write":      env.WriteFile("/src/main.go", nil),
+		"rewrite":    env.RewriteFile("/src/main.go", 0, nil),
+		"copy":       env.CopyFile("/out/main.go", "/src/copy.go"),
+		"remove src": env.RemoveFile("/src/main.go"),
+		"chmod src":  env.Chmod("/src/main.go", 0600),
+		"remove out": env.RemoveFile("/out/main.go"),
+		"chmod +x":   env.Chmod("/out/main.go", 0755),
+	} {
+		var permErr *MountPermissionError
+		require.ErrorAs(t, err, &permErr, name)
+		assert.ErrorIs(t, err, fs.ErrPermission, name)
+	}
+	for name, err := range map[string]error{
+		"create":        func() error { _, err := env.Create("/src/x.go"); return err }(),
+		"open rw":       func() error { _, err := env.OpenFile("/src/main.go", os.O_RDWR, 0); return err }(),
+		"append":        env.AppendFile("/src/main.go", nil),
+		"mkdir":         env.MkdirAll("/src/dir"),
+		"rename src":    env.Rename("/src/main.go", "/src/x.go"),
+		"symlink":       env.Symlink("main.go", "/src/link"),
+		"remove all":    env.RemoveAll("/out/main.go"),
+		"create +x":     func() error { _, err := env.OpenFile("/out/run.sh", os.O_CREATE|os.O_WRONLY, 0755); return err }(),
+		"rename onto":   env.Rename("/out/main.go", "/out/main.go"),
+		"rename out":    env.Rename("/out/main.go", "/out/new.go"),
+		"rename to src": env.Rename("/out/main.go", "/src/main.go"),
+	} {
+		var permErr *MountPermissionError
+		require.ErrorAs(t, err, &permErr, name)
+	}
+	rc, err := env.Open("/src/main.go")
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.NoError(t, env.AppendFile("/out/main.go", []byte("\n")))
+	env.Mount("/tmp", NewMemFS())
+	assert.ErrorIs(t, env.Rename("/out/main.go", "/tmp/main.go"), errCrossMount)
+
+	assert.EqualError(t, env.RemoveFile("/out/main.go"), "remove /out/main.go: permission denied (mount /out is nodelete)")
+	assert.EqualError(t, env.Rename("/out/main.go", "/out/new.go"), "rename /out/main.go: permission denied (mount /out is nodelete)")
+	assert.EqualError(t, env.WriteFile("/src/main.go", nil), "write /src/main.go: permission denied (mount /src is read-only)")
+}